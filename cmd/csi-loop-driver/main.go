@@ -1,14 +1,26 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/marxus/csi-loop-driver/conf"
 	"github.com/marxus/csi-loop-driver/pkg/serve"
 	"k8s.io/klog/v2"
 )
 
 func main() {
 	klog.InitFlags(nil)
+	envName := flag.String("env", "release", fmt.Sprintf("environment to run in (%s)", strings.Join(conf.Environments, ", ")))
+	flag.Parse()
+
+	env, err := conf.New(*envName)
+	if err != nil {
+		klog.Fatalf("Failed to run driver: %v", err)
+	}
 
-	if err := serve.StartDriver(); err != nil {
+	if err := serve.StartDriver(env); err != nil {
 		klog.Fatalf("Failed to run driver: %v", err)
 	}
 }
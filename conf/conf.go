@@ -0,0 +1,98 @@
+// Package conf provides environment-specific configuration for the CSI loop driver.
+// An Env holds the filesystem, commands, mounts and clock the driver runs with, so the release,
+// development and test environments are runtime options rather than builds.
+package conf
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/marxus/csi-loop-driver/pkg/command"
+	"github.com/marxus/csi-loop-driver/pkg/mount"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+)
+
+// Environments lists the environments New returns by name.
+var Environments = []string{"release", "develop"}
+
+// Env is the environment the driver runs in.
+type Env struct {
+	// NodeId is the unique identifier for the node running this driver.
+	NodeId string
+
+	// FS is the filesystem abstraction used by the driver.
+	FS afero.Fs
+
+	// RealPath converts virtual paths of FS to real filesystem paths.
+	RealPath func(path string) string
+
+	// Runner runs system commands, bounded by the context of the request and a timeout per command.
+	Runner command.Runner
+
+	// Mounter mounts the filesystems of volumes.
+	Mounter mount.Mounter
+
+	// Loop manages backing files and the loop devices they are attached to.
+	Loop mount.LoopManager
+
+	// Statfs reports the total and available bytes of the filesystem containing path.
+	Statfs func(path string) (total, available int64, err error)
+
+	// AllocatedBytes reports the number of bytes actually allocated on disk for a file.
+	// For sparse files this is smaller than the apparent file size.
+	AllocatedBytes func(path string) (int64, error)
+
+	// DataExtents returns the offset and length of each region of a sparse file holding data,
+	// skipping its holes.
+	DataExtents func(path string) ([][2]int64, error)
+
+	// CopyOnWrite reports whether writes to the file at path may go to new blocks instead of
+	// overwriting its data in place, which is always the case on btrfs and for files sharing
+	// extents with reflinked clones, e.g. on xfs.
+	CopyOnWrite func(path string) (bool, error)
+
+	// Writable reports whether files can be created in the directory at path.
+	// It fails for missing directories, missing permissions and read-only filesystems.
+	Writable func(path string) error
+
+	// KernelRelease returns the release of the running kernel, e.g. 6.8.0-45-generic.
+	KernelRelease func() (string, error)
+
+	// Now returns the current time.
+	Now func() time.Time
+
+	// Metrics is the registry the metrics of the driver are registered with and served from.
+	Metrics *prometheus.Registry
+
+	// Allocation serializes budget checks with the allocation of backing files,
+	// so concurrent requests cannot both claim the last free part of the budget.
+	Allocation sync.Mutex
+
+	// Placements advances with every volume placed by the round-robin strategy.
+	Placements atomic.Uint64
+
+	// WipeQueued wakes the wiper after a backing file was queued for wiping.
+	WipeQueued chan struct{}
+}
+
+// New returns the environment of the given name, see Environments.
+//
+// Returns an error if the name is unknown.
+func New(name string) (*Env, error) {
+	switch name {
+	case "release":
+		return Release(), nil
+	case "develop":
+		return Develop(), nil
+	}
+	return nil, fmt.Errorf("unknown environment %q, use one of %v", name, Environments)
+}
+
+// initFS creates required directories in the filesystem.
+func (e *Env) initFS() {
+	e.FS.MkdirAll("/csi", 0755)
+	e.FS.MkdirAll("/var/lib/csi-loop", 0755)
+}
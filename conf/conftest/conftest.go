@@ -0,0 +1,63 @@
+// Package conftest provides the test environment of the driver, kept out of the driver binary.
+package conftest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/command"
+	"github.com/marxus/csi-loop-driver/pkg/mount"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+)
+
+// New returns a test environment of its own, so tests using one each can run in parallel.
+// It sets up an in-memory filesystem and mocks Runner, Statfs, AllocatedBytes, DataExtents,
+// CopyOnWrite, Writable and KernelRelease to fail by default. Tests should override them with their own mock implementations.
+// Mounter and Loop report their operations to Runner as the equivalent util-linux commands,
+// so mocks of Runner record and fail them along with the other commands.
+// The node is "test-node".
+func New() *conf.Env {
+	env := &conf.Env{
+		NodeId:   "test-node",
+		FS:       afero.NewMemMapFs(),
+		RealPath: func(path string) string { return path },
+		Runner: &command.Fake{Script: func(input []byte, name string, args ...string) (string, error) {
+			return "", fmt.Errorf("Runner not mocked in test: %s %v", name, args)
+		}},
+		Statfs: func(path string) (int64, int64, error) {
+			return 0, 0, fmt.Errorf("Statfs not mocked in test: %s", path)
+		},
+		AllocatedBytes: func(path string) (int64, error) {
+			return 0, fmt.Errorf("AllocatedBytes not mocked in test: %s", path)
+		},
+		DataExtents: func(path string) ([][2]int64, error) {
+			return nil, fmt.Errorf("DataExtents not mocked in test: %s", path)
+		},
+		CopyOnWrite: func(path string) (bool, error) {
+			return false, fmt.Errorf("CopyOnWrite not mocked in test: %s", path)
+		},
+		Writable: func(path string) error {
+			return fmt.Errorf("Writable not mocked in test: %s", path)
+		},
+		KernelRelease: func() (string, error) {
+			return "", fmt.Errorf("KernelRelease not mocked in test")
+		},
+		Now:        time.Now,
+		Metrics:    prometheus.NewRegistry(),
+		WipeQueued: make(chan struct{}, 1),
+	}
+
+	fake := &mount.Fake{Run: func(name string, args ...string) error {
+		_, err := env.Runner.Run(context.Background(), name, args...)
+		return err
+	}}
+	env.Mounter, env.Loop = fake, fake
+
+	// The directories of the other environments
+	env.FS.MkdirAll("/csi", 0755)
+	env.FS.MkdirAll("/var/lib/csi-loop", 0755)
+	return env
+}
@@ -1,31 +1,34 @@
-//go:build release
-
-// Package conf provides environment-specific configuration for the CSI loop driver.
-// This file contains the release/production configuration using the real filesystem.
 package conf
 
 import (
 	"os"
-	"os/exec"
-)
-
-// FS is the filesystem abstraction used by the driver.
-// In release mode, this uses the real operating system filesystem.
-const FS = afero.NewOsFs()
+	"time"
 
-// NodeId is the unique identifier for the node running this driver.
-// It is read from the NODE_ID environment variable.
-const NodeId = os.Getenv("NODE_ID")
-
-// RealPath converts virtual paths to real filesystem paths.
-// In release mode, paths are used as-is without translation.
-const RealPath = func(path string) string {
-	return path
-}
+	"github.com/marxus/csi-loop-driver/pkg/command"
+	"github.com/marxus/csi-loop-driver/pkg/mount"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+)
 
-// RunCommand executes system commands.
-// In release mode, this runs actual system commands via exec.Command.
-const RunCommand = func(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	return cmd.Run()
+// Release returns the release/production environment.
+// It uses the real operating system filesystem with paths as-is, runs actual system commands
+// and mounts with real system calls. The node is identified by the NODE_ID environment variable.
+func Release() *Env {
+	return &Env{
+		NodeId:         os.Getenv("NODE_ID"),
+		FS:             afero.NewOsFs(),
+		RealPath:       func(path string) string { return path },
+		Runner:         command.NewRunner(),
+		Mounter:        mount.NewMounter(),
+		Loop:           mount.NewLoopManager(),
+		Statfs:         statfs,
+		AllocatedBytes: allocatedBytes,
+		DataExtents:    dataExtents,
+		CopyOnWrite:    copyOnWrite,
+		Writable:       writable,
+		KernelRelease:  kernelRelease,
+		Now:            time.Now,
+		Metrics:        prometheus.NewRegistry(),
+		WipeQueued:     make(chan struct{}, 1),
+	}
 }
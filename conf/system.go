@@ -0,0 +1,66 @@
+package conf
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// statfs queries the real filesystem containing path, see Env.Statfs.
+func statfs(path string) (total, available int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Blocks) * int64(st.Bsize), int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// allocatedBytes stats the real file at path, see Env.AllocatedBytes.
+func allocatedBytes(path string) (int64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Blocks * 512, nil
+}
+
+// dataExtents walks the real file at path with SEEK_DATA and SEEK_HOLE, see Env.DataExtents.
+func dataExtents(path string) ([][2]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var extents [][2]int64
+	for offset := int64(0); ; {
+		start, err := unix.Seek(int(f.Fd()), offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			return extents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := unix.Seek(int(f.Fd()), start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, [2]int64{start, end - start})
+		offset = end
+	}
+}
+
+// writable checks the real directory at path, see Env.Writable.
+func writable(path string) error {
+	return unix.Access(path, unix.W_OK)
+}
+
+// kernelRelease asks the real kernel for its release, see Env.KernelRelease.
+func kernelRelease() (string, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "", err
+	}
+	return unix.ByteSliceToString(uts.Release[:]), nil
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package conf
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fiemap ioctl of linux/fiemap.h, which golang.org/x/sys/unix does not define.
+const (
+	fsIocFiemap        = 0xc020660b
+	fiemapExtentLast   = 0x1
+	fiemapExtentShared = 0x2000
+	fiemapBatch        = 64
+)
+
+// fiemapExtent is struct fiemap_extent.
+type fiemapExtent struct {
+	Logical  uint64
+	Physical uint64
+	Length   uint64
+	_        [2]uint64
+	Flags    uint32
+	_        [3]uint32
+}
+
+// fiemapRequest is struct fiemap followed by room for a batch of extents.
+type fiemapRequest struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	_             uint32
+	Extents       [fiemapBatch]fiemapExtent
+}
+
+// copyOnWrite checks the filesystem of the real file at path and walks its extents with
+// FIEMAP for shared ones, see Env.CopyOnWrite.
+func copyOnWrite(path string) (bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false, err
+	}
+	if st.Type == unix.BTRFS_SUPER_MAGIC {
+		return true, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	for start := uint64(0); ; {
+		req := fiemapRequest{Start: start, Length: ^uint64(0) - start, ExtentCount: fiemapBatch}
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&req))); errno != 0 {
+			// Filesystems without FIEMAP support have no reflinks either
+			if errno == unix.EOPNOTSUPP || errno == unix.ENOTTY {
+				return false, nil
+			}
+			return false, errno
+		}
+		if req.MappedExtents == 0 {
+			return false, nil
+		}
+		for _, extent := range req.Extents[:req.MappedExtents] {
+			if extent.Flags&fiemapExtentShared != 0 {
+				return true, nil
+			}
+			if extent.Flags&fiemapExtentLast != 0 {
+				return false, nil
+			}
+			start = extent.Logical + extent.Length
+		}
+	}
+}
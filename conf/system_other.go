@@ -0,0 +1,14 @@
+//go:build !linux
+
+package conf
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyOnWrite fails with ENOTSUP outside of Linux, FIEMAP being specific to it, see Env.CopyOnWrite.
+func copyOnWrite(path string) (bool, error) {
+	return false, &os.PathError{Op: "ioctl", Path: path, Err: unix.ENOTSUP}
+}
@@ -0,0 +1,120 @@
+// Package command runs external tools such as mkfs and cryptsetup. Commands are bounded by the
+// context of the request and a timeout per command, and killed along with their children once
+// either is done. Failed commands return *Error carrying their stderr.
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultTimeout bounds commands without a timeout of their own.
+const DefaultTimeout = 2 * time.Minute
+
+// defaultTimeouts bounds commands that take longer than DefaultTimeout on large volumes.
+var defaultTimeouts = map[string]time.Duration{
+	// Sparse copies of images on filesystems without reflinks
+	"cp":         30 * time.Minute,
+	"e2fsck":     30 * time.Minute,
+	"xfs_repair": 30 * time.Minute,
+	"btrfs":      30 * time.Minute,
+	"resize2fs":  10 * time.Minute,
+	"mkfs.btrfs": 10 * time.Minute,
+	"mkfs.ext4":  10 * time.Minute,
+	"mkfs.xfs":   10 * time.Minute,
+}
+
+// waitDelay is how long a killed command may keep its output open, e.g. through a child that
+// left its process group, before its output is abandoned.
+const waitDelay = 5 * time.Second
+
+// Runner runs commands.
+type Runner interface {
+	// Run runs the command and returns its stdout.
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+	// RunWithInput runs the command with input written to its stdin and returns its stdout,
+	// for secrets that must not show up in the process list.
+	RunWithInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error)
+}
+
+// Error is a command that failed.
+type Error struct {
+	// Name is the name of the command.
+	Name string
+	// Stderr holds what the command wrote to stderr.
+	Stderr string
+	// Err is the *exec.ExitError of a command that exited with a failure, an error wrapping
+	// context.DeadlineExceeded of a command killed at its timeout, or the error of its context.
+	Err error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %v", e.Name, e.Err)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// runner runs commands with os/exec.
+type runner struct {
+	// timeouts bounds commands by name.
+	timeouts map[string]time.Duration
+}
+
+// NewRunner returns a Runner executing commands.
+func NewRunner() Runner {
+	return &runner{timeouts: defaultTimeouts}
+}
+
+func (r *runner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return r.run(ctx, nil, name, args)
+}
+
+func (r *runner) RunWithInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error) {
+	return r.run(ctx, input, name, args)
+}
+
+func (r *runner) run(ctx context.Context, input []byte, name string, args []string) ([]byte, error) {
+	timeout := r.timeout(name)
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, fmt.Errorf("timed out after %v: %w", timeout, context.DeadlineExceeded))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Children of the command, e.g. the helpers of mkfs, are killed along with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = waitDelay
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = context.Cause(ctx)
+		}
+		return stdout.Bytes(), &Error{Name: name, Stderr: stderr.String(), Err: err}
+	}
+	return stdout.Bytes(), nil
+}
+
+// timeout returns how long the named command may run before it is killed.
+func (r *runner) timeout(name string) time.Duration {
+	if timeout, ok := r.timeouts[name]; ok {
+		return timeout
+	}
+	return DefaultTimeout
+}
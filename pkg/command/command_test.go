@@ -0,0 +1,90 @@
+// Command runner tests.
+package command
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunner_Run(t *testing.T) {
+	t.Parallel()
+
+	runner := NewRunner()
+
+	stdout, err := runner.Run(context.Background(), "sh", "-c", "echo /dev/loop7; echo ignored >&2")
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/loop7\n", string(stdout))
+
+	stdout, err = runner.RunWithInput(context.Background(), []byte("hunter2"), "cat")
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", string(stdout))
+
+	// Failures carry the exit status and stderr of the command
+	_, err = runner.Run(context.Background(), "sh", "-c", "echo 'ERROR: device too small' >&2; exit 1")
+	assert.EqualError(t, err, "sh: exit status 1: ERROR: device too small")
+	var exit *exec.ExitError
+	require.ErrorAs(t, err, &exit)
+	assert.Equal(t, 1, exit.ExitCode())
+
+	_, err = runner.Run(context.Background(), "mkfs.missing")
+	assert.ErrorIs(t, err, exec.ErrNotFound)
+}
+
+func TestRunner_Timeout(t *testing.T) {
+	t.Parallel()
+
+	runner := &runner{timeouts: map[string]time.Duration{"sh": 100 * time.Millisecond}}
+
+	// The children of the command are killed too, so the command returns before waitDelay
+	start := time.Now()
+	_, err := runner.Run(context.Background(), "sh", "-c", "sleep 10 & sleep 10")
+	assert.Less(t, time.Since(start), waitDelay)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "sh: timed out after 100ms")
+}
+
+func TestRunner_Canceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := NewRunner().Run(ctx, "sleep", "10")
+	assert.Less(t, time.Since(start), waitDelay)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestFake(t *testing.T) {
+	t.Parallel()
+
+	var inputs []string
+	fake := &Fake{Script: func(input []byte, name string, args ...string) (string, error) {
+		inputs = append(inputs, string(input))
+		if name == "losetup" {
+			return "/dev/loop3\n", nil
+		}
+		return "", errors.New("exit status 1")
+	}}
+
+	stdout, err := fake.Run(context.Background(), "losetup", "--find", "--show", "/a.img")
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/loop3\n", string(stdout))
+
+	_, err = fake.RunWithInput(context.Background(), []byte("key"), "cryptsetup", "open")
+	assert.EqualError(t, err, "exit status 1")
+	assert.Equal(t, []string{"", "key"}, inputs)
+
+	// Commands of canceled requests do not run
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fake.Run(ctx, "losetup", "--find")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, inputs, 2)
+}
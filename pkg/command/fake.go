@@ -0,0 +1,23 @@
+package command
+
+import "context"
+
+// Fake is a Runner for tests. Instead of running a command, it passes it to Script, which
+// returns what the command writes to stdout, e.g. the device of losetup --show, or its failure.
+// Commands run without input are passed a nil input.
+type Fake struct {
+	// Script is called with every command.
+	Script func(input []byte, name string, args ...string) (string, error)
+}
+
+func (f *Fake) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return f.RunWithInput(ctx, nil, name, args...)
+}
+
+func (f *Fake) RunWithInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &Error{Name: name, Err: context.Cause(ctx)}
+	}
+	stdout, err := f.Script(input, name, args...)
+	return []byte(stdout), err
+}
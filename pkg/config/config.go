@@ -0,0 +1,566 @@
+// Package config provides the runtime configuration of the CSI loop driver.
+// The configuration is read from a JSON file, typically rendered by the Helm chart
+// into a ConfigMap and mounted into the driver container.
+package config
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// DefaultPoolName is the name of the implicit pool used when no pools are configured.
+	DefaultPoolName = "default"
+	// DefaultPoolPath is the directory of the implicit pool.
+	DefaultPoolPath = "/var/lib/csi-loop"
+	// DefaultFilesystem is used for pools that do not configure a filesystem.
+	DefaultFilesystem = "btrfs"
+	// DefaultRetainTTL is how long retained volumes are kept when RetainTTL is not set.
+	DefaultRetainTTL = 24 * time.Hour
+	// DefaultSourceCatalog is the directory of the archives volumes can be seeded from
+	// when SourceCatalog is not set.
+	DefaultSourceCatalog = "/var/lib/csi-loop-sources"
+	// DefaultImageCatalog is the directory of the OCI layouts volumes can be seeded from
+	// when ImageCatalog is not set.
+	DefaultImageCatalog = "/var/lib/csi-loop-images"
+	// DefaultArchiveMaxAge is how long archived volumes are kept when Archive.MaxAge is not set.
+	DefaultArchiveMaxAge = 7 * 24 * time.Hour
+	// DefaultWarmPoolMinFreePercent is the free space below which the warm pool stops filling
+	// when WarmPool.MinFreePercent is not set.
+	DefaultWarmPoolMinFreePercent = 15
+	// DefaultMetricsAddress is the address metrics are served on when MetricsAddress is not set.
+	DefaultMetricsAddress = ":9180"
+)
+
+// Filesystems lists the filesystems volumes can be formatted with.
+var Filesystems = []string{"btrfs", "ext4", "xfs"}
+
+// Placement strategies choosing a pool for volumes that do not select one.
+const (
+	// PlacementMostFreeSpace picks the pool with the most available capacity.
+	PlacementMostFreeSpace = "mostFreeSpace"
+	// PlacementRoundRobin cycles through the pools.
+	PlacementRoundRobin = "roundRobin"
+	// PlacementLeastVolumes picks the pool holding the fewest volumes.
+	PlacementLeastVolumes = "leastVolumes"
+)
+
+// Placements lists the supported placement strategies.
+var Placements = []string{PlacementMostFreeSpace, PlacementRoundRobin, PlacementLeastVolumes}
+
+// Wipe policies for the backing files of deleted volumes.
+const (
+	// WipePolicyNone removes backing files without wiping them.
+	WipePolicyNone = "none"
+	// WipePolicyDiscard punches holes into backing files before removing them,
+	// so their blocks are discarded by filesystems and devices supporting it.
+	WipePolicyDiscard = "discard"
+	// WipePolicyOverwrite overwrites the data of backing files with zeros in the background
+	// before removing them. Copy-on-write backing files are discarded instead.
+	WipePolicyOverwrite = "overwrite"
+)
+
+// WipePolicies lists the supported wipe policies.
+var WipePolicies = []string{WipePolicyNone, WipePolicyDiscard, WipePolicyOverwrite}
+
+// MountRelaxations lists the mount options relaxing the hardened mount options of volumes,
+// undoing nosuid, nodev and noexec.
+var MountRelaxations = []string{"suid", "dev", "exec"}
+
+// AllNamespaces is the namespace key of settings applying to every namespace.
+const AllNamespaces = "*"
+
+// Config holds the tunable settings of the driver.
+type Config struct {
+	// OvercommitRatio scales the capacity reported to the scheduler and the node budget.
+	// A ratio of 1.0 promises exactly the space of the backing filesystem,
+	// higher values allow sparse volumes to be overcommitted.
+	OvercommitRatio float64 `json:"overcommitRatio"`
+	// Capacity caps the total size of all volumes on the node, e.g. "200Gi".
+	// Defaults to the size of the backing filesystem.
+	// Only applies to the implicit default pool, configured pools have their own budget.
+	Capacity *resource.Quantity `json:"capacity,omitempty"`
+	// CapacityPercent caps the total size of all volumes to a percentage of the
+	// backing filesystem size. It is ignored when Capacity is set.
+	CapacityPercent float64 `json:"capacityPercent,omitempty"`
+	// Reserved is space on the backing filesystem that is never promised to volumes.
+	Reserved resource.Quantity `json:"reserved,omitempty"`
+	// CacheCapacity caps the total size of the cache images on the node, e.g. "50Gi".
+	// The least recently used caches are evicted beyond it. Unset is unlimited.
+	// Only applies to the implicit default pool, configured pools have their own limit.
+	CacheCapacity *resource.Quantity `json:"cacheCapacity,omitempty"`
+	// WarmPool keeps pre-formatted images ready in all pools, unless a pool overrides it.
+	WarmPool *WarmPool `json:"warmPool,omitempty"`
+	// WipePolicy is how the backing files of deleted volumes are wiped in all pools,
+	// unless a pool overrides it. Defaults to none.
+	WipePolicy string `json:"wipePolicy,omitempty"`
+	// Sizing bounds volume sizes in all pools, unless a pool overrides it.
+	Sizing
+	// Pools are the named storage pools volumes can be placed in, keyed by name.
+	// Without pools, all volumes go into a single pool at /var/lib/csi-loop.
+	Pools map[string]Pool `json:"pools,omitempty"`
+	// DefaultPool is the pool used for volumes that do not select one.
+	// It may be omitted if only one pool is configured.
+	DefaultPool string `json:"defaultPool,omitempty"`
+	// Placement is the strategy choosing a pool for volumes that do not select one,
+	// instead of the default pool. Unhealthy and full pools are skipped.
+	Placement string `json:"placement,omitempty"`
+	// NamespaceQuotas limits the loop storage each namespace may use on a node.
+	NamespaceQuotas NamespaceQuotas `json:"namespaceQuotas,omitempty"`
+	// RetainTTL is how long an inline volume with retainPolicy keep is kept after its pod
+	// is gone, waiting for a pod with the same identity. Defaults to 24h.
+	RetainTTL *metav1.Duration `json:"retainTTL,omitempty"`
+	// Archive keeps the backing files of deleted inline volumes for post-mortem debugging.
+	Archive Archive `json:"archive,omitempty"`
+	// MountPolicy hardens the mounts of volumes and lists the namespaces that may relax it.
+	MountPolicy MountPolicy `json:"mountPolicy,omitempty"`
+	// SourceCatalog is the node-local directory holding the tar archives new inline volumes
+	// can be seeded from. Defaults to /var/lib/csi-loop-sources.
+	SourceCatalog string `json:"sourceCatalog,omitempty"`
+	// ImageCatalog is the node-local directory holding the OCI image layouts new inline volumes
+	// can be seeded from, one layout per repository. Defaults to /var/lib/csi-loop-images.
+	ImageCatalog string `json:"imageCatalog,omitempty"`
+	// RegistryMirror is the base URL of a registry that images missing from the image catalog
+	// are pulled from, e.g. "http://registry.local:5000". Unset only uses the catalog.
+	RegistryMirror string `json:"registryMirror,omitempty"`
+	// MetricsAddress is the address Prometheus metrics are served on. Defaults to :9180.
+	MetricsAddress string `json:"metricsAddress,omitempty"`
+}
+
+// WarmPool configures the pre-formatted images kept ready for new inline volumes,
+// so publishing skips mkfs.
+type WarmPool struct {
+	// Images is the number of images kept ready per size class. Zero disables the warm pool.
+	Images int `json:"images,omitempty"`
+	// SizeClasses are the sizes images are kept ready in, e.g. ["1Gi", "10Gi"]. A volume takes
+	// an image of the largest class not above its size, which is grown to the volume size.
+	SizeClasses []resource.Quantity `json:"sizeClasses,omitempty"`
+	// MinFreePercent pauses filling while less of the filesystem of the pool is free. Defaults to 15.
+	MinFreePercent float64 `json:"minFreePercent,omitempty"`
+}
+
+// Enabled reports whether images are kept ready.
+func (w *WarmPool) Enabled() bool {
+	return w != nil && w.Images > 0 && len(w.SizeClasses) > 0
+}
+
+// MinFree returns the percentage of free space below which filling pauses.
+func (w *WarmPool) MinFree() float64 {
+	return cmp.Or(w.MinFreePercent, DefaultWarmPoolMinFreePercent)
+}
+
+// MountPolicy hardens the mounts of volumes. Volumes are always mounted nosuid and nodev,
+// so setuid binaries and device nodes planted in a volume take no effect.
+type MountPolicy struct {
+	// NoExec also mounts volumes noexec.
+	NoExec bool `json:"noexec,omitempty"`
+	// Allow lists the mount options of MountRelaxations the volumes of a namespace may relax,
+	// keyed by namespace. The key "*" applies to every namespace. Unset allows no relaxations.
+	Allow map[string][]string `json:"allow,omitempty"`
+}
+
+// Allowed reports whether the volumes of a namespace may relax a hardened mount option.
+func (p MountPolicy) Allowed(namespace, relaxation string) bool {
+	if namespace != "" && slices.Contains(p.Allow[namespace], relaxation) {
+		return true
+	}
+	return slices.Contains(p.Allow[AllNamespaces], relaxation)
+}
+
+// Archive configures the archiving of inline volumes on deletion.
+// Archives are pruned per pool, oldest first.
+type Archive struct {
+	// Enabled archives the inline volumes that do not set the archiveOnDelete attribute.
+	Enabled bool `json:"enabled,omitempty"`
+	// MaxAge is how long archives are kept. Defaults to 7 days.
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+	// MaxSize caps the total size of the archives in a pool, e.g. "20Gi". Unset is unlimited.
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+}
+
+// MaxAgeDuration returns how long archives are kept.
+func (a Archive) MaxAgeDuration() time.Duration {
+	if a.MaxAge == nil {
+		return DefaultArchiveMaxAge
+	}
+	return a.MaxAge.Duration
+}
+
+// Pool is a directory holding backing files, typically on its own disk.
+type Pool struct {
+	// Name is the key of the pool in Config.Pools.
+	Name string `json:"-"`
+	// Path is the directory the backing files of the pool are stored in.
+	Path string `json:"path"`
+	// Capacity caps the total size of all volumes in the pool, e.g. "200Gi".
+	// Defaults to the size of the filesystem the pool lives on.
+	Capacity *resource.Quantity `json:"capacity,omitempty"`
+	// CapacityPercent caps the total size of all volumes to a percentage of the
+	// filesystem size. It is ignored when Capacity is set.
+	CapacityPercent float64 `json:"capacityPercent,omitempty"`
+	// Reserved is space on the filesystem that is never promised to volumes.
+	Reserved resource.Quantity `json:"reserved,omitempty"`
+	// CacheCapacity caps the total size of the cache images in the pool, e.g. "50Gi".
+	// The least recently used caches are evicted beyond it. Unset is unlimited.
+	CacheCapacity *resource.Quantity `json:"cacheCapacity,omitempty"`
+	// WarmPool keeps pre-formatted images of the filesystem of the pool ready.
+	// Unset inherits the top-level setting.
+	WarmPool *WarmPool `json:"warmPool,omitempty"`
+	// WipePolicy is how the backing files of deleted volumes are wiped.
+	// Unset inherits the top-level setting.
+	WipePolicy string `json:"wipePolicy,omitempty"`
+	// Filesystem is the filesystem new volumes are formatted with, unless
+	// the volume requests another one. Defaults to btrfs.
+	Filesystem string `json:"filesystem,omitempty"`
+	// Sizing bounds volume sizes in the pool. Unset fields inherit the top-level settings.
+	Sizing
+}
+
+// Sizing holds the default and the bounds of volume sizes.
+type Sizing struct {
+	// DefaultSize is used for volumes that do not request a size. Defaults to 1Gi.
+	DefaultSize *resource.Quantity `json:"defaultSize,omitempty"`
+	// MinSize is the smallest volume size accepted, on top of the minimum of the filesystem.
+	MinSize *resource.Quantity `json:"minSize,omitempty"`
+	// MaxSize is the largest volume size accepted. Unset is unlimited.
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+}
+
+// NamespaceQuotas holds the default quota and per-namespace overrides.
+type NamespaceQuotas struct {
+	// Default applies to every namespace without an override.
+	Default Quota `json:"default,omitempty"`
+	// Namespaces overrides the default quota for individual namespaces.
+	Namespaces map[string]Quota `json:"namespaces,omitempty"`
+}
+
+// Quota limits the loop volumes of a single namespace on a node.
+// Unset limits are unlimited.
+type Quota struct {
+	// MaxBytes caps the total size of the namespace's volumes, e.g. "50Gi".
+	MaxBytes *resource.Quantity `json:"maxBytes,omitempty"`
+	// MaxVolumes caps the number of the namespace's volumes.
+	MaxVolumes *int `json:"maxVolumes,omitempty"`
+}
+
+// For returns the quota that applies to the given namespace.
+func (q NamespaceQuotas) For(namespace string) Quota {
+	if quota, ok := q.Namespaces[namespace]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+// AllPools returns the storage pools sorted by name.
+// Without configured pools, it returns the implicit default pool.
+func (c *Config) AllPools() []Pool {
+	if len(c.Pools) == 0 {
+		return []Pool{{
+			Name:            DefaultPoolName,
+			Path:            DefaultPoolPath,
+			Capacity:        c.Capacity,
+			CapacityPercent: c.CapacityPercent,
+			Reserved:        c.Reserved,
+			CacheCapacity:   c.CacheCapacity,
+			WarmPool:        c.WarmPool,
+			WipePolicy:      c.WipePolicy,
+			Filesystem:      DefaultFilesystem,
+			Sizing:          c.Sizing,
+		}}
+	}
+
+	pools := make([]Pool, 0, len(c.Pools))
+	for name, pool := range c.Pools {
+		pool.Name = name
+		if pool.Filesystem == "" {
+			pool.Filesystem = DefaultFilesystem
+		}
+		pool.WarmPool = cmp.Or(pool.WarmPool, c.WarmPool)
+		pool.WipePolicy = cmp.Or(pool.WipePolicy, c.WipePolicy)
+		pool.DefaultSize = cmp.Or(pool.DefaultSize, c.DefaultSize)
+		pool.MinSize = cmp.Or(pool.MinSize, c.MinSize)
+		pool.MaxSize = cmp.Or(pool.MaxSize, c.MaxSize)
+		pools = append(pools, pool)
+	}
+	slices.SortFunc(pools, func(a, b Pool) int { return strings.Compare(a.Name, b.Name) })
+	return pools
+}
+
+// Pool returns the pool with the given name, or the default pool if the name is empty.
+// There is no default pool if several pools are configured without DefaultPool.
+func (c *Config) Pool(name string) (Pool, bool) {
+	pools := c.AllPools()
+	if name == "" {
+		if c.DefaultPool == "" && len(pools) == 1 {
+			return pools[0], true
+		}
+		name = c.DefaultPool
+	}
+
+	for _, pool := range pools {
+		if pool.Name == name {
+			return pool, true
+		}
+	}
+	return Pool{}, false
+}
+
+// RetainDuration returns how long retained volumes are kept.
+func (c *Config) RetainDuration() time.Duration {
+	if c.RetainTTL == nil {
+		return DefaultRetainTTL
+	}
+	return c.RetainTTL.Duration
+}
+
+// SourceCatalogPath returns the directory of the archives volumes can be seeded from.
+func (c *Config) SourceCatalogPath() string {
+	return cmp.Or(c.SourceCatalog, DefaultSourceCatalog)
+}
+
+// ImageCatalogPath returns the directory of the OCI layouts volumes can be seeded from.
+func (c *Config) ImageCatalogPath() string {
+	return cmp.Or(c.ImageCatalog, DefaultImageCatalog)
+}
+
+// MetricsAddr returns the address metrics are served on.
+func (c *Config) MetricsAddr() string {
+	return cmp.Or(c.MetricsAddress, DefaultMetricsAddress)
+}
+
+// Default returns the configuration used when no config file is present.
+func Default() *Config {
+	return &Config{
+		OvercommitRatio: 1.0,
+	}
+}
+
+// Load reads the configuration from the given path of the filesystem.
+// Missing fields keep their default values, and a missing file yields the defaults.
+//
+// Returns an error if the file cannot be read, parsed, or fails validation.
+func Load(fs afero.Fs, path string) (*Config, error) {
+	cfg := Default()
+
+	data, err := afero.ReadFile(fs, path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration for values the driver cannot work with.
+func (c *Config) Validate() error {
+	if c.OvercommitRatio <= 0 {
+		return fmt.Errorf("overcommitRatio must be positive, got %v", c.OvercommitRatio)
+	}
+	if err := validateBudget(c.Capacity, c.CapacityPercent, c.Reserved); err != nil {
+		return err
+	}
+	if err := validateCacheCapacity(c.CacheCapacity); err != nil {
+		return err
+	}
+	if err := c.WarmPool.validate(); err != nil {
+		return err
+	}
+	if err := validateWipePolicy(c.WipePolicy); err != nil {
+		return err
+	}
+	if err := c.Sizing.validate(); err != nil {
+		return err
+	}
+
+	paths := map[string]string{}
+	for name, pool := range c.Pools {
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return fmt.Errorf("invalid pool name %q: %s", name, strings.Join(errs, ", "))
+		}
+		if err := pool.validate(); err != nil {
+			return fmt.Errorf("pools[%s]: %v", name, err)
+		}
+		if other, ok := paths[pool.Path]; ok {
+			return fmt.Errorf("pools %s and %s share the path %s", min(name, other), max(name, other), pool.Path)
+		}
+		paths[pool.Path] = name
+	}
+	if c.DefaultPool != "" {
+		if _, ok := c.Pool(c.DefaultPool); !ok {
+			return fmt.Errorf("defaultPool %s is not a configured pool", c.DefaultPool)
+		}
+	}
+	if c.Placement != "" {
+		if !slices.Contains(Placements, c.Placement) {
+			return fmt.Errorf("placement %s is not supported, use one of %v", c.Placement, Placements)
+		}
+		if c.DefaultPool != "" {
+			return fmt.Errorf("defaultPool and placement are mutually exclusive")
+		}
+	}
+
+	if c.RetainTTL != nil && c.RetainTTL.Duration <= 0 {
+		return fmt.Errorf("retainTTL must be positive, got %s", c.RetainTTL.Duration)
+	}
+	if c.SourceCatalog != "" && !filepath.IsAbs(c.SourceCatalog) {
+		return fmt.Errorf("sourceCatalog must be absolute, got %q", c.SourceCatalog)
+	}
+	if c.ImageCatalog != "" && !filepath.IsAbs(c.ImageCatalog) {
+		return fmt.Errorf("imageCatalog must be absolute, got %q", c.ImageCatalog)
+	}
+	if c.RegistryMirror != "" {
+		if u, err := url.Parse(c.RegistryMirror); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("registryMirror must be an http or https URL, got %q", c.RegistryMirror)
+		}
+	}
+	if c.Archive.MaxAge != nil && c.Archive.MaxAge.Duration <= 0 {
+		return fmt.Errorf("archive.maxAge must be positive, got %s", c.Archive.MaxAge.Duration)
+	}
+	if c.Archive.MaxSize != nil && c.Archive.MaxSize.Sign() < 0 {
+		return fmt.Errorf("archive.maxSize must not be negative, got %s", c.Archive.MaxSize)
+	}
+
+	for namespace, relaxations := range c.MountPolicy.Allow {
+		if errs := validation.IsDNS1123Label(namespace); namespace != AllNamespaces && len(errs) > 0 {
+			return fmt.Errorf("invalid mountPolicy.allow namespace %q: %s", namespace, strings.Join(errs, ", "))
+		}
+		for _, relaxation := range relaxations {
+			if !slices.Contains(MountRelaxations, relaxation) {
+				return fmt.Errorf("mountPolicy.allow[%s]: %s is not a relaxation, use one of %v", namespace, relaxation, MountRelaxations)
+			}
+		}
+	}
+
+	if err := c.NamespaceQuotas.Default.validate(); err != nil {
+		return fmt.Errorf("namespaceQuotas.default: %v", err)
+	}
+	for namespace, quota := range c.NamespaceQuotas.Namespaces {
+		if err := quota.validate(); err != nil {
+			return fmt.Errorf("namespaceQuotas.namespaces[%s]: %v", namespace, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the pool for a usable path, filesystem and budget.
+func (p Pool) validate() error {
+	if !filepath.IsAbs(p.Path) {
+		return fmt.Errorf("path must be absolute, got %q", p.Path)
+	}
+	if p.Filesystem != "" && !slices.Contains(Filesystems, p.Filesystem) {
+		return fmt.Errorf("filesystem %s is not supported, use one of %v", p.Filesystem, Filesystems)
+	}
+	if err := validateBudget(p.Capacity, p.CapacityPercent, p.Reserved); err != nil {
+		return err
+	}
+	if err := validateCacheCapacity(p.CacheCapacity); err != nil {
+		return err
+	}
+	if err := p.WarmPool.validate(); err != nil {
+		return err
+	}
+	if err := validateWipePolicy(p.WipePolicy); err != nil {
+		return err
+	}
+	return p.Sizing.validate()
+}
+
+// validateWipePolicy checks that a wipe policy is supported, if set.
+func validateWipePolicy(policy string) error {
+	if policy != "" && !slices.Contains(WipePolicies, policy) {
+		return fmt.Errorf("wipePolicy %s is not supported, use one of %v", policy, WipePolicies)
+	}
+	return nil
+}
+
+// validate checks the warm pool for a usable number of images and size classes.
+func (w *WarmPool) validate() error {
+	if w == nil {
+		return nil
+	}
+	if w.Images < 0 {
+		return fmt.Errorf("warmPool.images must not be negative, got %d", w.Images)
+	}
+	if w.Images > 0 && len(w.SizeClasses) == 0 {
+		return fmt.Errorf("warmPool.sizeClasses must not be empty")
+	}
+	for _, class := range w.SizeClasses {
+		if class.Sign() <= 0 {
+			return fmt.Errorf("warmPool.sizeClasses must be positive, got %s", &class)
+		}
+	}
+	if w.MinFreePercent < 0 || w.MinFreePercent > 100 {
+		return fmt.Errorf("warmPool.minFreePercent must be between 0 and 100, got %v", w.MinFreePercent)
+	}
+	return nil
+}
+
+// validate checks the sizes for positive values and a non-empty range.
+func (s Sizing) validate() error {
+	for _, size := range []struct {
+		name  string
+		value *resource.Quantity
+	}{{"defaultSize", s.DefaultSize}, {"minSize", s.MinSize}, {"maxSize", s.MaxSize}} {
+		if size.value != nil && size.value.Sign() <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", size.name, size.value)
+		}
+	}
+	if s.MinSize != nil && s.MaxSize != nil && s.MinSize.Cmp(*s.MaxSize) > 0 {
+		return fmt.Errorf("minSize %s must not exceed maxSize %s", s.MinSize, s.MaxSize)
+	}
+	return nil
+}
+
+// validateBudget checks the settings limiting the total size of volumes.
+func validateBudget(capacity *resource.Quantity, capacityPercent float64, reserved resource.Quantity) error {
+	if capacity != nil && capacity.Sign() < 0 {
+		return fmt.Errorf("capacity must not be negative, got %s", capacity)
+	}
+	if capacityPercent < 0 || capacityPercent > 100 {
+		return fmt.Errorf("capacityPercent must be between 0 and 100, got %v", capacityPercent)
+	}
+	if reserved.Sign() < 0 {
+		return fmt.Errorf("reserved must not be negative, got %s", reserved.String())
+	}
+	return nil
+}
+
+// validateCacheCapacity checks the limit of the cache images.
+func validateCacheCapacity(capacity *resource.Quantity) error {
+	if capacity != nil && capacity.Sign() < 0 {
+		return fmt.Errorf("cacheCapacity must not be negative, got %s", capacity)
+	}
+	return nil
+}
+
+// validate checks the quota for negative limits.
+func (q Quota) validate() error {
+	if q.MaxBytes != nil && q.MaxBytes.Sign() < 0 {
+		return fmt.Errorf("maxBytes must not be negative, got %s", q.MaxBytes)
+	}
+	if q.MaxVolumes != nil && *q.MaxVolumes < 0 {
+		return fmt.Errorf("maxVolumes must not be negative, got %d", *q.MaxVolumes)
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+// Driver configuration loading tests.
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestConfig_AllPools(t *testing.T) {
+	t.Parallel()
+
+	warmPool := &WarmPool{Images: 2, SizeClasses: []resource.Quantity{resource.MustParse("1Gi")}}
+	cfg := &Config{
+		Sizing:     Sizing{DefaultSize: ptr(resource.MustParse("2Gi")), MaxSize: ptr(resource.MustParse("100Gi"))},
+		WarmPool:   warmPool,
+		WipePolicy: WipePolicyDiscard,
+		Pools: map[string]Pool{
+			"sata": {Path: "/mnt/sata", WarmPool: &WarmPool{}, WipePolicy: WipePolicyOverwrite},
+			"nvme": {Path: "/mnt/nvme", Filesystem: "xfs", Sizing: Sizing{MaxSize: ptr(resource.MustParse("10Gi"))}},
+		},
+	}
+
+	pools := cfg.AllPools()
+
+	require.Len(t, pools, 2)
+	assert.Equal(t, "nvme", pools[0].Name)
+	assert.Equal(t, "xfs", pools[0].Filesystem)
+	assert.Equal(t, "2Gi", pools[0].DefaultSize.String())
+	assert.Equal(t, "10Gi", pools[0].MaxSize.String())
+	assert.Same(t, warmPool, pools[0].WarmPool)
+	assert.Equal(t, WipePolicyDiscard, pools[0].WipePolicy)
+	assert.Equal(t, "sata", pools[1].Name)
+	assert.Equal(t, DefaultFilesystem, pools[1].Filesystem)
+	assert.Equal(t, "100Gi", pools[1].MaxSize.String())
+	assert.False(t, pools[1].WarmPool.Enabled())
+	assert.Equal(t, WipePolicyOverwrite, pools[1].WipePolicy)
+}
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		content         string
+		wantErr         bool
+		wantErrContains string
+		want            *Config
+	}{
+		{
+			name: "missing file yields defaults",
+			want: Default(),
+		},
+		{
+			name:    "reads overcommit ratio",
+			content: `{"overcommitRatio": 1.5}`,
+			want:    &Config{OvercommitRatio: 1.5},
+		},
+		{
+			name:    "reads node budget",
+			content: `{"capacity": "200Gi", "capacityPercent": 80, "reserved": "10Gi"}`,
+			want: &Config{
+				OvercommitRatio: 1.0,
+				Capacity:        ptr(resource.MustParse("200Gi")),
+				CapacityPercent: 80,
+				Reserved:        resource.MustParse("10Gi"),
+			},
+		},
+		{
+			name:    "reads namespace quotas",
+			content: `{"namespaceQuotas": {"default": {"maxBytes": "50Gi"}, "namespaces": {"ci": {"maxVolumes": 10}}}}`,
+			want: &Config{
+				OvercommitRatio: 1.0,
+				NamespaceQuotas: NamespaceQuotas{
+					Default:    Quota{MaxBytes: ptr(resource.MustParse("50Gi"))},
+					Namespaces: map[string]Quota{"ci": {MaxVolumes: ptr(10)}},
+				},
+			},
+		},
+		{
+			name:    "reads storage pools",
+			content: `{"pools": {"nvme": {"path": "/mnt/nvme", "capacity": "500Gi", "filesystem": "xfs"}}, "defaultPool": "nvme"}`,
+			want: &Config{
+				OvercommitRatio: 1.0,
+				Pools: map[string]Pool{
+					"nvme": {Path: "/mnt/nvme", Capacity: ptr(resource.MustParse("500Gi")), Filesystem: "xfs"},
+				},
+				DefaultPool: "nvme",
+			},
+		},
+		{
+			name:    "reads size bounds",
+			content: `{"defaultSize": "2Gi", "maxSize": "100Gi", "pools": {"nvme": {"path": "/mnt/nvme", "minSize": "1Gi"}}}`,
+			want: &Config{
+				OvercommitRatio: 1.0,
+				Sizing:          Sizing{DefaultSize: ptr(resource.MustParse("2Gi")), MaxSize: ptr(resource.MustParse("100Gi"))},
+				Pools: map[string]Pool{
+					"nvme": {Path: "/mnt/nvme", Sizing: Sizing{MinSize: ptr(resource.MustParse("1Gi"))}},
+				},
+			},
+		},
+		{
+			name:    "reads placement strategy",
+			content: `{"placement": "leastVolumes"}`,
+			want:    &Config{OvercommitRatio: 1.0, Placement: PlacementLeastVolumes},
+		},
+		{
+			name:    "reads wipe policy",
+			content: `{"wipePolicy": "overwrite"}`,
+			want:    &Config{OvercommitRatio: 1.0, WipePolicy: WipePolicyOverwrite},
+		},
+		{
+			name:    "reads mount policy",
+			content: `{"mountPolicy": {"noexec": true, "allow": {"builds": ["suid", "exec"], "*": ["dev"]}}}`,
+			want: &Config{OvercommitRatio: 1.0, MountPolicy: MountPolicy{
+				NoExec: true,
+				Allow:  map[string][]string{"builds": {"suid", "exec"}, AllNamespaces: {"dev"}},
+			}},
+		},
+		{
+			name:    "reads retain ttl",
+			content: `{"retainTTL": "1h30m"}`,
+			want:    &Config{OvercommitRatio: 1.0, RetainTTL: &metav1.Duration{Duration: 90 * time.Minute}},
+		},
+		{
+			name:    "reads archive settings",
+			content: `{"archive": {"enabled": true, "maxAge": "48h", "maxSize": "20Gi"}}`,
+			want: &Config{OvercommitRatio: 1.0, Archive: Archive{
+				Enabled: true,
+				MaxAge:  &metav1.Duration{Duration: 48 * time.Hour},
+				MaxSize: ptr(resource.MustParse("20Gi")),
+			}},
+		},
+		{
+			name:    "reads warm pool settings",
+			content: `{"warmPool": {"images": 3, "sizeClasses": ["1Gi", "10Gi"], "minFreePercent": 20}}`,
+			want: &Config{OvercommitRatio: 1.0, WarmPool: &WarmPool{
+				Images:         3,
+				SizeClasses:    []resource.Quantity{resource.MustParse("1Gi"), resource.MustParse("10Gi")},
+				MinFreePercent: 20,
+			}},
+		},
+		{
+			name:    "keeps defaults for missing fields",
+			content: `{}`,
+			want:    Default(),
+		},
+		{
+			name:            "fails on malformed json",
+			content:         `{"overcommitRatio":`,
+			wantErr:         true,
+			wantErrContains: "failed to parse config",
+		},
+		{
+			name:            "fails on non-positive overcommit ratio",
+			content:         `{"overcommitRatio": 0}`,
+			wantErr:         true,
+			wantErrContains: "overcommitRatio must be positive",
+		},
+		{
+			name:            "fails on capacity percent above 100",
+			content:         `{"capacityPercent": 120}`,
+			wantErr:         true,
+			wantErrContains: "capacityPercent must be between 0 and 100",
+		},
+		{
+			name:            "fails on negative reserved floor",
+			content:         `{"reserved": "-1Gi"}`,
+			wantErr:         true,
+			wantErrContains: "reserved must not be negative",
+		},
+		{
+			name:            "fails on negative namespace quota",
+			content:         `{"namespaceQuotas": {"namespaces": {"ci": {"maxVolumes": -1}}}}`,
+			wantErr:         true,
+			wantErrContains: "namespaceQuotas.namespaces[ci]: maxVolumes must not be negative",
+		},
+		{
+			name:            "fails on invalid pool name",
+			content:         `{"pools": {"Fast_Disk": {"path": "/mnt/fast"}}}`,
+			wantErr:         true,
+			wantErrContains: `invalid pool name "Fast_Disk"`,
+		},
+		{
+			name:            "fails on relative pool path",
+			content:         `{"pools": {"nvme": {"path": "mnt/nvme"}}}`,
+			wantErr:         true,
+			wantErrContains: `pools[nvme]: path must be absolute`,
+		},
+		{
+			name:            "fails on unsupported pool filesystem",
+			content:         `{"pools": {"nvme": {"path": "/mnt/nvme", "filesystem": "zfs"}}}`,
+			wantErr:         true,
+			wantErrContains: "pools[nvme]: filesystem zfs is not supported",
+		},
+		{
+			name:            "fails on pools sharing a path",
+			content:         `{"pools": {"a": {"path": "/mnt/disk"}, "b": {"path": "/mnt/disk"}}}`,
+			wantErr:         true,
+			wantErrContains: "pools a and b share the path /mnt/disk",
+		},
+		{
+			name:            "fails on unknown default pool",
+			content:         `{"pools": {"nvme": {"path": "/mnt/nvme"}}, "defaultPool": "sata"}`,
+			wantErr:         true,
+			wantErrContains: "defaultPool sata is not a configured pool",
+		},
+		{
+			name:            "fails on unknown placement strategy",
+			content:         `{"placement": "random"}`,
+			wantErr:         true,
+			wantErrContains: "placement random is not supported",
+		},
+		{
+			name:            "fails on unknown wipe policy",
+			content:         `{"wipePolicy": "shred"}`,
+			wantErr:         true,
+			wantErrContains: "wipePolicy shred is not supported",
+		},
+		{
+			name:            "fails on unknown pool wipe policy",
+			content:         `{"pools": {"nvme": {"path": "/mnt/nvme", "wipePolicy": "burn"}}}`,
+			wantErr:         true,
+			wantErrContains: "pools[nvme]: wipePolicy burn is not supported",
+		},
+		{
+			name:            "fails on unknown mount relaxation",
+			content:         `{"mountPolicy": {"allow": {"builds": ["rw"]}}}`,
+			wantErr:         true,
+			wantErrContains: "mountPolicy.allow[builds]: rw is not a relaxation",
+		},
+		{
+			name:            "fails on invalid mount policy namespace",
+			content:         `{"mountPolicy": {"allow": {"Builds": ["exec"]}}}`,
+			wantErr:         true,
+			wantErrContains: `invalid mountPolicy.allow namespace "Builds"`,
+		},
+		{
+			name:            "fails on placement with default pool",
+			content:         `{"pools": {"nvme": {"path": "/mnt/nvme"}}, "defaultPool": "nvme", "placement": "roundRobin"}`,
+			wantErr:         true,
+			wantErrContains: "defaultPool and placement are mutually exclusive",
+		},
+		{
+			name:            "fails on non-positive size",
+			content:         `{"defaultSize": "0"}`,
+			wantErr:         true,
+			wantErrContains: "defaultSize must be positive",
+		},
+		{
+			name:            "fails on empty pool size range",
+			content:         `{"pools": {"nvme": {"path": "/mnt/nvme", "minSize": "2Gi", "maxSize": "1Gi"}}}`,
+			wantErr:         true,
+			wantErrContains: "pools[nvme]: minSize 2Gi must not exceed maxSize 1Gi",
+		},
+		{
+			name:            "fails on negative pool cache capacity",
+			content:         `{"pools": {"nvme": {"path": "/mnt/nvme", "cacheCapacity": "-1Gi"}}}`,
+			wantErr:         true,
+			wantErrContains: "pools[nvme]: cacheCapacity must not be negative, got -1Gi",
+		},
+		{
+			name:            "fails on non-positive retain ttl",
+			content:         `{"retainTTL": "0s"}`,
+			wantErr:         true,
+			wantErrContains: "retainTTL must be positive, got 0s",
+		},
+		{
+			name:            "fails on relative source catalog",
+			content:         `{"sourceCatalog": "datasets"}`,
+			wantErr:         true,
+			wantErrContains: `sourceCatalog must be absolute, got "datasets"`,
+		},
+		{
+			name:            "fails on warm pool without size classes",
+			content:         `{"warmPool": {"images": 3}}`,
+			wantErr:         true,
+			wantErrContains: "warmPool.sizeClasses must not be empty",
+		},
+		{
+			name:            "fails on negative warm pool images",
+			content:         `{"pools": {"fast": {"path": "/mnt/fast", "warmPool": {"images": -1}}}}`,
+			wantErr:         true,
+			wantErrContains: "pools[fast]: warmPool.images must not be negative, got -1",
+		},
+		{
+			name:            "fails on registry mirror without scheme",
+			content:         `{"registryMirror": "registry.local:5000"}`,
+			wantErr:         true,
+			wantErrContains: `registryMirror must be an http or https URL, got "registry.local:5000"`,
+		},
+		{
+			name:            "fails on non-positive archive age",
+			content:         `{"archive": {"maxAge": "-1h"}}`,
+			wantErr:         true,
+			wantErrContains: "archive.maxAge must be positive, got -1h0m0s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			fs := afero.NewMemMapFs()
+			path := "/etc/csi-loop-driver/config.json"
+			if tt.content != "" {
+				require.NoError(t, afero.WriteFile(fs, path, []byte(tt.content), 0644))
+			}
+
+			cfg, err := Load(fs, path)
+
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cfg)
+		})
+	}
+}
+
+func TestMountPolicy_Allowed(t *testing.T) {
+	t.Parallel()
+
+	policy := MountPolicy{Allow: map[string][]string{"builds": {"suid"}, AllNamespaces: {"dev"}}}
+
+	assert.True(t, policy.Allowed("builds", "suid"))
+	assert.True(t, policy.Allowed("builds", "dev"), "relaxations of every namespace should apply")
+	assert.True(t, policy.Allowed("", "dev"))
+	assert.False(t, policy.Allowed("web", "suid"))
+	assert.False(t, policy.Allowed("builds", "exec"))
+	assert.False(t, MountPolicy{}.Allowed("builds", "suid"))
+}
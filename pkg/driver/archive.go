@@ -0,0 +1,128 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// archiveInterval is how often archives are pruned without volumes being archived.
+const archiveInterval = 10 * time.Minute
+
+// archiveOnDeleteParameter is the volume attribute archiving the backing file of an inline
+// volume instead of deleting it, overriding the node default.
+const archiveOnDeleteParameter = "archiveOnDelete"
+
+// archiveOnDelete reports whether an inline volume is archived when its pod is gone.
+//
+// Returns an error if the attribute is not a boolean.
+func archiveOnDelete(cfg *config.Config, volumeContext map[string]string) (bool, error) {
+	value, ok := volumeContext[archiveOnDeleteParameter]
+	if !ok {
+		return cfg.Archive.Enabled, nil
+	}
+	archive, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "invalid %s %q: must be true or false", archiveOnDeleteParameter, value)
+	}
+	return archive, nil
+}
+
+// archiveVolume moves the backing file and metadata of a volume into the archive directory
+// of its pool, named after the volume and the time of archiving, and forgets the volume.
+// Archives of the pool beyond the configured age and size are pruned afterwards.
+// If the backing file cannot be moved, the volume is released.
+func archiveVolume(env *conf.Env, cfg *config.Config, store *state.Store, volume state.Volume) error {
+	pool := dataPool(cfg, volume.Pool, filepath.Dir(volume.BackingFile))
+	dir := filepath.Join(pool.Path, archiveSubdir)
+	archive := backingFilePath(dir, volume.ID+"-"+env.Now().UTC().Format("20060102T150405Z"))
+
+	klog.Infof("Archiving volume %s to %s", volume.ID, archive)
+	env.FS.MkdirAll(dir, 0755)
+	if err := env.FS.Rename(volume.BackingFile, archive); err != nil {
+		klog.Warningf("Failed to archive volume %s: %v", volume.ID, err)
+		return releaseVolume(env, cfg, store, volume)
+	}
+	// The archive ages from now, not from the last write to the volume
+	now := env.Now()
+	env.FS.Chtimes(archive, now, now)
+	if err := env.FS.Rename(metadataFilePath(volume.BackingFile), metadataFilePath(archive)); err != nil {
+		klog.Warningf("Failed to archive metadata of volume %s: %v", volume.ID, err)
+	}
+
+	if err := store.DeleteVolume(volume.ID); err != nil {
+		return err
+	}
+
+	pruneArchives(env, cfg, store, pool)
+	return nil
+}
+
+// PruneArchives prunes the archives of all pools until ctx is done, on start and periodically,
+// so archives also expire while no volume is archived.
+func (ns *NodeServer) PruneArchives(ctx context.Context) {
+	for {
+		for _, pool := range ns.Config.AllPools() {
+			if exists, _ := afero.DirExists(ns.Env.FS, filepath.Join(pool.Path, archiveSubdir)); exists {
+				pruneArchives(ns.Env, ns.Config, ns.State, pool)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(archiveInterval):
+		}
+	}
+}
+
+// pruneArchives removes the archives of a pool that are older than the maximum age,
+// then the oldest archives until the total size fits into the maximum size.
+// Archives are wiped according to the wipe policy of the pool, see removeDataFile.
+func pruneArchives(env *conf.Env, cfg *config.Config, store *state.Store, pool config.Pool) {
+	dir := filepath.Join(pool.Path, archiveSubdir)
+	entries, err := afero.ReadDir(env.FS, dir)
+	if err != nil {
+		klog.Warningf("Failed to list archives in %s: %v", dir, err)
+		return
+	}
+
+	var total int64
+	var archives []string
+	modTimes := map[string]time.Time{}
+	sizes := map[string]int64{}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !strings.HasSuffix(entry.Name(), ".img") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		archives = append(archives, path)
+		modTimes[path] = entry.ModTime()
+		sizes[path] = entry.Size()
+		total += entry.Size()
+	}
+	slices.SortFunc(archives, func(a, b string) int { return modTimes[a].Compare(modTimes[b]) })
+
+	maxAge := cfg.Archive.MaxAgeDuration()
+	for _, path := range archives {
+		expired := env.Now().Sub(modTimes[path]) > maxAge
+		oversized := cfg.Archive.MaxSize != nil && total > cfg.Archive.MaxSize.Value()
+		if !expired && !oversized {
+			return
+		}
+		klog.Infof("Pruning archive %s", path)
+		removeDataFile(env, store, pool, strings.TrimSuffix(filepath.Base(path), ".img"), path, sizes[path])
+		env.FS.Remove(metadataFilePath(path))
+		total -= sizes[path]
+	}
+}
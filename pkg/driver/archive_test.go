@@ -0,0 +1,164 @@
+// Volume archive tests.
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestArchiveOnDelete(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		enabled         bool
+		volumeContext   map[string]string
+		want            bool
+		wantErrContains string
+	}{
+		{name: "deletes volumes by default", volumeContext: map[string]string{}},
+		{name: "uses node default", enabled: true, volumeContext: map[string]string{}, want: true},
+		{name: "attribute enables archiving", volumeContext: map[string]string{archiveOnDeleteParameter: "true"}, want: true},
+		{name: "attribute overrides node default", enabled: true, volumeContext: map[string]string{archiveOnDeleteParameter: "false"}},
+		{
+			name:            "fails on non-boolean attribute",
+			volumeContext:   map[string]string{archiveOnDeleteParameter: "sometimes"},
+			wantErrContains: `invalid archiveOnDelete "sometimes"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := config.Default()
+			cfg.Archive.Enabled = tt.enabled
+
+			archive, err := archiveOnDelete(cfg, tt.volumeContext)
+
+			if tt.wantErrContains != "" {
+				require.Error(t, err)
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, archive)
+		})
+	}
+}
+
+func TestNodeServer_ArchiveVolume(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	mockCommands(env, func(name string, args ...string) error {
+		if name == "truncate" {
+			return afero.WriteFile(env.FS, args[2], nil, 0644)
+		}
+		return nil
+	})
+
+	mockStatfs(env, 1<<40, 1<<40)
+
+	archiveDir := "/var/lib/csi-loop/archive"
+
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "csi-1",
+		TargetPath:       "/mnt/crash",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{"size": "200Mi", archiveOnDeleteParameter: "true", podNamespaceKey: "team-a"},
+	})
+	require.NoError(t, err)
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-1", TargetPath: "/mnt/crash"})
+	require.NoError(t, err)
+
+	_, ok := ns.State.GetVolume("csi-1")
+	assert.False(t, ok)
+	exists, _ := afero.Exists(env.FS, backingFilePath(config.DefaultPoolPath, "csi-1"))
+	assert.False(t, exists, "backing file should be moved")
+
+	images, _ := afero.Glob(env.FS, archiveDir+"/csi-1-*.img")
+	assert.Len(t, images, 1, "backing file should be archived")
+	metadata, _ := afero.Glob(env.FS, archiveDir+"/csi-1-*.json")
+	assert.Len(t, metadata, 1, "metadata should be archived with the backing file")
+}
+
+func TestPruneArchives(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	dir := "/var/lib/csi-loop/archive"
+
+	now := time.Now()
+	archives := []struct {
+		name string
+		age  time.Duration
+	}{
+		{"expired", 10 * 24 * time.Hour},
+		{"oldest", 3 * time.Hour},
+		{"older", 2 * time.Hour},
+		{"newest", time.Hour},
+	}
+	for _, archive := range archives {
+		path := backingFilePath(dir, archive.name)
+		writeBackingFile(t, env, path, 100<<10)
+		require.NoError(t, afero.WriteFile(env.FS, metadataFilePath(path), []byte("{}"), 0644))
+		require.NoError(t, env.FS.Chtimes(path, now.Add(-archive.age), now.Add(-archive.age)))
+	}
+
+	cfg := config.Default()
+	maxSize := resource.MustParse("250Ki")
+	cfg.Archive.MaxSize = &maxSize
+	pool, _ := cfg.Pool(config.DefaultPoolName)
+	pruneArchives(env, cfg, newTestState(t, env), pool)
+
+	var remaining []string
+	for _, archive := range archives {
+		if exists, _ := afero.Exists(env.FS, backingFilePath(dir, archive.name)); exists {
+			remaining = append(remaining, archive.name)
+		}
+	}
+	assert.Equal(t, []string{"older", "newest"}, remaining)
+	exists, _ := afero.Exists(env.FS, metadataFilePath(backingFilePath(dir, "oldest")))
+	assert.False(t, exists, "metadata of pruned archives should be removed")
+}
+
+func TestNodeServer_PruneArchives(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+
+	dir := filepath.Join(config.DefaultPoolPath, archiveSubdir)
+	expired := backingFilePath(dir, "expired")
+	recent := backingFilePath(dir, "recent")
+	old := time.Now().Add(-2 * config.DefaultArchiveMaxAge)
+	writeBackingFile(t, env, expired, 4096)
+	writeBackingFile(t, env, recent, 4096)
+	require.NoError(t, env.FS.Chtimes(expired, old, old))
+
+	// Expired archives are pruned on start, without a volume being archived
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ns.PruneArchives(ctx)
+
+	exists, _ := afero.Exists(env.FS, expired)
+	assert.False(t, exists)
+	exists, _ = afero.Exists(env.FS, recent)
+	assert.True(t, exists)
+}
@@ -0,0 +1,153 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+// cacheKeyParameter is the volume attribute naming the node-local cache an inline volume
+// is checked out from and written back to.
+const cacheKeyParameter = "cacheKey"
+
+// cacheKey returns the key of the cache an inline volume uses, or an empty key without cache.
+// Keys are scoped to the namespace of the pod, so caches are never shared across namespaces.
+//
+// Returns an error if the key is invalid or kubelet did not pass the pod info.
+func cacheKey(volumeContext map[string]string) (string, error) {
+	key := volumeContext[cacheKeyParameter]
+	if key == "" {
+		return "", nil
+	}
+	if errs := validation.IsDNS1123Label(key); len(errs) > 0 {
+		return "", status.Errorf(codes.InvalidArgument, "invalid cacheKey %q: %s", key, strings.Join(errs, ", "))
+	}
+
+	namespace := volumeContext[podNamespaceKey]
+	if namespace == "" {
+		return "", status.Errorf(codes.InvalidArgument, "%s requires the pod info, enable podInfoOnMount", cacheKeyParameter)
+	}
+	return namespace + "/" + key, nil
+}
+
+// checkoutCache creates a new volume as a copy of the image of its cache, which is a
+// copy-on-write clone on filesystems supporting reflinks. Caches that are in another pool
+// than requested, have another filesystem, or are smaller than requested are not used,
+// the volume starts empty instead and replaces the cache once written back.
+func (ns *NodeServer) checkoutCache(ctx context.Context, cache state.Cache, volume state.Volume, volumeContext map[string]string, capability *csi.VolumeCapability, sizeRequest sizeRequest) (state.Volume, error) {
+	pool, ok := ns.Config.Pool(cache.Pool)
+	name := volumeContext[poolParameter]
+	fsType := capability.GetMount().GetFsType()
+
+	if ok && (name == "" || name == pool.Name) && (fsType == "" || fsType == cache.Filesystem) {
+		sizeBytes, err := ephemeralSize(ns.Env, pool, cache.Filesystem, sizeRequest)
+		if err != nil {
+			return state.Volume{}, err
+		}
+
+		if cache.Size >= sizeBytes {
+			klog.Infof("Checking out cache %s for volume %s", cache.Key, volume.ID)
+			volume.Pool = pool.Name
+			volume.Filesystem = cache.Filesystem
+			volume.BackingFile = backingFilePath(pool.Path, volume.ID)
+			volume.Size = cache.Size
+			if err := allocateVolumeFrom(ctx, ns.Env, ns.Config, ns.State, pool, volume, cache.BackingFile); err != nil {
+				return state.Volume{}, err
+			}
+
+			cache.LastUsedAt = ns.Env.Now()
+			if err := ns.State.PutCache(cache); err != nil {
+				klog.Warningf("Failed to record use of cache %s: %v", cache.Key, err)
+			}
+			return volume, nil
+		}
+	}
+
+	klog.Infof("Cache %s does not match volume %s, starting with an empty volume", cache.Key, volume.ID)
+	return ns.createEphemeralVolume(ctx, volume, volumeContext, capability, sizeRequest, nil)
+}
+
+// storeCache writes the backing file of an unpublished volume back as the image of its cache,
+// replacing the previous image, and evicts the least recently used caches of the pool beyond
+// its cache capacity. If the backing file cannot be moved, the volume is released and the
+// previous image is kept.
+func storeCache(env *conf.Env, cfg *config.Config, store *state.Store, volume state.Volume) error {
+	cache := state.Cache{
+		Key:         volume.CacheKey,
+		Pool:        volume.Pool,
+		Filesystem:  volume.Filesystem,
+		BackingFile: cacheFilePath(filepath.Dir(volume.BackingFile), volume.CacheKey),
+		Size:        volume.Size,
+		LastUsedAt:  env.Now(),
+	}
+	previous, hasPrevious := store.GetCache(cache.Key)
+
+	klog.Infof("Writing volume %s back to cache %s", volume.ID, cache.Key)
+	env.FS.MkdirAll(filepath.Dir(cache.BackingFile), 0755)
+	if err := env.FS.Rename(volume.BackingFile, cache.BackingFile); err != nil {
+		klog.Warningf("Failed to write back cache %s: %v", cache.Key, err)
+		return releaseVolume(env, cfg, store, volume)
+	}
+	env.FS.Remove(metadataFilePath(volume.BackingFile))
+
+	if err := store.PutCache(cache); err != nil {
+		return err
+	}
+	if hasPrevious && previous.BackingFile != cache.BackingFile {
+		removeCache(env, cfg, store, previous)
+	}
+	if err := store.DeleteVolume(volume.ID); err != nil {
+		return err
+	}
+
+	evictCaches(env, cfg, store, cache.Pool)
+	return nil
+}
+
+// evictCaches removes the least recently used caches of a pool until the total size
+// of its cache images fits into its cache capacity.
+func evictCaches(env *conf.Env, cfg *config.Config, store *state.Store, poolName string) {
+	pool, ok := cfg.Pool(poolName)
+	if !ok || pool.CacheCapacity == nil {
+		return
+	}
+
+	var caches []state.Cache
+	var total int64
+	for _, cache := range store.Caches() {
+		if cache.Pool == pool.Name {
+			caches = append(caches, cache)
+			total += cache.Size
+		}
+	}
+	slices.SortFunc(caches, func(a, b state.Cache) int { return a.LastUsedAt.Compare(b.LastUsedAt) })
+
+	for _, cache := range caches {
+		if total <= pool.CacheCapacity.Value() {
+			return
+		}
+		klog.Infof("Evicting cache %s of pool %s, last used at %s", cache.Key, pool.Name, cache.LastUsedAt)
+		removeCache(env, cfg, store, cache)
+		if err := store.DeleteCache(cache.Key); err != nil {
+			klog.Warningf("Failed to evict cache %s: %v", cache.Key, err)
+			return
+		}
+		total -= cache.Size
+	}
+}
+
+// removeCache removes the image of a cache according to the wipe policy of its pool, see removeDataFile.
+func removeCache(env *conf.Env, cfg *config.Config, store *state.Store, cache state.Cache) {
+	pool := dataPool(cfg, cache.Pool, filepath.Dir(filepath.Dir(cache.BackingFile)))
+	removeDataFile(env, store, pool, cache.Key, cache.BackingFile, cache.Size)
+}
@@ -0,0 +1,173 @@
+// Node-local cache volume tests.
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestCacheKey(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		volumeContext   map[string]string
+		want            string
+		wantErrContains string
+	}{
+		{
+			name:          "uses no cache without key",
+			volumeContext: map[string]string{podNamespaceKey: "ci"},
+		},
+		{
+			name:          "scopes key to the pod namespace",
+			volumeContext: map[string]string{cacheKeyParameter: "go-mod", podNamespaceKey: "ci"},
+			want:          "ci/go-mod",
+		},
+		{
+			name:            "fails on invalid key",
+			volumeContext:   map[string]string{cacheKeyParameter: "../etc", podNamespaceKey: "ci"},
+			wantErrContains: `invalid cacheKey "../etc"`,
+		},
+		{
+			name:            "fails without pod info",
+			volumeContext:   map[string]string{cacheKeyParameter: "go-mod"},
+			wantErrContains: "cacheKey requires the pod info",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			key, err := cacheKey(tt.volumeContext)
+
+			if tt.wantErrContains != "" {
+				require.Error(t, err)
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, key)
+		})
+	}
+}
+
+func TestNodeServer_CacheVolume(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		switch name {
+		case "truncate":
+			return afero.WriteFile(env.FS, args[2], nil, 0644)
+		case "cp":
+			data, err := afero.ReadFile(env.FS, args[1])
+			if err != nil {
+				return err
+			}
+			return afero.WriteFile(env.FS, args[2], data, 0644)
+		}
+		return nil
+	})
+
+	mockStatfs(env, 1<<40, 1<<40)
+
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+	publish := func(volumeID, targetPath string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       targetPath,
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeContext: map[string]string{
+				"size":            "200Mi",
+				cacheKeyParameter: "go-mod",
+				podNamespaceKey:   "ci",
+			},
+		})
+		return err
+	}
+	unpublish := func(volumeID, targetPath string) {
+		_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath})
+		require.NoError(t, err)
+	}
+	cacheFile := "/var/lib/csi-loop/caches/ci_go-mod.img"
+
+	// Without a cache, the first volume starts empty and becomes the cache on unpublish
+	require.NoError(t, publish("csi-1", "/mnt/build-1"))
+	assert.Contains(t, commands, "[mkfs.btrfs /var/lib/csi-loop/csi-1.img]")
+	unpublish("csi-1", "/mnt/build-1")
+
+	_, ok := ns.State.GetVolume("csi-1")
+	assert.False(t, ok)
+	cache, ok := ns.State.GetCache("ci/go-mod")
+	require.True(t, ok)
+	assert.Equal(t, cacheFile, cache.BackingFile)
+	assert.Equal(t, int64(200<<20), cache.Size)
+	exists, _ := afero.Exists(env.FS, cacheFile)
+	assert.True(t, exists, "backing file should be written back as cache")
+
+	// The next volume with the same key is a clone of the cache
+	commands = nil
+	require.NoError(t, publish("csi-2", "/mnt/build-2"))
+	assert.Equal(t, []string{
+		"[cp --reflink=always " + cacheFile + " /var/lib/csi-loop/csi-2.img.tmp]",
+		"[mount -o loop,nosuid,nodev /var/lib/csi-loop/csi-2.img /mnt/build-2]",
+	}, commands)
+	volume, ok := ns.State.GetVolume("csi-2")
+	require.True(t, ok)
+	assert.Equal(t, "ci/go-mod", volume.CacheKey)
+
+	unpublish("csi-2", "/mnt/build-2")
+	_, ok = ns.State.GetVolume("csi-2")
+	assert.False(t, ok)
+	_, ok = ns.State.GetCache("ci/go-mod")
+	assert.True(t, ok)
+}
+
+func TestEvictCaches(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	store := newTestState(t, env)
+	now := time.Now()
+	caches := []state.Cache{
+		{Key: "ci/oldest", Pool: config.DefaultPoolName, BackingFile: "/var/lib/csi-loop/caches/ci_oldest.img", Size: 100 << 10, LastUsedAt: now.Add(-2 * time.Hour)},
+		{Key: "ci/older", Pool: config.DefaultPoolName, BackingFile: "/var/lib/csi-loop/caches/ci_older.img", Size: 100 << 10, LastUsedAt: now.Add(-time.Hour)},
+		{Key: "ci/newest", Pool: config.DefaultPoolName, BackingFile: "/var/lib/csi-loop/caches/ci_newest.img", Size: 100 << 10, LastUsedAt: now},
+	}
+	for _, cache := range caches {
+		writeBackingFile(t, env, cache.BackingFile, 0)
+		require.NoError(t, store.PutCache(cache))
+	}
+
+	cfg := config.Default()
+	cacheCapacity := resource.MustParse("250Ki")
+	cfg.CacheCapacity = &cacheCapacity
+
+	evictCaches(env, cfg, store, config.DefaultPoolName)
+
+	var keys []string
+	for _, cache := range store.Caches() {
+		keys = append(keys, cache.Key)
+	}
+	assert.Equal(t, []string{"ci/newest", "ci/older"}, keys)
+	exists, _ := afero.Exists(env.FS, caches[0].BackingFile)
+	assert.False(t, exists, "evicted cache image should be removed")
+}
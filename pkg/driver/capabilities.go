@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// supportedAccessModes lists the access modes loop volumes can honour.
+// Backing files live on a single node, so only node-local modes are supported.
+var supportedAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+}
+
+// validateCapability checks that a volume capability can be honoured by a loop volume.
+// Loop volumes are always mounted filesystems with a node-local access mode.
+func validateCapability(capability *csi.VolumeCapability) error {
+	if capability == nil {
+		return fmt.Errorf("volume capability is required")
+	}
+	if capability.GetBlock() != nil {
+		return fmt.Errorf("block access is not supported")
+	}
+
+	mode := capability.GetAccessMode().GetMode()
+	if !slices.Contains(supportedAccessModes, mode) {
+		return fmt.Errorf("access mode %s is not supported, only single-node access modes are", mode)
+	}
+	return nil
+}
+
+// validateCapabilities checks every capability in a list, which must not be empty.
+func validateCapabilities(capabilities []*csi.VolumeCapability) error {
+	if len(capabilities) == 0 {
+		return fmt.Errorf("volume capabilities are required")
+	}
+	for _, capability := range capabilities {
+		if err := validateCapability(capability); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Volume capability validation tests.
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+// mountCapability returns a filesystem volume capability with the given access mode.
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestValidateCapability(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		capability *csi.VolumeCapability
+		wantErr    string
+	}{
+		{name: "accepts single-node writer", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		{name: "accepts single-node reader", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)},
+		{name: "accepts single-node single writer", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER)},
+		{name: "accepts single-node multi writer", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)},
+		{
+			name:       "rejects multi-node multi writer",
+			capability: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			wantErr:    "access mode MULTI_NODE_MULTI_WRITER is not supported",
+		},
+		{
+			name:       "rejects multi-node reader",
+			capability: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+			wantErr:    "access mode MULTI_NODE_READER_ONLY is not supported",
+		},
+		{
+			name:       "rejects unknown access mode",
+			capability: mountCapability(csi.VolumeCapability_AccessMode_UNKNOWN),
+			wantErr:    "access mode UNKNOWN is not supported",
+		},
+		{
+			name: "rejects block access",
+			capability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+			wantErr: "block access is not supported",
+		},
+		{
+			name:    "rejects missing capability",
+			wantErr: "volume capability is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := validateCapability(tt.capability)
+
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
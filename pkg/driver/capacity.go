@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// availableCapacity returns the number of bytes of a pool that can still be promised to new volumes.
+// Physically, that is the free space of the pool's filesystem minus the reserved floor
+// and the space existing sparse backing files may still grow into, scaled by the
+// overcommit ratio. The result is further capped by what is left of the pool budget.
+func availableCapacity(env *conf.Env, cfg *config.Config, pool config.Pool) (int64, error) {
+	_, free, err := env.Statfs(pool.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	reserved, err := reservedBytes(env, pool)
+	if err != nil {
+		return 0, err
+	}
+
+	available := int64(float64(free-pool.Reserved.Value()-reserved) * cfg.OvercommitRatio)
+
+	remaining, err := remainingBudget(env, cfg, pool)
+	if err != nil {
+		return 0, err
+	}
+	return max(min(available, remaining), 0), nil
+}
+
+// poolBudget returns the total number of bytes the node may provision to volumes in a pool.
+// The base is the configured capacity, a percentage of the pool's filesystem,
+// or the whole filesystem. The reserved floor is subtracted and the
+// result is scaled by the overcommit ratio.
+func poolBudget(env *conf.Env, cfg *config.Config, pool config.Pool) (int64, error) {
+	var base int64
+	if pool.Capacity != nil {
+		base = pool.Capacity.Value()
+	} else {
+		total, _, err := env.Statfs(pool.Path)
+		if err != nil {
+			return 0, err
+		}
+		base = total
+		if pool.CapacityPercent > 0 {
+			base = int64(float64(total) * pool.CapacityPercent / 100)
+		}
+	}
+
+	return int64(float64(base-pool.Reserved.Value()) * cfg.OvercommitRatio), nil
+}
+
+// remainingBudget returns the part of the pool budget not yet provisioned to volumes.
+func remainingBudget(env *conf.Env, cfg *config.Config, pool config.Pool) (int64, error) {
+	budget, err := poolBudget(env, cfg, pool)
+	if err != nil {
+		return 0, err
+	}
+
+	used, err := provisionedBytes(env, pool)
+	if err != nil {
+		return 0, err
+	}
+	return max(budget-used, 0), nil
+}
+
+// checkBudget verifies that a new volume of the given size fits into the budget of its pool.
+// Volumes reserved in the pool count as used, their backing files are still being created.
+// Callers reserving or allocating the volume afterwards must hold env.Allocation.
+//
+// Returns a ResourceExhausted error describing used, requested and available space
+// if the volume does not fit.
+func checkBudget(env *conf.Env, cfg *config.Config, store *state.Store, pool config.Pool, requested int64) error {
+	budget, err := poolBudget(env, cfg, pool)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to compute node budget: %v", err)
+	}
+
+	used, err := provisionedBytes(env, pool)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to compute node usage: %v", err)
+	}
+	for _, volume := range store.Reservations() {
+		if volume.Pool == pool.Name {
+			used += volume.Size
+		}
+	}
+
+	available := max(budget-used, 0)
+	if requested > available {
+		return status.Errorf(codes.ResourceExhausted, "insufficient capacity in pool %s: used %s, requested %s, available %s",
+			pool.Name, formatBytes(used), formatBytes(requested), formatBytes(available))
+	}
+	return nil
+}
+
+// formatBytes renders a byte count as a Kubernetes quantity, e.g. 10Gi.
+func formatBytes(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
+
+// backingFiles returns the backing images in the directory of a pool.
+func backingFiles(env *conf.Env, pool config.Pool) ([]os.FileInfo, error) {
+	entries, err := afero.ReadDir(env.FS, pool.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []os.FileInfo
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && strings.HasSuffix(entry.Name(), ".img") {
+			images = append(images, entry)
+		}
+	}
+	return images, nil
+}
+
+// provisionedBytes returns the space provisioned to volumes in a pool,
+// which is the sum of the apparent sizes of all backing files.
+func provisionedBytes(env *conf.Env, pool config.Pool) (int64, error) {
+	images, err := backingFiles(env, pool)
+	if err != nil {
+		return 0, err
+	}
+
+	var provisioned int64
+	for _, image := range images {
+		provisioned += image.Size()
+	}
+	return provisioned, nil
+}
+
+// reservedBytes returns the space promised to backing files but not yet allocated on disk.
+// Each sparse image may grow up to its apparent size, so the difference between
+// its size and its allocated blocks is an outstanding reservation.
+func reservedBytes(env *conf.Env, pool config.Pool) (int64, error) {
+	images, err := backingFiles(env, pool)
+	if err != nil {
+		return 0, err
+	}
+
+	var reserved int64
+	for _, image := range images {
+		allocated, err := env.AllocatedBytes(filepath.Join(pool.Path, image.Name()))
+		if err != nil {
+			return 0, err
+		}
+		if image.Size() > allocated {
+			reserved += image.Size() - allocated
+		}
+	}
+	return reserved, nil
+}
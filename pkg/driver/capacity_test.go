@@ -0,0 +1,147 @@
+// Node budget and capacity accounting tests.
+package driver
+
+import (
+	"testing"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// mockStatfs makes the backing filesystem of env report the given total and free bytes.
+func mockStatfs(env *conf.Env, total, free int64) {
+	env.Statfs = func(path string) (int64, int64, error) {
+		return total, free, nil
+	}
+}
+
+// writeBackingFile creates a backing file with the given apparent size in
+// the filesystem of env. Sizes should stay small, since the in-memory
+// filesystem allocates them.
+func writeBackingFile(t *testing.T, env *conf.Env, path string, size int64) {
+	f, err := env.FS.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(size))
+	f.Close()
+}
+
+func TestPoolBudget(t *testing.T) {
+	t.Parallel()
+
+	capacity := resource.MustParse("50Ki")
+
+	tests := []struct {
+		name string
+		cfg  *config.Config
+		want int64
+	}{
+		{
+			name: "defaults to the backing filesystem size",
+			cfg:  config.Default(),
+			want: 100 << 10,
+		},
+		{
+			name: "uses configured capacity",
+			cfg:  &config.Config{OvercommitRatio: 1.0, Capacity: &capacity},
+			want: 50 << 10,
+		},
+		{
+			name: "uses percentage of the backing filesystem",
+			cfg:  &config.Config{OvercommitRatio: 1.0, CapacityPercent: 25},
+			want: 25 << 10,
+		},
+		{
+			name: "subtracts reserved floor and applies overcommit ratio",
+			cfg:  &config.Config{OvercommitRatio: 2.0, Reserved: resource.MustParse("20Ki")},
+			want: 160 << 10,
+		},
+		{
+			name: "uses budget of configured pool",
+			cfg: &config.Config{OvercommitRatio: 1.0, Capacity: &capacity, Pools: map[string]config.Pool{
+				"nvme": {Path: "/mnt/nvme", CapacityPercent: 40},
+			}},
+			want: 40 << 10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			mockStatfs(env, 100<<10, 60<<10)
+			pool, ok := tt.cfg.Pool("")
+			require.True(t, ok)
+
+			budget, err := poolBudget(env, tt.cfg, pool)
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, budget)
+		})
+	}
+}
+
+func TestCheckBudget(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		requested       int64
+		reserved        int64
+		wantCode        codes.Code
+		wantErrContains string
+	}{
+		{
+			name:      "accepts volume within budget",
+			requested: 60 << 10,
+		},
+		{
+			name:            "rejects volume exceeding budget",
+			requested:       61 << 10,
+			wantCode:        codes.ResourceExhausted,
+			wantErrContains: "insufficient capacity in pool default: used 40Ki, requested 61Ki, available 60Ki",
+		},
+		{
+			name:            "counts reserved volumes as used",
+			requested:       40 << 10,
+			reserved:        30 << 10,
+			wantCode:        codes.ResourceExhausted,
+			wantErrContains: "insufficient capacity in pool default: used 70Ki, requested 40Ki, available 30Ki",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			mockStatfs(env, 100<<10, 100<<10)
+			writeBackingFile(t, env, backingFilePath(config.DefaultPoolPath, "vol-a"), 30<<10)
+			writeBackingFile(t, env, backingFilePath(config.DefaultPoolPath, "vol-b"), 10<<10)
+
+			cfg := config.Default()
+			pool, _ := cfg.Pool("")
+			store := newTestState(t, env)
+			if tt.reserved > 0 {
+				require.True(t, store.Reserve(state.Volume{ID: "vol-c", Pool: pool.Name, Size: tt.reserved}))
+			}
+
+			err := checkBudget(env, cfg, store, pool, tt.requested)
+
+			if tt.wantCode == codes.OK {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tt.wantCode, status.Code(err))
+			assert.Contains(t, err.Error(), tt.wantErrContains)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// copyImage copies a backing image.
+// It first tries a reflink, which shares blocks on btrfs and xfs and completes instantly.
+// If the filesystem does not support reflinks, it falls back to a sparse-aware copy
+// that keeps the holes of the image.
+func copyImage(ctx context.Context, env *conf.Env, src, dst string) error {
+	_, err := env.Runner.Run(ctx, "cp", "--reflink=always", env.RealPath(src), env.RealPath(dst))
+	if err == nil {
+		return nil
+	}
+	klog.Infof("Reflink copy of %s not possible, falling back to sparse copy: %v", src, err)
+
+	env.FS.Remove(dst)
+	_, err = env.Runner.Run(ctx, "cp", "--sparse=always", env.RealPath(src), env.RealPath(dst))
+	return err
+}
+
+// copyVolume copies the backing file of a volume to dst.
+// If the volume is mounted, its filesystem is frozen for the duration of the copy,
+// so the copy is crash-consistent.
+func copyVolume(ctx context.Context, env *conf.Env, volume state.Volume, dst string) error {
+	if len(volume.TargetPaths) > 0 {
+		mountPath := env.RealPath(volume.TargetPaths[0])
+		klog.Infof("Freezing filesystem at %s", mountPath)
+		if _, err := env.Runner.Run(ctx, "fsfreeze", "-f", mountPath); err != nil {
+			return fmt.Errorf("failed to freeze filesystem: %v", err)
+		}
+		defer func() {
+			// The filesystem is thawed even if the request was canceled during the copy
+			if _, err := env.Runner.Run(context.WithoutCancel(ctx), "fsfreeze", "-u", mountPath); err != nil {
+				klog.Errorf("Failed to unfreeze filesystem at %s: %v", mountPath, err)
+			}
+		}()
+	}
+
+	if err := copyImage(ctx, env, volume.BackingFile, dst); err != nil {
+		return fmt.Errorf("failed to copy backing file: %v", err)
+	}
+	return nil
+}
+
+// populateVolume creates the backing file of a new volume from a snapshot or an existing volume
+// and records the volume, provided it fits into the pool budget and the quota of its namespace.
+// The new volume is never smaller than its source; if it is larger, the backing file
+// is grown and the filesystem is grown on the next publish, as is a filesystem copied
+// from a source that was not grown yet.
+// The new volume keeps the filesystem and encryption of its source, an encrypted volume
+// cannot be populated from an unencrypted source. Sources must live on this node,
+// since backing files are node-local, but may live in another pool.
+func (cs *ControllerServer) populateVolume(ctx context.Context, volume *state.Volume, pool config.Pool, source *csi.VolumeContentSource) error {
+	var sourceSize int64
+	var sourceResizePending bool
+	var copySource func(path string) error
+	switch {
+	case source.GetSnapshot() != nil:
+		snapshotID := source.GetSnapshot().GetSnapshotId()
+		snapshot, ok := cs.State.GetSnapshot(snapshotID)
+		if !ok {
+			return status.Errorf(codes.NotFound, "snapshot %s not found on node %s", snapshotID, cs.NodeId)
+		}
+		if volume.Encrypted && !snapshot.Encrypted {
+			return status.Errorf(codes.InvalidArgument, "snapshot %s is not encrypted, volume %s cannot be restored from it", snapshotID, volume.ID)
+		}
+
+		volume.SourceSnapshotID = snapshotID
+		volume.Filesystem = snapshot.Filesystem
+		volume.Encrypted, volume.Unformatted = snapshot.Encrypted, snapshot.Unformatted
+		sourceSize, sourceResizePending = snapshot.Size, snapshot.ResizePending
+		copySource = func(path string) error {
+			klog.Infof("Restoring volume %s from snapshot %s", volume.ID, snapshotID)
+			if err := copyImage(ctx, cs.Env, snapshot.BackingFile, path); err != nil {
+				return fmt.Errorf("failed to copy snapshot: %v", err)
+			}
+			return nil
+		}
+
+	case source.GetVolume() != nil:
+		sourceID := source.GetVolume().GetVolumeId()
+		sourceVolume, ok := cs.persistentVolume(sourceID)
+		if !ok {
+			return status.Errorf(codes.NotFound, "source volume %s not found on node %s: volumes can only be cloned on the node they live on", sourceID, cs.NodeId)
+		}
+		if volume.Encrypted && !sourceVolume.Encrypted {
+			return status.Errorf(codes.InvalidArgument, "volume %s is not encrypted, volume %s cannot be cloned from it", sourceID, volume.ID)
+		}
+
+		volume.SourceVolumeID = sourceID
+		volume.Filesystem = sourceVolume.Filesystem
+		volume.Encrypted, volume.Unformatted = sourceVolume.Encrypted, sourceVolume.Unformatted
+		sourceSize, sourceResizePending = sourceVolume.Size, sourceVolume.ResizePending
+		copySource = func(path string) error {
+			klog.Infof("Cloning volume %s from volume %s", volume.ID, sourceID)
+			return copyVolume(ctx, cs.Env, sourceVolume, path)
+		}
+
+	default:
+		return status.Error(codes.InvalidArgument, "unsupported volume content source")
+	}
+
+	// A source whose filesystem was not grown yet leaves the filesystem of the copy smaller too
+	grown := volume.Size > sourceSize
+	volume.Size = max(volume.Size, sourceSize)
+	volume.ResizePending = sourceResizePending || grown
+
+	// The volume is reserved while its source is copied, so concurrent requests cannot both
+	// claim the last free part of the budget without waiting for the copy
+	err := allocateReserved(cs.Env, cs.Config, cs.State, pool, *volume, func(path string) error {
+		if err := copySource(path); err != nil {
+			return err
+		}
+		if grown {
+			if err := cs.Env.Loop.Truncate(cs.Env.RealPath(path), volume.Size); err != nil {
+				return fmt.Errorf("failed to grow backing file: %v", err)
+			}
+		}
+		return nil
+	})
+	if status.Code(err) == codes.Unknown {
+		err = status.Error(codes.Internal, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+// Backing image copy tests.
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyImage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		reflinkErr   error
+		sparseErr    error
+		wantErr      bool
+		wantCommands []string
+	}{
+		{
+			name:         "uses reflink when supported",
+			wantCommands: []string{"[cp --reflink=always /src.img /dst.img]"},
+		},
+		{
+			name:       "falls back to sparse copy without reflink support",
+			reflinkErr: fmt.Errorf("operation not supported"),
+			wantCommands: []string{
+				"[cp --reflink=always /src.img /dst.img]",
+				"[cp --sparse=always /src.img /dst.img]",
+			},
+		},
+		{
+			name:       "fails when sparse copy fails",
+			reflinkErr: fmt.Errorf("operation not supported"),
+			sparseErr:  fmt.Errorf("no space left on device"),
+			wantErr:    true,
+			wantCommands: []string{
+				"[cp --reflink=always /src.img /dst.img]",
+				"[cp --sparse=always /src.img /dst.img]",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+
+			// Setup mock
+			var commands []string
+			mockCommands(env, func(name string, args ...string) error {
+				commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+				if args[0] == "--reflink=always" {
+					return tt.reflinkErr
+				}
+				return tt.sparseErr
+			})
+
+			err := copyImage(context.Background(), env, "/src.img", "/dst.img")
+
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantCommands, commands)
+		})
+	}
+}
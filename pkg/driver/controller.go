@@ -0,0 +1,325 @@
+package driver
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// pvcNamespaceKey is the CreateVolume parameter holding the namespace of the claim.
+const pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+
+// ControllerServer implements the CSI Controller service.
+// It runs next to the node service on every node (external-provisioner node deployment)
+// and manages persistent volumes and snapshots that live on the local node.
+type ControllerServer struct {
+	// Env is the environment the service runs in: its filesystem, commands, mounts and clock.
+	Env *conf.Env
+	// NodeId is the unique identifier for this node.
+	NodeId string
+	// Config holds the driver configuration.
+	Config *config.Config
+	// State tracks persistent volumes and snapshots.
+	State *state.Store
+}
+
+// NewControllerServer returns the controller service of the node env runs on.
+func NewControllerServer(env *conf.Env, cfg *config.Config, store *state.Store) *ControllerServer {
+	return &ControllerServer{Env: env, NodeId: env.NodeId, Config: cfg, State: store}
+}
+
+// CreateVolume creates a persistent volume on this node.
+// The backing file is allocated in the pool selected by the pool parameter or the placement
+// strategy and formatted with the pool's filesystem, or copied from the snapshot or volume
+// given as content source and grown to the requested size.
+// The size is the required bytes of the capacity range, or the default size of the pool,
+// raised to the pool's minimum and rounded up to whole blocks.
+// Volumes with the encrypted parameter are formatted with LUKS on their first publish.
+// Creating a volume that already exists with a compatible size returns the existing volume.
+//
+// The volume counts towards the quota of the claim's namespace, which the external-provisioner
+// passes as a parameter when started with --extra-create-metadata.
+//
+// Returns an error if the request, pool or size is invalid, the node is not accessible, out of
+// budget or the namespace quota is exhausted, the content source is unknown, or file creation fails.
+func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	volumeID := req.GetName()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume name is required")
+	}
+
+	if err := validateCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if !cs.isAccessible(req.GetAccessibilityRequirements()) {
+		return nil, status.Errorf(codes.ResourceExhausted, "volume %s cannot be placed on node %s", volumeID, cs.NodeId)
+	}
+
+	capacityRange := req.GetCapacityRange()
+	klog.Infof("CreateVolume: volumeID=%s, requiredBytes=%d, limitBytes=%d, pool=%s",
+		volumeID, capacityRange.GetRequiredBytes(), capacityRange.GetLimitBytes(), req.GetParameters()[poolParameter])
+
+	if volume, ok := cs.persistentVolume(volumeID); ok {
+		if limit := capacityRange.GetLimitBytes(); volume.Size < capacityRange.GetRequiredBytes() || (limit > 0 && volume.Size > limit) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with size %d", volumeID, volume.Size)
+		}
+		return &csi.CreateVolumeResponse{Volume: cs.csiVolume(volume, req.GetVolumeContentSource())}, nil
+	}
+
+	pool, err := selectPool(cs.Env, cs.Config, cs.State, req.GetParameters()[poolParameter], capacityRange.GetRequiredBytes())
+	if err != nil {
+		return nil, err
+	}
+	fsType, err := volumeFilesystem(pool, req.GetVolumeCapabilities()[0])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	sizeBytes, err := capacitySize(pool, fsType, capacityRange)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := parseEncrypted(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	volume := state.Volume{
+		ID:          volumeID,
+		Namespace:   req.GetParameters()[pvcNamespaceKey],
+		Pool:        pool.Name,
+		Filesystem:  fsType,
+		BackingFile: backingFilePath(pool.Path, volumeID),
+		Size:        sizeBytes,
+		Encrypted:   encrypted,
+		Unformatted: encrypted,
+		CreatedAt:   cs.Env.Now(),
+	}
+	if required := capacityRange.GetRequiredBytes(); required > 0 {
+		volume.RequestedSize = formatBytes(required)
+	}
+
+	if source := req.GetVolumeContentSource(); source != nil {
+		if err := cs.populateVolume(ctx, &volume, pool, source); err != nil {
+			return nil, err
+		}
+	} else if err := cs.createVolume(ctx, pool, volume); err != nil {
+		return nil, err
+	}
+
+	klog.Infof("Volume %s successfully created", volumeID)
+	return &csi.CreateVolumeResponse{Volume: cs.csiVolume(volume, req.GetVolumeContentSource())}, nil
+}
+
+// createVolume allocates and formats the backing file of a new empty volume.
+// Encrypted volumes are left unformatted, their passphrase is only passed to the node on publish.
+func (cs *ControllerServer) createVolume(ctx context.Context, pool config.Pool, volume state.Volume) error {
+	if err := allocateVolume(cs.Env, cs.Config, cs.State, pool, volume); err != nil {
+		if status.Code(err) == codes.Unknown {
+			err = status.Error(codes.Internal, err.Error())
+		}
+		return err
+	}
+	if volume.Encrypted {
+		return nil
+	}
+
+	if err := formatBackingFile(ctx, cs.Env, volume.Filesystem, volume.BackingFile); err != nil {
+		releaseVolume(cs.Env, cs.Config, cs.State, volume)
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// persistentVolume returns the persistent volume with the given ID.
+// Ephemeral volumes only exist on the node side and are invisible to the controller.
+func (cs *ControllerServer) persistentVolume(volumeID string) (state.Volume, bool) {
+	volume, ok := cs.State.GetVolume(volumeID)
+	return volume, ok && !volume.Ephemeral
+}
+
+// DeleteVolume removes a persistent volume, its backing file and its metadata.
+// Deleting an unknown volume succeeds, as required for idempotency.
+//
+// Returns an error if the volume is still mounted or the state cannot be saved.
+func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+
+	klog.Infof("DeleteVolume: volumeID=%s", volumeID)
+
+	volume, ok := cs.persistentVolume(volumeID)
+	if !ok {
+		klog.Infof("Volume %s not found, nothing to delete", volumeID)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	if len(volume.TargetPaths) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is still mounted at %v", volumeID, volume.TargetPaths)
+	}
+
+	if err := releaseVolume(cs.Env, cs.Config, cs.State, volume); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	klog.Infof("Volume %s successfully deleted", volumeID)
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// isAccessible reports whether volumes with the given topology requirements can live on this node.
+func (cs *ControllerServer) isAccessible(requirements *csi.TopologyRequirement) bool {
+	if len(requirements.GetRequisite()) == 0 {
+		return true
+	}
+	node := nodeTopology(cs.Config, cs.NodeId)
+	for _, topology := range requirements.GetRequisite() {
+		if matchesTopology(topology, node) {
+			return true
+		}
+	}
+	return false
+}
+
+// csiVolume converts a volume record into its CSI representation.
+// Volumes recorded before pools existed belong to the default pool.
+func (cs *ControllerServer) csiVolume(volume state.Volume, source *csi.VolumeContentSource) *csi.Volume {
+	pool := cmp.Or(volume.Pool, config.DefaultPoolName)
+	return &csi.Volume{
+		VolumeId:           volume.ID,
+		CapacityBytes:      volume.Size,
+		ContentSource:      source,
+		VolumeContext:      map[string]string{poolParameter: pool},
+		AccessibleTopology: []*csi.Topology{volumeTopology(cs.NodeId, pool)},
+	}
+}
+
+// GetCapacity returns the capacity available for new volumes in a pool of this node.
+// The pool is selected by the pool parameter of the StorageClass. Without one, and with
+// a placement strategy, the largest capacity of the eligible pools is reported.
+// Requests scoped to the topology of another node report zero capacity.
+//
+// Returns an error if the pool is unknown or its filesystem cannot be inspected.
+func (cs *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	klog.V(5).Infof("GetCapacity called: topology=%v, parameters=%v", req.GetAccessibleTopology(), req.GetParameters())
+
+	if topology := req.GetAccessibleTopology(); topology != nil {
+		if !matchesTopology(topology, nodeTopology(cs.Config, cs.NodeId)) {
+			return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+		}
+	}
+
+	var available int64
+	if name := req.GetParameters()[poolParameter]; name == "" && cs.Config.Placement != "" {
+		// Any eligible pool may be chosen, so the largest volume that fits is what counts
+		for _, candidate := range eligiblePools(cs.Env, cs.Config, cs.State, 0) {
+			available = max(available, candidate.available)
+		}
+	} else {
+		pool, err := resolvePool(cs.Config, name)
+		if err != nil {
+			return nil, err
+		}
+
+		available, err = availableCapacity(cs.Env, cs.Config, pool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute capacity: %v", err)
+		}
+	}
+
+	klog.V(5).Infof("GetCapacity: available=%d bytes", available)
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
+}
+
+// ControllerGetCapabilities returns the controller capabilities.
+// It supports capacity reporting, persistent volumes, snapshots, cloning,
+// and single-node multi-writer access.
+func (cs *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	var capabilities []*csi.ControllerServiceCapability
+	for _, capability := range []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+	} {
+		capabilities = append(capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: capability},
+			},
+		})
+	}
+
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: capabilities}, nil
+}
+
+// ControllerPublishVolume is not implemented since loop volumes need no attach step.
+func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// ControllerUnpublishVolume is not implemented since loop volumes need no detach step.
+func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// ValidateVolumeCapabilities checks whether a persistent volume supports the given capabilities.
+// Only mounted filesystems with node-local access modes are confirmed;
+// unsupported capabilities are reported in the response message.
+//
+// Returns an error if the request is invalid or the volume does not exist.
+func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
+	}
+
+	if _, ok := cs.persistentVolume(volumeID); !ok {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found on node %s", volumeID, cs.NodeId)
+	}
+
+	if err := validateCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// ListVolumes is not implemented.
+func (cs *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// ControllerExpandVolume is not implemented.
+func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// ControllerGetVolume is not implemented.
+func (cs *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// ControllerModifyVolume is not implemented.
+func (cs *ControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
@@ -0,0 +1,727 @@
+// Controller service capacity and volume lifecycle tests.
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestControllerServer_GetCapabilities(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	cs := NewControllerServer(env, config.Default(), nil)
+
+	resp, err := cs.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+
+	require.NoError(t, err)
+
+	var rpcs []csi.ControllerServiceCapability_RPC_Type
+	for _, capability := range resp.Capabilities {
+		rpcs = append(rpcs, capability.GetRpc().GetType())
+	}
+	assert.ElementsMatch(t, []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+	}, rpcs)
+}
+
+func TestControllerServer_GetCapacity(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		overcommitRatio float64
+		free            int64
+		images          map[string][2]int64 // name -> {size, allocated}
+		topology        *csi.Topology
+		statfsErr       error
+		want            int64
+		wantErr         bool
+	}{
+		{
+			name:            "reports free space without volumes",
+			overcommitRatio: 1.0,
+			free:            10 << 10,
+			want:            10 << 10,
+		},
+		{
+			name:            "subtracts outstanding reservations of sparse volumes",
+			overcommitRatio: 1.0,
+			free:            10 << 10,
+			images: map[string][2]int64{
+				"vol-a.img": {4 << 10, 1 << 10},
+				"vol-b.img": {2 << 10, 2 << 10},
+			},
+			want: 7 << 10,
+		},
+		{
+			name:            "applies overcommit ratio",
+			overcommitRatio: 2.0,
+			free:            10 << 10,
+			images: map[string][2]int64{
+				"vol-a.img": {4 << 10, 0},
+			},
+			want: 12 << 10,
+		},
+		{
+			name:            "never reports negative capacity",
+			overcommitRatio: 1.0,
+			free:            1 << 10,
+			images: map[string][2]int64{
+				"vol-a.img": {4 << 10, 0},
+			},
+			want: 0,
+		},
+		{
+			name:            "reports zero for another node's topology",
+			overcommitRatio: 1.0,
+			free:            10 << 10,
+			topology:        &csi.Topology{Segments: map[string]string{topologyKey: "other-node"}},
+			want:            0,
+		},
+		{
+			name:            "reports capacity for own topology",
+			overcommitRatio: 1.0,
+			free:            10 << 10,
+			topology:        &csi.Topology{Segments: map[string]string{topologyKey: "test-node"}},
+			want:            10 << 10,
+		},
+		{
+			name:            "fails when statfs fails",
+			overcommitRatio: 1.0,
+			statfsErr:       fmt.Errorf("no such device"),
+			wantErr:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+
+			// Setup mocks
+
+			env.Statfs = func(path string) (int64, int64, error) {
+				return 100 << 10, tt.free, tt.statfsErr
+			}
+			env.AllocatedBytes = func(path string) (int64, error) {
+				for name, sizes := range tt.images {
+					if path == fmt.Sprintf("%s/%s", config.DefaultPoolPath, name) {
+						return sizes[1], nil
+					}
+				}
+				return 0, fmt.Errorf("unexpected file %s", path)
+			}
+
+			// Setup backing files
+			for name, sizes := range tt.images {
+				backingFile := fmt.Sprintf("%s/%s", config.DefaultPoolPath, name)
+				f, err := env.FS.Create(backingFile)
+				require.NoError(t, err)
+				require.NoError(t, f.Truncate(sizes[0]))
+				f.Close()
+			}
+
+			cs := NewControllerServer(env, &config.Config{OvercommitRatio: tt.overcommitRatio}, nil)
+			resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{AccessibleTopology: tt.topology})
+
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "failed to compute capacity")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, resp.AvailableCapacity)
+		})
+	}
+}
+
+func TestControllerServer_CreateVolume(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		req          *csi.CreateVolumeRequest
+		existing     *state.Volume
+		source       *state.Volume
+		snapshot     *state.Snapshot
+		mockCommands map[string]error
+		wantCode     codes.Code
+		wantSize     int64
+		wantCommands []string
+		wantResize   bool
+	}{
+		{
+			name: "creates and formats volume",
+			req: &csi.CreateVolumeRequest{
+				Name:          "pvc-1",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30},
+			},
+			wantSize:     2 << 30,
+			wantCommands: []string{"truncate", "mkfs.btrfs"},
+		},
+		{
+			name:         "defaults size without capacity range",
+			req:          &csi.CreateVolumeRequest{Name: "pvc-1"},
+			wantSize:     defaultVolumeSize,
+			wantCommands: []string{"truncate", "mkfs.btrfs"},
+		},
+		{
+			name:     "returns existing volume with compatible size",
+			req:      &csi.CreateVolumeRequest{Name: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30}},
+			existing: &state.Volume{ID: "pvc-1", Size: 1 << 30},
+			wantSize: 1 << 30,
+		},
+		{
+			name:     "rejects existing volume with incompatible size",
+			req:      &csi.CreateVolumeRequest{Name: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30}},
+			existing: &state.Volume{ID: "pvc-1", Size: 1 << 30},
+			wantCode: codes.AlreadyExists,
+		},
+		{
+			name: "rejects topology of another node",
+			req: &csi.CreateVolumeRequest{
+				Name: "pvc-1",
+				AccessibilityRequirements: &csi.TopologyRequirement{
+					Requisite: []*csi.Topology{{Segments: map[string]string{topologyKey: "other-node"}}},
+				},
+			},
+			wantCode: codes.ResourceExhausted,
+		},
+		{
+			name:     "rejects volume exceeding node budget",
+			req:      &csi.CreateVolumeRequest{Name: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 40}},
+			wantCode: codes.ResourceExhausted,
+		},
+		{
+			name:     "rejects missing name",
+			req:      &csi.CreateVolumeRequest{},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "rejects multi-node access mode",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "restores from snapshot",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				CapacityRange:       &csi.CapacityRange{RequiredBytes: 1 << 30},
+				VolumeContentSource: snapshotSource("snap-1"),
+			},
+			snapshot:     &state.Snapshot{ID: "snap-1", BackingFile: snapshotFilePath(config.DefaultPoolPath, "snap-1"), Size: 1 << 30},
+			wantSize:     1 << 30,
+			wantCommands: []string{"cp"},
+		},
+		{
+			name: "restores from snapshot and grows backing file",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				CapacityRange:       &csi.CapacityRange{RequiredBytes: 3 << 30},
+				VolumeContentSource: snapshotSource("snap-1"),
+			},
+			snapshot:     &state.Snapshot{ID: "snap-1", BackingFile: snapshotFilePath(config.DefaultPoolPath, "snap-1"), Size: 1 << 30},
+			wantSize:     3 << 30,
+			wantCommands: []string{"cp", "truncate"},
+			wantResize:   true,
+		},
+		{
+			name: "rejects unknown snapshot",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				VolumeContentSource: snapshotSource("snap-unknown"),
+			},
+			wantCode: codes.NotFound,
+		},
+		{
+			name: "clones volume and grows backing file",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				CapacityRange:       &csi.CapacityRange{RequiredBytes: 2 << 30},
+				VolumeContentSource: volumeSource("pvc-src"),
+			},
+			source:       &state.Volume{ID: "pvc-src", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-src"), Size: 1 << 30},
+			wantSize:     2 << 30,
+			wantCommands: []string{"cp", "truncate"},
+			wantResize:   true,
+		},
+		{
+			name: "clones mounted volume while frozen",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				VolumeContentSource: volumeSource("pvc-src"),
+			},
+			source:       &state.Volume{ID: "pvc-src", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-src"), Size: 2 << 30, TargetPaths: []string{"/mnt/src"}},
+			wantSize:     2 << 30,
+			wantCommands: []string{"fsfreeze", "cp", "fsfreeze"},
+		},
+		{
+			name: "clones volume whose filesystem was not grown yet",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				VolumeContentSource: volumeSource("pvc-src"),
+			},
+			source:       &state.Volume{ID: "pvc-src", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-src"), Size: 2 << 30, ResizePending: true},
+			wantSize:     2 << 30,
+			wantCommands: []string{"cp"},
+			wantResize:   true,
+		},
+		{
+			name: "restores from snapshot whose filesystem was not grown yet",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				VolumeContentSource: snapshotSource("snap-1"),
+			},
+			snapshot:     &state.Snapshot{ID: "snap-1", BackingFile: snapshotFilePath(config.DefaultPoolPath, "snap-1"), Size: 1 << 30, ResizePending: true},
+			wantSize:     1 << 30,
+			wantCommands: []string{"cp"},
+			wantResize:   true,
+		},
+		{
+			name: "rejects clone exceeding node budget",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				VolumeContentSource: volumeSource("pvc-src"),
+			},
+			source:   &state.Volume{ID: "pvc-src", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-src"), Size: 2 << 40},
+			wantCode: codes.ResourceExhausted,
+		},
+		{
+			name: "fails when copying the source fails",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				VolumeContentSource: snapshotSource("snap-1"),
+			},
+			snapshot:     &state.Snapshot{ID: "snap-1", BackingFile: snapshotFilePath(config.DefaultPoolPath, "snap-1"), Size: 1 << 30},
+			mockCommands: map[string]error{"cp": fmt.Errorf("cp error")},
+			wantCode:     codes.Internal,
+		},
+		{
+			name: "rejects source volume from another node",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				VolumeContentSource: volumeSource("pvc-elsewhere"),
+			},
+			wantCode: codes.NotFound,
+		},
+		{
+			name:         "leaves encrypted volume unformatted",
+			req:          &csi.CreateVolumeRequest{Name: "pvc-1", Parameters: map[string]string{encryptedParameter: "true"}},
+			wantSize:     defaultVolumeSize,
+			wantCommands: []string{"truncate"},
+		},
+		{
+			name:     "rejects invalid encrypted parameter",
+			req:      &csi.CreateVolumeRequest{Name: "pvc-1", Parameters: map[string]string{encryptedParameter: "maybe"}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "rejects encrypted volume from unencrypted snapshot",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				Parameters:          map[string]string{encryptedParameter: "true"},
+				VolumeContentSource: snapshotSource("snap-1"),
+			},
+			snapshot: &state.Snapshot{ID: "snap-1", BackingFile: snapshotFilePath(config.DefaultPoolPath, "snap-1"), Size: 1 << 30},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "clones encrypted volume",
+			req: &csi.CreateVolumeRequest{
+				Name:                "pvc-1",
+				VolumeContentSource: volumeSource("pvc-src"),
+			},
+			source:       &state.Volume{ID: "pvc-src", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-src"), Size: 1 << 30, Encrypted: true},
+			wantSize:     1 << 30,
+			wantCommands: []string{"cp"},
+		},
+		{
+			name:         "fails when mkfs fails",
+			req:          &csi.CreateVolumeRequest{Name: "pvc-1"},
+			mockCommands: map[string]error{"mkfs.btrfs": fmt.Errorf("mkfs error")},
+			wantCode:     codes.Internal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+
+			// Setup mock
+			var commands []string
+			mockCommands(env, func(name string, args ...string) error {
+				commands = append(commands, name)
+				if name == "cp" && tt.mockCommands[name] == nil {
+					return afero.WriteFile(env.FS, args[len(args)-1], nil, 0644)
+				}
+				return tt.mockCommands[name]
+			})
+
+			store := newTestState(t, env)
+			if tt.existing != nil {
+				require.NoError(t, store.PutVolume(*tt.existing))
+			}
+			if tt.source != nil {
+				require.NoError(t, store.PutVolume(*tt.source))
+			}
+			if tt.snapshot != nil {
+				require.NoError(t, store.PutSnapshot(*tt.snapshot))
+			}
+
+			mockStatfs(env, 1<<40, 1<<40)
+
+			if tt.req.VolumeCapabilities == nil {
+				tt.req.VolumeCapabilities = []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}
+			}
+
+			cs := NewControllerServer(env, config.Default(), store)
+			resp, err := cs.CreateVolume(context.Background(), tt.req)
+
+			if tt.wantCode != codes.OK {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				if tt.existing == nil {
+					_, ok := store.GetVolume(tt.req.GetName())
+					assert.False(t, ok, "failed volume should not be recorded")
+				}
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantSize, resp.Volume.CapacityBytes)
+			assert.Equal(t, "test-node", resp.Volume.AccessibleTopology[0].Segments[topologyKey])
+			assert.Equal(t, tt.wantCommands, commands)
+
+			volume, ok := store.GetVolume(tt.req.GetName())
+			require.True(t, ok)
+			assert.Equal(t, tt.wantSize, volume.Size)
+			assert.Equal(t, tt.wantResize, volume.ResizePending)
+			encrypted := tt.req.GetParameters()[encryptedParameter] == "true" || (tt.source != nil && tt.source.Encrypted)
+			assert.Equal(t, encrypted, volume.Encrypted)
+		})
+	}
+}
+
+func TestControllerServer_CreateVolumeWhileCopying(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	copying, copied := make(chan struct{}), make(chan struct{})
+	mockCommands(env, func(name string, args ...string) error {
+		if name == "cp" {
+			close(copying)
+			<-copied
+			return afero.WriteFile(env.FS, args[len(args)-1], nil, 0644)
+		}
+		return nil
+	})
+	mockStatfs(env, 4<<30, 4<<30)
+
+	store := newTestState(t, env)
+	require.NoError(t, store.PutVolume(state.Volume{ID: "pvc-src", Pool: "default", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-src"), Size: 2 << 30}))
+	cs := NewControllerServer(env, config.Default(), store)
+	create := func(name string, size int64, source *csi.VolumeContentSource) error {
+		_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: size},
+			VolumeCapabilities:  []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			VolumeContentSource: source,
+		})
+		return err
+	}
+
+	cloned := make(chan error)
+	go func() { cloned <- create("pvc-1", 2<<30, volumeSource("pvc-src")) }()
+	<-copying
+
+	// Other volumes are created while the clone is copied, its reservation counts towards the budget
+	require.NoError(t, create("pvc-2", 1<<30, nil))
+	err := create("pvc-3", 3<<30, nil)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, ok := store.GetVolume("pvc-1")
+	assert.False(t, ok, "the clone should only be recorded once copied")
+
+	close(copied)
+	require.NoError(t, <-cloned)
+	volume, ok := store.GetVolume("pvc-1")
+	require.True(t, ok)
+	assert.Equal(t, "pvc-src", volume.SourceVolumeID)
+	assert.Empty(t, store.Reservations())
+	exists, _ := afero.Exists(env.FS, volume.BackingFile)
+	assert.True(t, exists, "the copy should be moved into place")
+}
+
+func TestControllerServer_CreateVolumeInPool(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		parameters      map[string]string
+		fsType          string
+		wantCode        codes.Code
+		wantErrContains string
+		wantPool        string
+		wantBackingFile string
+		wantMkfs        string
+	}{
+		{
+			name:            "places volume in default pool",
+			wantPool:        "sata",
+			wantBackingFile: "/mnt/sata/pvc-1.img",
+			wantMkfs:        "[mkfs.btrfs /mnt/sata/pvc-1.img]",
+		},
+		{
+			name:            "places volume in selected pool with its filesystem",
+			parameters:      map[string]string{poolParameter: "nvme"},
+			wantPool:        "nvme",
+			wantBackingFile: "/mnt/nvme/pvc-1.img",
+			wantMkfs:        "[mkfs.ext4 -F /mnt/nvme/pvc-1.img]",
+		},
+		{
+			name:            "formats with filesystem of volume capability",
+			parameters:      map[string]string{poolParameter: "nvme"},
+			fsType:          "xfs",
+			wantPool:        "nvme",
+			wantBackingFile: "/mnt/nvme/pvc-1.img",
+			wantMkfs:        "[mkfs.xfs /mnt/nvme/pvc-1.img]",
+		},
+		{
+			name:            "rejects unknown pool",
+			parameters:      map[string]string{poolParameter: "tape"},
+			wantCode:        codes.InvalidArgument,
+			wantErrContains: "unknown pool tape, available pools: [nvme sata]",
+		},
+		{
+			name:            "rejects unsupported filesystem",
+			fsType:          "zfs",
+			wantCode:        codes.InvalidArgument,
+			wantErrContains: "filesystem zfs is not supported",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+
+			// Setup mock
+			var commands []string
+			mockCommands(env, func(name string, args ...string) error {
+				commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+				return nil
+			})
+
+			mockStatfs(env, 1<<40, 1<<40)
+
+			cfg := config.Default()
+			cfg.Pools = map[string]config.Pool{
+				"nvme": {Path: "/mnt/nvme", Filesystem: "ext4"},
+				"sata": {Path: "/mnt/sata"},
+			}
+			cfg.DefaultPool = "sata"
+
+			capability := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+			capability.GetMount().FsType = tt.fsType
+
+			store := newTestState(t, env)
+			cs := NewControllerServer(env, cfg, store)
+			resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+				Parameters:         tt.parameters,
+				VolumeCapabilities: []*csi.VolumeCapability{capability},
+			})
+
+			if tt.wantCode != codes.OK {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{poolParameter: tt.wantPool}, resp.Volume.VolumeContext)
+			assert.Equal(t, map[string]string{
+				topologyKey:                  "test-node",
+				poolTopologyKey(tt.wantPool): "true",
+			}, resp.Volume.AccessibleTopology[0].Segments)
+			assert.Equal(t, tt.wantMkfs, commands[1])
+
+			volume, ok := store.GetVolume("pvc-1")
+			require.True(t, ok)
+			assert.Equal(t, tt.wantPool, volume.Pool)
+			assert.Equal(t, tt.wantBackingFile, volume.BackingFile)
+		})
+	}
+}
+
+func TestControllerServer_DeleteVolume(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		existing *state.Volume
+		wantCode codes.Code
+	}{
+		{
+			name:     "deletes volume and backing file",
+			existing: &state.Volume{ID: "pvc-1", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-1")},
+		},
+		{
+			name: "succeeds for unknown volume",
+		},
+		{
+			name:     "refuses to delete mounted volume",
+			existing: &state.Volume{ID: "pvc-1", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-1"), TargetPaths: []string{"/mnt/pvc"}},
+			wantCode: codes.FailedPrecondition,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			store := newTestState(t, env)
+			if tt.existing != nil {
+				require.NoError(t, store.PutVolume(*tt.existing))
+				require.NoError(t, afero.WriteFile(env.FS, tt.existing.BackingFile, []byte("fake-image"), 0644))
+			}
+
+			cs := NewControllerServer(env, config.Default(), store)
+			_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-1"})
+
+			if tt.wantCode != codes.OK {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+
+			require.NoError(t, err)
+			_, ok := store.GetVolume("pvc-1")
+			assert.False(t, ok)
+
+			exists, _ := afero.Exists(env.FS, backingFilePath(config.DefaultPoolPath, "pvc-1"))
+			assert.False(t, exists, "backing file should be removed")
+		})
+	}
+}
+
+func TestControllerServer_ValidateVolumeCapabilities(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		volumeID      string
+		capabilities  []*csi.VolumeCapability
+		wantCode      codes.Code
+		wantConfirmed bool
+	}{
+		{
+			name:          "confirms single-node multi-writer",
+			volumeID:      "pvc-1",
+			capabilities:  []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)},
+			wantConfirmed: true,
+		},
+		{
+			name:     "does not confirm multi-node modes",
+			volumeID: "pvc-1",
+			capabilities: []*csi.VolumeCapability{
+				mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+			},
+		},
+		{
+			name:     "does not confirm block access",
+			volumeID: "pvc-1",
+			capabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		},
+		{
+			name:         "rejects unknown volume",
+			volumeID:     "pvc-unknown",
+			capabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			wantCode:     codes.NotFound,
+		},
+		{
+			name:     "rejects missing capabilities",
+			volumeID: "pvc-1",
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			store := newTestState(t, env)
+			require.NoError(t, store.PutVolume(state.Volume{ID: "pvc-1"}))
+
+			cs := NewControllerServer(env, config.Default(), store)
+			resp, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           tt.volumeID,
+				VolumeCapabilities: tt.capabilities,
+			})
+
+			if tt.wantCode != codes.OK {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+
+			require.NoError(t, err)
+			if tt.wantConfirmed {
+				require.NotNil(t, resp.Confirmed)
+				assert.Equal(t, tt.capabilities, resp.Confirmed.VolumeCapabilities)
+			} else {
+				assert.Nil(t, resp.Confirmed)
+				assert.NotEmpty(t, resp.Message)
+			}
+		})
+	}
+}
+
+// snapshotSource returns a volume content source referencing a snapshot.
+func snapshotSource(snapshotID string) *csi.VolumeContentSource {
+	return &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+		},
+	}
+}
+
+// volumeSource returns a volume content source referencing an existing volume.
+func volumeSource(volumeID string) *csi.VolumeContentSource {
+	return &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volumeID},
+		},
+	}
+}
@@ -0,0 +1,179 @@
+package driver
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// encryptedParameter is the volume attribute, or StorageClass parameter, encrypting a volume with LUKS.
+const encryptedParameter = "encrypted"
+
+// passphraseSecret is the key of the node publish secret holding the LUKS passphrase of a volume.
+const passphraseSecret = "passphrase"
+
+// keySize is the number of random bytes of a throwaway key.
+const keySize = 64
+
+// cryptsetupWrongKey is the exit status of cryptsetup when no key slot matches the passphrase.
+const cryptsetupWrongKey = 2
+
+// exitStatus is implemented by the errors of commands that ran and failed, like *exec.ExitError.
+type exitStatus interface {
+	ExitCode() int
+}
+
+// parseEncrypted returns whether the given attributes or parameters encrypt a volume.
+//
+// Returns an InvalidArgument error if the value is not a boolean.
+func parseEncrypted(parameters map[string]string) (bool, error) {
+	value, ok := parameters[encryptedParameter]
+	if !ok {
+		return false, nil
+	}
+	encrypted, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "invalid %s %q: must be true or false", encryptedParameter, value)
+	}
+	return encrypted, nil
+}
+
+// encryptedVolume returns whether a new inline volume is encrypted, and the passphrase from
+// the node publish secrets it is encrypted with. Without a passphrase, the volume is encrypted
+// with a throwaway key that is lost with the mapping, so it cannot be retained. No encrypted
+// volume can be cached, archived or copied from an image template.
+//
+// Returns an InvalidArgument error if the attribute is invalid or combined with one of those.
+func encryptedVolume(volumeContext, secrets map[string]string) (bool, []byte, error) {
+	encrypted, err := parseEncrypted(volumeContext)
+	if err != nil || !encrypted {
+		return false, nil, err
+	}
+
+	passphrase := secretPassphrase(secrets)
+	if passphrase == nil && volumeContext[retainPolicyParameter] == retainPolicyKeep {
+		return false, nil, status.Errorf(codes.InvalidArgument, "%s %s requires the %s secret for %s volumes, a throwaway key is lost on unpublish",
+			retainPolicyParameter, retainPolicyKeep, passphraseSecret, encryptedParameter)
+	}
+
+	conflicts := map[string]bool{
+		cacheKeyParameter:    volumeContext[cacheKeyParameter] != "",
+		sourceImageParameter: volumeContext[sourceImageParameter] != "",
+	}
+	if archive, err := strconv.ParseBool(volumeContext[archiveOnDeleteParameter]); err == nil {
+		conflicts[archiveOnDeleteParameter] = archive
+	}
+	for _, parameter := range []string{cacheKeyParameter, archiveOnDeleteParameter, sourceImageParameter} {
+		if conflicts[parameter] {
+			return false, nil, status.Errorf(codes.InvalidArgument, "%s cannot be combined with %s volumes", parameter, encryptedParameter)
+		}
+	}
+	return true, passphrase, nil
+}
+
+// secretPassphrase returns the passphrase in the node publish secrets, or nil without one.
+// The whole value is the passphrase, including trailing newlines.
+func secretPassphrase(secrets map[string]string) []byte {
+	if passphrase := secrets[passphraseSecret]; passphrase != "" {
+		return []byte(passphrase)
+	}
+	return nil
+}
+
+// volumePassphrase returns the passphrase of an encrypted persistent volume from the node publish secrets.
+//
+// Returns an InvalidArgument error if the secret is missing.
+func volumePassphrase(volumeID string, secrets map[string]string) ([]byte, error) {
+	passphrase := secretPassphrase(secrets)
+	if passphrase == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s is %s and requires the %s secret, set nodePublishSecretRef", volumeID, encryptedParameter, passphraseSecret)
+	}
+	return passphrase, nil
+}
+
+// encryptedDeviceName returns the name of the dm-crypt mapping of a volume.
+func encryptedDeviceName(volumeID string) string {
+	return "csi-loop-" + volumeID
+}
+
+// encryptedDevicePath returns the device of the dm-crypt mapping of a volume.
+func encryptedDevicePath(volumeID string) string {
+	return filepath.Join("/dev/mapper", encryptedDeviceName(volumeID))
+}
+
+// volumeDevice returns the device holding the filesystem of a volume: its dm-crypt mapping
+// if encrypted, its backing file otherwise.
+func volumeDevice(env *conf.Env, volume state.Volume) string {
+	if volume.Encrypted {
+		return encryptedDevicePath(volume.ID)
+	}
+	return env.RealPath(volume.BackingFile)
+}
+
+// formatEncryptedVolume formats the backing file of a new volume with LUKS, opens it as a
+// dm-crypt mapping and creates the filesystem of the volume on the mapping.
+// Without a passphrase, a random key is used that only ever exists in memory, so the data
+// cannot be recovered once the mapping is closed.
+func formatEncryptedVolume(ctx context.Context, env *conf.Env, volume state.Volume, passphrase []byte) error {
+	key := passphrase
+	if key == nil {
+		key = make([]byte, keySize)
+		rand.Read(key)
+		defer clear(key)
+	}
+
+	klog.Infof("Encrypting volume %s", volume.ID)
+	args := []string{"luksFormat", "--batch-mode", "--type", "luks2"}
+	// A random key does not need to be stretched, passphrases get the default PBKDF of cryptsetup
+	if passphrase == nil {
+		args = append(args, "--pbkdf", "pbkdf2", "--pbkdf-force-iterations", "1000")
+	}
+	args = append(args, "--key-file", "-", env.RealPath(volume.BackingFile))
+	if _, err := env.Runner.RunWithInput(ctx, key, "cryptsetup", args...); err != nil {
+		return fmt.Errorf("failed to format LUKS: %v", err)
+	}
+
+	if err := openEncryptedVolume(ctx, env, volume.BackingFile, volume.ID, key); err != nil {
+		return err
+	}
+	if err := formatDevice(ctx, env, volume.Filesystem, encryptedDevicePath(volume.ID)); err != nil {
+		closeEncryptedVolume(env, volume.ID)
+		return err
+	}
+	return nil
+}
+
+// openEncryptedVolume opens a LUKS backing file as the dm-crypt mapping of the given volume.
+// The key is handed to cryptsetup through its stdin and never appears in its arguments.
+//
+// Returns a PermissionDenied error if the key does not unlock the backing file.
+func openEncryptedVolume(ctx context.Context, env *conf.Env, backingFile, volumeID string, key []byte) error {
+	_, err := env.Runner.RunWithInput(ctx, key, "cryptsetup", "open", "--type", "luks2", "--key-file", "-",
+		env.RealPath(backingFile), encryptedDeviceName(volumeID))
+	var exit exitStatus
+	if errors.As(err, &exit) && exit.ExitCode() == cryptsetupWrongKey {
+		return status.Errorf(codes.PermissionDenied, "wrong %s for volume %s", passphraseSecret, volumeID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open LUKS: %v", err)
+	}
+	return nil
+}
+
+// closeEncryptedVolume closes the dm-crypt mapping of a volume, discarding its key.
+// It cleans up after failed and canceled requests too, so it is bounded by its timeout only.
+func closeEncryptedVolume(env *conf.Env, volumeID string) error {
+	if _, err := env.Runner.Run(context.Background(), "cryptsetup", "close", encryptedDeviceName(volumeID)); err != nil {
+		return fmt.Errorf("failed to close LUKS: %v", err)
+	}
+	return nil
+}
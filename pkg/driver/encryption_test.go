@@ -0,0 +1,339 @@
+// Encrypted volume tests.
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/command"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// exitError is the error of a command that exited with the given status.
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitError) ExitCode() int { return int(e) }
+
+// mockCryptsetup records the commands run and the keys handed to cryptsetup over stdin.
+// Opening a backing file fails like cryptsetup unless the key is the one it was formatted with.
+func mockCryptsetup(env *conf.Env) (commands, keys *[]string) {
+	commands, keys = &[]string{}, &[]string{}
+	formatted := map[string]string{}
+	env.Runner = &command.Fake{Script: func(input []byte, name string, args ...string) (string, error) {
+		*commands = append(*commands, fmt.Sprint(append([]string{name}, args...)))
+		if input == nil {
+			if name == "truncate" {
+				return "", afero.WriteFile(env.FS, args[2], nil, 0644)
+			}
+			return "", nil
+		}
+		*keys = append(*keys, string(input))
+		switch args[0] {
+		case "luksFormat":
+			formatted[args[len(args)-1]] = string(input)
+		case "open":
+			if formatted[args[len(args)-2]] != string(input) {
+				return "", exitError(cryptsetupWrongKey)
+			}
+		}
+		return "", nil
+	}}
+	return commands, keys
+}
+
+func TestEncryptedVolume(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		volumeContext   map[string]string
+		secrets         map[string]string
+		want            bool
+		wantPassphrase  string
+		wantErrContains string
+	}{
+		{
+			name:          "does not encrypt by default",
+			volumeContext: map[string]string{},
+			secrets:       map[string]string{passphraseSecret: "hunter2"},
+		},
+		{
+			name:          "encrypts with throwaway key",
+			volumeContext: map[string]string{encryptedParameter: "true", retainPolicyParameter: "delete", archiveOnDeleteParameter: "false"},
+			want:          true,
+		},
+		{
+			name:           "encrypts with passphrase secret",
+			volumeContext:  map[string]string{encryptedParameter: "true"},
+			secrets:        map[string]string{passphraseSecret: "hunter2"},
+			want:           true,
+			wantPassphrase: "hunter2",
+		},
+		{
+			name:            "fails on invalid attribute",
+			volumeContext:   map[string]string{encryptedParameter: "yes please"},
+			wantErrContains: `invalid encrypted "yes please"`,
+		},
+		{
+			name:            "fails to keep volumes with throwaway key",
+			volumeContext:   map[string]string{encryptedParameter: "true", retainPolicyParameter: "keep"},
+			wantErrContains: "retainPolicy keep requires the passphrase secret for encrypted volumes",
+		},
+		{
+			name:           "keeps volumes with passphrase secret",
+			volumeContext:  map[string]string{encryptedParameter: "true", retainPolicyParameter: "keep"},
+			secrets:        map[string]string{passphraseSecret: "hunter2"},
+			want:           true,
+			wantPassphrase: "hunter2",
+		},
+		{
+			name:            "fails with caches",
+			volumeContext:   map[string]string{encryptedParameter: "true", cacheKeyParameter: "go-mod"},
+			secrets:         map[string]string{passphraseSecret: "hunter2"},
+			wantErrContains: "cacheKey cannot be combined with encrypted volumes",
+		},
+		{
+			name:            "fails with archives",
+			volumeContext:   map[string]string{encryptedParameter: "true", archiveOnDeleteParameter: "true"},
+			wantErrContains: "archiveOnDelete cannot be combined with encrypted volumes",
+		},
+		{
+			name:            "fails with images",
+			volumeContext:   map[string]string{encryptedParameter: "true", sourceImageParameter: "models/bert"},
+			wantErrContains: "sourceImage cannot be combined with encrypted volumes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			encrypted, passphrase, err := encryptedVolume(tt.volumeContext, tt.secrets)
+
+			if tt.wantErrContains != "" {
+				require.Error(t, err)
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, encrypted)
+			assert.Equal(t, tt.wantPassphrase, string(passphrase))
+		})
+	}
+}
+
+func TestNodeServer_EncryptedVolume(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	commands, keys := mockCryptsetup(env)
+	mockStatfs(env, 1<<40, 1<<40)
+
+	cfg := config.Default()
+	cfg.Archive.Enabled = true
+	ns := NewNodeServer(env, cfg, newTestState(t, env), nil)
+
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "csi-1",
+		TargetPath:       "/mnt/scratch",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{"size": "200Mi", encryptedParameter: "true"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"[truncate -s 209715200 /var/lib/csi-loop/csi-1.img]",
+		"[cryptsetup luksFormat --batch-mode --type luks2 --pbkdf pbkdf2 --pbkdf-force-iterations 1000 --key-file - /var/lib/csi-loop/csi-1.img]",
+		"[cryptsetup open --type luks2 --key-file - /var/lib/csi-loop/csi-1.img csi-loop-csi-1]",
+		"[mkfs.btrfs /dev/mapper/csi-loop-csi-1]",
+		"[mount -o nosuid,nodev /dev/mapper/csi-loop-csi-1 /mnt/scratch]",
+	}, *commands)
+
+	// Both cryptsetup calls got the same random key over stdin
+	require.Len(t, *keys, 2)
+	assert.Len(t, (*keys)[0], keySize)
+	assert.Equal(t, (*keys)[0], (*keys)[1])
+
+	volume, ok := ns.State.GetVolume("csi-1")
+	require.True(t, ok)
+	assert.True(t, volume.Encrypted)
+	assert.False(t, volume.Archive, "encrypted volumes should not be archived")
+
+	// The mapping is closed before the backing file is removed
+	*commands = nil
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-1", TargetPath: "/mnt/scratch"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"[umount /mnt/scratch]",
+		"[cryptsetup close csi-loop-csi-1]",
+	}, *commands)
+	exists, _ := afero.Exists(env.FS, volume.BackingFile)
+	assert.False(t, exists, "backing file should be removed")
+	_, ok = ns.State.GetVolume("csi-1")
+	assert.False(t, ok)
+}
+
+func TestNodeServer_RetainedEncryptedVolume(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	commands, keys := mockCryptsetup(env)
+	mockStatfs(env, 1<<40, 1<<40)
+
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+	targetPath := func(podUID string) string {
+		return fmt.Sprintf("/var/lib/kubelet/pods/%s/volumes/kubernetes.io~csi/data/mount", podUID)
+	}
+	publish := func(volumeID, podUID, passphrase string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       targetPath(podUID),
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeContext: map[string]string{
+				"size":                "200Mi",
+				encryptedParameter:    "true",
+				retainPolicyParameter: "keep",
+				podNamespaceKey:       "team-a",
+				podNameKey:            "db-0",
+				podUIDKey:             podUID,
+			},
+			Secrets: map[string]string{passphraseSecret: passphrase},
+		})
+		return err
+	}
+
+	// The volume is formatted with the passphrase, stretched by the default PBKDF
+	require.NoError(t, publish("csi-1", "uid-1", "hunter2"))
+	assert.Contains(t, *commands, "[cryptsetup luksFormat --batch-mode --type luks2 --key-file - /var/lib/csi-loop/csi-1.img]")
+	assert.Equal(t, []string{"hunter2", "hunter2"}, *keys)
+	for _, command := range *commands {
+		assert.NotContains(t, command, "hunter2", "the passphrase must not be passed as an argument")
+	}
+
+	// The retained volume is locked
+	*commands = nil
+	_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-1", TargetPath: targetPath("uid-1")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"[umount " + targetPath("uid-1") + "]", "[cryptsetup close csi-loop-csi-1]"}, *commands)
+
+	// A wrong passphrase is denied and leaves the volume retained
+	err = publish("csi-2", "uid-2", "hunter3")
+	require.Error(t, err)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Contains(t, err.Error(), "wrong passphrase for volume csi-2")
+	assert.NotContains(t, err.Error(), "hunter")
+	retained, ok := ns.State.GetVolume("csi-1")
+	require.True(t, ok)
+	assert.NotNil(t, retained.ReleasedAt)
+
+	// The next pod with the same passphrase gets the volume unlocked under its new ID
+	*commands = nil
+	require.NoError(t, publish("csi-2", "uid-2", "hunter2"))
+	assert.Equal(t, []string{
+		"[cryptsetup open --type luks2 --key-file - /var/lib/csi-loop/csi-1.img csi-loop-csi-2]",
+		"[btrfs check /dev/mapper/csi-loop-csi-2]",
+		"[mount -o nosuid,nodev /dev/mapper/csi-loop-csi-2 " + targetPath("uid-2") + "]",
+	}, *commands)
+	volume, ok := ns.State.GetVolume("csi-2")
+	require.True(t, ok)
+	assert.True(t, volume.Encrypted)
+}
+
+func TestNodeServer_EncryptedPersistentVolume(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	commands, keys := mockCryptsetup(env)
+	mockStatfs(env, 1<<40, 1<<40)
+
+	store := newTestState(t, env)
+	cs := NewControllerServer(env, config.Default(), store)
+	ns := NewNodeServer(env, config.Default(), store, nil)
+
+	// The controller leaves the volume unformatted, it never sees the passphrase
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 200 << 20},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         map[string]string{encryptedParameter: "true"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"[truncate -s 209715200 /var/lib/csi-loop/pvc-1.img]"}, *commands)
+	volume, _ := store.GetVolume("pvc-1")
+	assert.True(t, volume.Unformatted)
+
+	publish := func(targetPath string, secrets map[string]string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         "pvc-1",
+			TargetPath:       targetPath,
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER),
+			Secrets:          secrets,
+		})
+		return err
+	}
+	unpublish := func(targetPath string) {
+		_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: targetPath})
+		require.NoError(t, err)
+	}
+	secrets := map[string]string{passphraseSecret: "correct horse battery staple"}
+
+	// Publishing requires the passphrase secret
+	err = publish("/mnt/a", nil)
+	require.Error(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), "set nodePublishSecretRef")
+
+	// The first publish formats the volume with the passphrase
+	*commands, *keys = nil, nil
+	require.NoError(t, publish("/mnt/a", secrets))
+	assert.Equal(t, []string{
+		"[cryptsetup luksFormat --batch-mode --type luks2 --key-file - /var/lib/csi-loop/pvc-1.img]",
+		"[cryptsetup open --type luks2 --key-file - /var/lib/csi-loop/pvc-1.img csi-loop-pvc-1]",
+		"[mkfs.btrfs /dev/mapper/csi-loop-pvc-1]",
+		"[mount -o nosuid,nodev /dev/mapper/csi-loop-pvc-1 /mnt/a]",
+	}, *commands)
+	assert.Len(t, *keys, 2)
+	volume, _ = store.GetVolume("pvc-1")
+	assert.False(t, volume.Unformatted)
+
+	// Further publishes share the mapping, the last unpublish locks the volume
+	*commands = nil
+	require.NoError(t, publish("/mnt/b", secrets))
+	unpublish("/mnt/a")
+	unpublish("/mnt/b")
+	assert.Equal(t, []string{
+		"[mount --bind /mnt/a /mnt/b]",
+		"[mount -o remount,bind,rw,nosuid,nodev /mnt/b]",
+		"[umount /mnt/a]",
+		"[umount /mnt/b]",
+		"[cryptsetup close csi-loop-pvc-1]",
+	}, *commands)
+
+	// A wrong passphrase is denied, the right one unlocks the volume without formatting it
+	err = publish("/mnt/a", map[string]string{passphraseSecret: "Tr0ub4dor&3"})
+	require.Error(t, err)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	*commands = nil
+	require.NoError(t, publish("/mnt/a", secrets))
+	assert.Equal(t, []string{
+		"[cryptsetup open --type luks2 --key-file - /var/lib/csi-loop/pvc-1.img csi-loop-pvc-1]",
+		"[mount -o nosuid,nodev /dev/mapper/csi-loop-pvc-1 /mnt/a]",
+	}, *commands)
+	for _, command := range *commands {
+		assert.NotContains(t, command, "horse", "the passphrase must not be passed as an argument")
+	}
+	unpublish("/mnt/a")
+}
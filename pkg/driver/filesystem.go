@@ -0,0 +1,108 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"k8s.io/klog/v2"
+)
+
+// volumeFilesystem returns the filesystem a new volume is formatted with:
+// the fsType of the volume capability if given, the pool default otherwise.
+func volumeFilesystem(pool config.Pool, capability *csi.VolumeCapability) (string, error) {
+	fsType := capability.GetMount().GetFsType()
+	if fsType == "" {
+		return pool.Filesystem, nil
+	}
+	if !slices.Contains(config.Filesystems, fsType) {
+		return "", fmt.Errorf("filesystem %s is not supported, use one of %v", fsType, config.Filesystems)
+	}
+	return fsType, nil
+}
+
+// formatBackingFile formats a backing file with the given filesystem.
+func formatBackingFile(ctx context.Context, env *conf.Env, fsType, backingFile string) error {
+	return formatDevice(ctx, env, fsType, env.RealPath(backingFile))
+}
+
+// formatDevice formats a file or block device with the given filesystem.
+func formatDevice(ctx context.Context, env *conf.Env, fsType, device string) error {
+	klog.Infof("Formatting with mkfs.%s", fsType)
+
+	var args []string
+	if fsType == "ext4" {
+		// mkfs.ext4 asks for confirmation on regular files
+		args = append(args, "-F")
+	}
+	args = append(args, device)
+
+	if _, err := env.Runner.Run(ctx, "mkfs."+fsType, args...); err != nil {
+		return fmt.Errorf("failed to format: %v", err)
+	}
+	return nil
+}
+
+// e2fsckUncorrected is the lowest exit status of e2fsck for errors it left uncorrected or failures
+// of its own. Statuses below it report that errors were corrected, the filesystem is consistent.
+const e2fsckUncorrected = 4
+
+// e2fsck checks and repairs the ext4 filesystem of an unmounted device.
+// Repaired filesystems pass, only errors left uncorrected fail.
+func e2fsck(ctx context.Context, env *conf.Env, device string) error {
+	_, err := env.Runner.Run(ctx, "e2fsck", "-f", "-p", device)
+	var exit exitStatus
+	if errors.As(err, &exit) && exit.ExitCode() < e2fsckUncorrected {
+		klog.Infof("Corrected filesystem errors on %s (e2fsck exit status %d)", device, exit.ExitCode())
+		return nil
+	}
+	return err
+}
+
+// growsOffline reports whether a filesystem is grown through its backing file before mounting,
+// rather than through its mount point.
+func growsOffline(fsType string) bool {
+	return fsType == "ext4"
+}
+
+// growFilesystem grows a filesystem to the size of its device, see volumeDevice.
+// ext4 is grown offline through the unmounted device, btrfs and xfs online
+// through the target path they are mounted at.
+func growFilesystem(ctx context.Context, env *conf.Env, fsType, device, targetPath string) error {
+	var err error
+	switch fsType {
+	case "ext4":
+		if err = e2fsck(ctx, env, device); err == nil {
+			_, err = env.Runner.Run(ctx, "resize2fs", device)
+		}
+	case "xfs":
+		_, err = env.Runner.Run(ctx, "xfs_growfs", env.RealPath(targetPath))
+	default:
+		_, err = env.Runner.Run(ctx, "btrfs", "filesystem", "resize", "max", env.RealPath(targetPath))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resize filesystem: %v", err)
+	}
+	return nil
+}
+
+// checkFilesystem checks and repairs the filesystem of an unmounted device, see volumeDevice.
+func checkFilesystem(ctx context.Context, env *conf.Env, fsType, device string) error {
+	var err error
+	switch fsType {
+	case "ext4":
+		err = e2fsck(ctx, env, device)
+	case "xfs":
+		_, err = env.Runner.Run(ctx, "xfs_repair", device)
+	default:
+		_, err = env.Runner.Run(ctx, "btrfs", "check", device)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check filesystem: %v", err)
+	}
+	return nil
+}
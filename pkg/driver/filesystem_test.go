@@ -0,0 +1,84 @@
+// Filesystem formatting, growing and checking tests.
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFilesystem_E2fsck(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr string
+	}{
+		{
+			name: "passes clean filesystems",
+		},
+		{
+			name: "passes corrected errors",
+			err:  exitError(1),
+		},
+		{
+			name: "passes corrected errors requiring a reboot",
+			err:  exitError(2),
+		},
+		{
+			name:    "fails on uncorrected errors",
+			err:     exitError(4),
+			wantErr: "failed to check filesystem: exit status 4",
+		},
+		{
+			name:    "fails on operational errors",
+			err:     exitError(8),
+			wantErr: "failed to check filesystem: exit status 8",
+		},
+		{
+			name:    "fails if e2fsck does not run",
+			err:     fmt.Errorf("executable file not found"),
+			wantErr: "failed to check filesystem: executable file not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			mockCommands(env, func(name string, args ...string) error {
+				return tt.err
+			})
+
+			err := checkFilesystem(context.Background(), env, "ext4", "/dev/loop0")
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestGrowFilesystem_CorrectedErrors(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		if name == "e2fsck" {
+			return exitError(1)
+		}
+		return nil
+	})
+
+	// Growing goes on once e2fsck corrected the filesystem
+	assert.NoError(t, growFilesystem(context.Background(), env, "ext4", "/dev/loop0", "/mnt/a"))
+	assert.Equal(t, []string{"[e2fsck -f -p /dev/loop0]", "[resize2fs /dev/loop0]"}, commands)
+}
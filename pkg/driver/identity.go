@@ -1,4 +1,4 @@
-// Package driver implements the CSI Identity and Node services for the loop volume driver.
+// Package driver implements the CSI Identity, Node and Controller services for the loop volume driver.
 // It provides ephemeral node-local volumes backed by btrfs-formatted loop devices.
 package driver
 
@@ -14,6 +14,12 @@ import (
 type IdentityServer struct {
 }
 
+// NewIdentityServer returns the identity service.
+// It does not depend on the environment, the plugin metadata is the same on every node.
+func NewIdentityServer() *IdentityServer {
+	return &IdentityServer{}
+}
+
 // GetPluginInfo returns metadata about the plugin.
 // It provides the plugin name and version for CSI driver registration.
 func (ids *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
@@ -25,11 +31,27 @@ func (ids *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPlugin
 }
 
 // GetPluginCapabilities returns the capabilities of the plugin.
-// Returns an empty list since ephemeral inline volumes require no special capabilities.
+// The controller service is advertised for capacity reporting, and volumes are
+// constrained to the topology of the node they are created on.
 func (ids *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	klog.V(5).Infof("GetPluginCapabilities called")
 	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{},
+		Capabilities: []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+					},
+				},
+			},
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+					},
+				},
+			},
+		},
 	}, nil
 }
 
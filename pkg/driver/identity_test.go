@@ -11,7 +11,9 @@ import (
 )
 
 func TestIdentityServer_GetPluginInfo(t *testing.T) {
-	ids := &IdentityServer{}
+	t.Parallel()
+
+	ids := NewIdentityServer()
 
 	resp, err := ids.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
 
@@ -21,16 +23,28 @@ func TestIdentityServer_GetPluginInfo(t *testing.T) {
 }
 
 func TestIdentityServer_GetPluginCapabilities(t *testing.T) {
-	ids := &IdentityServer{}
+	t.Parallel()
+
+	ids := NewIdentityServer()
 
 	resp, err := ids.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
 
 	require.NoError(t, err)
-	assert.Empty(t, resp.Capabilities, "ephemeral-only driver should have no plugin capabilities")
+
+	var services []csi.PluginCapability_Service_Type
+	for _, capability := range resp.Capabilities {
+		services = append(services, capability.GetService().GetType())
+	}
+	assert.ElementsMatch(t, []csi.PluginCapability_Service_Type{
+		csi.PluginCapability_Service_CONTROLLER_SERVICE,
+		csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+	}, services)
 }
 
 func TestIdentityServer_Probe(t *testing.T) {
-	ids := &IdentityServer{}
+	t.Parallel()
+
+	ids := NewIdentityServer()
 
 	resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
 
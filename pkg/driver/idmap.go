@@ -0,0 +1,159 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// idMapParameter is the volume attribute mapping the IDs of an inline volume, as
+// containerID:hostID:length for both users and groups, if kubelet does not record one.
+const idMapParameter = "idMap"
+
+// usernsFile is the file in the pod directory kubelet records the user namespace of a pod with
+// hostUsers false in.
+const usernsFile = "userns"
+
+// idMapMinKernel is the first kernel release supporting ID-mapped mounts per filesystem.
+var idMapMinKernel = map[string][2]int{
+	"btrfs": {5, 15},
+	"ext4":  {5, 12},
+	"xfs":   {5, 12},
+}
+
+// idMapping maps a range of IDs inside a user namespace to IDs on the host.
+type idMapping struct {
+	ContainerID uint32 `json:"containerId"`
+	HostID      uint32 `json:"hostId"`
+	Length      uint32 `json:"length"`
+}
+
+// userNamespace holds the ID mappings of a user namespace, as kubelet records them.
+type userNamespace struct {
+	UIDMappings []idMapping `json:"uidMappings"`
+	GIDMappings []idMapping `json:"gidMappings"`
+}
+
+// mountOption returns the X-mount.idmap option creating an ID-mapped mount with the mappings
+// of the user namespace, so files owned by an ID on disk appear owned by the same ID inside it.
+func (u userNamespace) mountOption() string {
+	var mappings []string
+	for _, m := range u.UIDMappings {
+		mappings = append(mappings, fmt.Sprintf("u:%d:%d:%d", m.ContainerID, m.HostID, m.Length))
+	}
+	for _, m := range u.GIDMappings {
+		mappings = append(mappings, fmt.Sprintf("g:%d:%d:%d", m.ContainerID, m.HostID, m.Length))
+	}
+	return "X-mount.idmap=" + strings.Join(mappings, " ")
+}
+
+// parseIDMap parses the idMap attribute, mapping both users and groups.
+//
+// Returns an InvalidArgument error if it is not three numbers with a positive length.
+func parseIDMap(value string) (userNamespace, error) {
+	invalid := status.Errorf(codes.InvalidArgument, "invalid %s %q: must be containerID:hostID:length", idMapParameter, value)
+	fields := strings.Split(value, ":")
+	if len(fields) != 3 {
+		return userNamespace{}, invalid
+	}
+	var ids [3]uint32
+	for i, field := range fields {
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return userNamespace{}, invalid
+		}
+		ids[i] = uint32(id)
+	}
+	if ids[2] == 0 {
+		return userNamespace{}, invalid
+	}
+	mapping := []idMapping{{ContainerID: ids[0], HostID: ids[1], Length: ids[2]}}
+	return userNamespace{UIDMappings: mapping, GIDMappings: mapping}, nil
+}
+
+// podUserNamespace returns the user namespace kubelet recorded for the pod owning a target path,
+// found in the pod directory containing it. Kubelet records it once the pod sandbox is created,
+// so it is usually missing on the first publish of a pod.
+func podUserNamespace(env *conf.Env, targetPath, podUID string) (userNamespace, bool, error) {
+	podDir, _, ok := strings.Cut(targetPath, "/pods/"+podUID+"/")
+	if podUID == "" || !ok {
+		return userNamespace{}, false, nil
+	}
+	data, err := afero.ReadFile(env.FS, filepath.Join(podDir, "pods", podUID, usernsFile))
+	if os.IsNotExist(err) {
+		return userNamespace{}, false, nil
+	}
+	if err != nil {
+		return userNamespace{}, false, err
+	}
+	var userns userNamespace
+	if err := json.Unmarshal(data, &userns); err != nil {
+		return userNamespace{}, false, fmt.Errorf("invalid %s of pod %s: %v", usernsFile, podUID, err)
+	}
+	return userns, len(userns.UIDMappings) > 0 || len(userns.GIDMappings) > 0, nil
+}
+
+// volumeIDMap returns the X-mount.idmap option of a volume mounted at the target path, from the
+// user namespace kubelet recorded for the pod or the idMap attribute, or "" without either.
+//
+// Returns an InvalidArgument error if the attribute is invalid, or an Internal error if the
+// recorded user namespace cannot be read.
+func volumeIDMap(env *conf.Env, volumeContext map[string]string, targetPath string) (string, error) {
+	userns, ok, err := podUserNamespace(env, targetPath, volumeContext[podUIDKey])
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if ok {
+		return userns.mountOption(), nil
+	}
+	if value := volumeContext[idMapParameter]; value != "" {
+		userns, err := parseIDMap(value)
+		if err != nil {
+			return "", err
+		}
+		return userns.mountOption(), nil
+	}
+	return "", nil
+}
+
+// supportedIDMap returns the ID mapping option if the running kernel supports ID-mapped mounts
+// of the filesystem, or "" with a warning so the volume is mounted without it.
+func supportedIDMap(env *conf.Env, idMap, fsType, volumeID string) string {
+	if idMap == "" {
+		return ""
+	}
+	if err := idMapSupported(env, fsType); err != nil {
+		klog.Warningf("Mounting volume %s without ID mapping, files appear owned by their IDs on disk: %v", volumeID, err)
+		return ""
+	}
+	return idMap
+}
+
+// idMapSupported checks that the running kernel supports ID-mapped mounts of the filesystem.
+func idMapSupported(env *conf.Env, fsType string) error {
+	minimum, ok := idMapMinKernel[fsType]
+	if !ok {
+		return fmt.Errorf("ID-mapped mounts of %s are not supported", fsType)
+	}
+	release, err := env.KernelRelease()
+	if err != nil {
+		return fmt.Errorf("failed to detect kernel: %v", err)
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(release, "%d.%d", &major, &minor); err != nil {
+		return fmt.Errorf("failed to parse kernel release %q: %v", release, err)
+	}
+	if major < minimum[0] || major == minimum[0] && minor < minimum[1] {
+		return fmt.Errorf("kernel %s is older than %d.%d, which first supports ID-mapped mounts of %s", release, minimum[0], minimum[1], fsType)
+	}
+	return nil
+}
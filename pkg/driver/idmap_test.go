@@ -0,0 +1,203 @@
+// ID-mapped mounts tests.
+package driver
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mockKernelRelease makes env report the given kernel release.
+func mockKernelRelease(env *conf.Env, release string) {
+	env.KernelRelease = func() (string, error) {
+		return release, nil
+	}
+}
+
+func TestParseIDMap(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "maps users and groups",
+			value: "0:65536:65536",
+			want:  "X-mount.idmap=u:0:65536:65536 g:0:65536:65536",
+		},
+		{
+			name:    "fails on missing length",
+			value:   "0:65536",
+			wantErr: true,
+		},
+		{
+			name:    "fails on zero length",
+			value:   "0:65536:0",
+			wantErr: true,
+		},
+		{
+			name:    "fails on negative id",
+			value:   "0:-1:65536",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseIDMap(tt.value)
+			if tt.wantErr {
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.mountOption())
+		})
+	}
+}
+
+func TestVolumeIDMap(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	const podDir = "/var/lib/kubelet/pods/uid-1"
+	target := podDir + "/volumes/kubernetes.io~csi/data/mount"
+
+	// Without a recorded user namespace, the attribute maps the volume
+	got, err := volumeIDMap(env, map[string]string{podUIDKey: "uid-1", idMapParameter: "0:1000:1"}, target)
+	require.NoError(t, err)
+	assert.Equal(t, "X-mount.idmap=u:0:1000:1 g:0:1000:1", got)
+
+	got, err = volumeIDMap(env, map[string]string{podUIDKey: "uid-1"}, target)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// The user namespace kubelet recorded for the pod takes precedence
+	userns := `{"uidMappings": [{"hostId": 131072, "containerId": 0, "length": 65536}], "gidMappings": [{"hostId": 196608, "containerId": 0, "length": 65536}]}`
+	require.NoError(t, afero.WriteFile(env.FS, podDir+"/userns", []byte(userns), 0644))
+	got, err = volumeIDMap(env, map[string]string{podUIDKey: "uid-1", idMapParameter: "0:1000:1"}, target)
+	require.NoError(t, err)
+	assert.Equal(t, "X-mount.idmap=u:0:131072:65536 g:0:196608:65536", got)
+
+	require.NoError(t, afero.WriteFile(env.FS, podDir+"/userns", []byte("{"), 0644))
+	_, err = volumeIDMap(env, map[string]string{podUIDKey: "uid-1"}, target)
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestIDMapSupported(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		release string
+		fsType  string
+		wantErr string
+	}{
+		{
+			name:    "supports btrfs since 5.15",
+			release: "5.15.0-91-generic",
+			fsType:  "btrfs",
+		},
+		{
+			name:    "supports ext4 since 5.12",
+			release: "5.12.1",
+			fsType:  "ext4",
+		},
+		{
+			name:    "rejects older kernels",
+			release: "5.14.21",
+			fsType:  "btrfs",
+			wantErr: "kernel 5.14.21 is older than 5.15",
+		},
+		{
+			name:    "rejects unknown releases",
+			release: "unknown",
+			fsType:  "xfs",
+			wantErr: "failed to parse kernel release",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			mockKernelRelease(env, tt.release)
+
+			err := idMapSupported(env, tt.fsType)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestNodeServer_IDMappedVolume(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		return nil
+	})
+	mockStatfs(env, 1<<40, 1<<40)
+	writeArchive(t, env, "/var/lib/csi-loop-sources/dataset.tar", []tarEntry{{name: "train.csv", typeflag: tar.TypeReg, content: "1,2\n"}})
+
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+	publish := func(volumeID string, volumeContext map[string]string) error {
+		volumeContext["size"] = "200Mi"
+		volumeContext[idMapParameter] = "0:65536:65536"
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       "/mnt/" + volumeID,
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeContext:    volumeContext,
+		})
+		return err
+	}
+	const idMap = "X-mount.idmap=u:0:65536:65536 g:0:65536:65536"
+
+	// The filesystem created by mkfs is owned by root on disk and inside the pod
+	mockKernelRelease(env, "6.8.0")
+	require.NoError(t, publish("csi-1", map[string]string{}))
+	assert.Contains(t, commands, "[mount -o loop,nosuid,nodev,"+idMap+" /var/lib/csi-loop/csi-1.img /mnt/csi-1]")
+	volume, _ := ns.State.GetVolume("csi-1")
+	assert.Equal(t, idMap, volume.IDMap)
+
+	// Seeding writes as host root, so the volume is only ID-mapped once seeded
+	commands = nil
+	require.NoError(t, publish("csi-2", map[string]string{sourceParameter: "dataset.tar"}))
+	assert.Equal(t, []string{
+		"[truncate -s 209715200 /var/lib/csi-loop/csi-2.img]",
+		"[mkfs.btrfs /var/lib/csi-loop/csi-2.img]",
+		"[mount -o loop,nosuid,nodev /var/lib/csi-loop/csi-2.img /mnt/csi-2]",
+		"[umount /mnt/csi-2]",
+		"[mount -o loop,nosuid,nodev," + idMap + " /var/lib/csi-loop/csi-2.img /mnt/csi-2]",
+	}, commands)
+
+	// Kernels without ID-mapped mounts fall back to a plain mount
+	commands = nil
+	mockKernelRelease(env, "5.10.0")
+	require.NoError(t, publish("csi-3", map[string]string{}))
+	assert.Contains(t, commands, "[mount -o loop,nosuid,nodev /var/lib/csi-loop/csi-3.img /mnt/csi-3]")
+	volume, _ = ns.State.GetVolume("csi-3")
+	assert.Empty(t, volume.IDMap)
+}
@@ -0,0 +1,634 @@
+package driver
+
+import (
+	"archive/tar"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// sourceImageParameter is the volume attribute naming the OCI image a new inline volume is
+// seeded from, as repository[:tag] or repository@digest.
+const sourceImageParameter = "sourceImage"
+
+// Media types of image manifests and indexes, as served by OCI layouts and registries.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// refNameAnnotation tags the manifests in the index of an OCI layout.
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// Whiteout files of image layers, see the OCI image layer specification.
+const (
+	// whiteoutPrefix marks a file of a lower layer as removed.
+	whiteoutPrefix = ".wh."
+	// opaqueWhiteout marks a directory whose lower layer contents are removed.
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+	digestPattern     = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// registryTimeout bounds a request to the registry mirror, including downloading its body.
+const registryTimeout = 10 * time.Minute
+
+// registryHeaderTimeout bounds waiting for the response headers of the registry mirror,
+// so a stalled mirror fails fast instead of after registryTimeout.
+const registryHeaderTimeout = 30 * time.Second
+
+// registryClient requests manifests and blobs from the registry mirror.
+var registryClient = &http.Client{
+	Timeout:   registryTimeout,
+	Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, ResponseHeaderTimeout: registryHeaderTimeout},
+}
+
+// keyedMutex serializes work on the same key, without blocking work on other keys.
+// The zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// keyedLock is the lock of a key, removed once no one holds or waits for it.
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks key and returns the function unlocking it.
+func (m *keyedMutex) Lock(key string) (unlock func()) {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = map[string]*keyedLock{}
+	}
+	lock, ok := m.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		m.locks[key] = lock
+	}
+	lock.refs++
+	m.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		m.mu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// imageReference is a parsed sourceImage attribute.
+type imageReference struct {
+	repository string
+	tag        string
+	digest     string
+}
+
+// String returns the reference in its attribute form.
+func (r imageReference) String() string {
+	if r.digest != "" {
+		return r.repository + "@" + r.digest
+	}
+	return r.repository + ":" + r.tag
+}
+
+// descriptor points to a manifest or layer blob.
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+// manifest is an image manifest or, if it lists manifests, an image index.
+type manifest struct {
+	Manifests []descriptor `json:"manifests"`
+	Layers    []descriptor `json:"layers"`
+}
+
+// parseImageReference parses the sourceImage attribute. Images without tag or digest
+// default to the latest tag.
+func parseImageReference(value string) (imageReference, error) {
+	ref := imageReference{repository: value, tag: "latest"}
+	if i := strings.Index(value, "@"); i >= 0 {
+		ref.repository, ref.tag, ref.digest = value[:i], "", value[i+1:]
+		if !digestPattern.MatchString(ref.digest) {
+			return imageReference{}, status.Errorf(codes.InvalidArgument, "invalid %s %q: digest must be sha256", sourceImageParameter, value)
+		}
+	} else if i := strings.LastIndex(value, ":"); i > strings.LastIndex(value, "/") {
+		ref.repository, ref.tag = value[:i], value[i+1:]
+		if !tagPattern.MatchString(ref.tag) {
+			return imageReference{}, status.Errorf(codes.InvalidArgument, "invalid %s %q: invalid tag", sourceImageParameter, value)
+		}
+	}
+	if !repositoryPattern.MatchString(ref.repository) {
+		return imageReference{}, status.Errorf(codes.InvalidArgument, "invalid %s %q: invalid repository", sourceImageParameter, value)
+	}
+	return ref, nil
+}
+
+// imageSource reads the manifests and blobs of a repository, either from its OCI layout
+// in the image catalog or from the registry mirror.
+type imageSource struct {
+	// env is the environment holding the image catalog.
+	env *conf.Env
+	// layout is the directory of the OCI layout, empty for the registry mirror.
+	layout string
+	// mirror is the base URL of the registry mirror.
+	mirror     string
+	repository string
+}
+
+// newImageSource returns the source of a repository, preferring its layout in the image catalog.
+//
+// Returns a NotFound error if the repository has no layout and no registry mirror is configured.
+func newImageSource(env *conf.Env, cfg *config.Config, repository string) (imageSource, error) {
+	layout := filepath.Join(cfg.ImageCatalogPath(), repository)
+	if exists, _ := afero.Exists(env.FS, filepath.Join(layout, "index.json")); exists {
+		return imageSource{env: env, layout: layout, repository: repository}, nil
+	}
+	if cfg.RegistryMirror == "" {
+		return imageSource{}, status.Errorf(codes.NotFound, "image %s not found in %s", repository, cfg.ImageCatalogPath())
+	}
+	return imageSource{env: env, mirror: strings.TrimSuffix(cfg.RegistryMirror, "/"), repository: repository}, nil
+}
+
+// resolve returns the digest and layers of the image a reference points to.
+// Image indexes are resolved to the manifest of the platform of the node.
+func (s imageSource) resolve(ctx context.Context, ref imageReference) (string, []descriptor, error) {
+	for nested := false; ; nested = true {
+		data, err := s.manifest(ctx, ref)
+		if err != nil {
+			return "", nil, err
+		}
+		digest := digestOf(data)
+		if ref.digest != "" && ref.digest != digest {
+			return "", nil, status.Errorf(codes.DataLoss, "manifest of %s has digest %s", ref, digest)
+		}
+
+		var m manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return "", nil, status.Errorf(codes.InvalidArgument, "invalid manifest of %s: %v", ref, err)
+		}
+		if len(m.Manifests) == 0 {
+			return digest, m.Layers, nil
+		}
+		if nested {
+			return "", nil, status.Errorf(codes.InvalidArgument, "image index %s lists another index", ref)
+		}
+
+		found := false
+		for _, desc := range m.Manifests {
+			if desc.Platform == nil || (desc.Platform.OS == runtime.GOOS && desc.Platform.Architecture == runtime.GOARCH) {
+				ref, found = imageReference{repository: ref.repository, digest: desc.Digest}, true
+				break
+			}
+		}
+		if !found {
+			return "", nil, status.Errorf(codes.NotFound, "image %s has no manifest for %s/%s", ref, runtime.GOOS, runtime.GOARCH)
+		}
+	}
+}
+
+// manifest reads the manifest or index a reference points to.
+func (s imageSource) manifest(ctx context.Context, ref imageReference) ([]byte, error) {
+	if ref.digest != "" && !digestPattern.MatchString(ref.digest) {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported digest %q", ref.digest)
+	}
+
+	if s.mirror != "" {
+		resp, err := s.get(ctx, "manifests/"+cmp.Or(ref.digest, ref.tag), manifestMediaTypes)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return io.ReadAll(resp.Body)
+	}
+
+	digest := ref.digest
+	if digest == "" {
+		data, err := afero.ReadFile(s.env.FS, filepath.Join(s.layout, "index.json"))
+		if err != nil {
+			return nil, err
+		}
+		var index manifest
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid index of %s: %v", s.layout, err)
+		}
+		for _, desc := range index.Manifests {
+			if desc.Annotations[refNameAnnotation] == ref.tag && digestPattern.MatchString(desc.Digest) {
+				digest = desc.Digest
+				break
+			}
+		}
+		if digest == "" {
+			return nil, status.Errorf(codes.NotFound, "image %s not found in %s", ref, s.layout)
+		}
+	}
+	return afero.ReadFile(s.env.FS, s.blobPath(digest))
+}
+
+// blobPath returns the path of a blob in the OCI layout.
+func (s imageSource) blobPath(digest string) string {
+	algorithm, encoded, _ := strings.Cut(digest, ":")
+	return filepath.Join(s.layout, "blobs", algorithm, encoded)
+}
+
+// fetchBlob returns the path of a blob, downloading it into dir if it is pulled from the
+// registry mirror. Blobs already downloaded into dir are reused. The digest is not verified
+// here, but while unpacking.
+func (s imageSource) fetchBlob(ctx context.Context, desc descriptor, dir string) (string, error) {
+	if !digestPattern.MatchString(desc.Digest) {
+		return "", status.Errorf(codes.InvalidArgument, "unsupported digest %q", desc.Digest)
+	}
+	if s.mirror == "" {
+		return s.blobPath(desc.Digest), nil
+	}
+	path := filepath.Join(dir, strings.TrimPrefix(desc.Digest, "sha256:"))
+	if exists, _ := afero.Exists(s.env.FS, path); exists {
+		return path, nil
+	}
+
+	resp, err := s.get(ctx, "blobs/"+desc.Digest, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := writeFile(s.env, path, resp.Body, 0644); err != nil {
+		return "", status.Errorf(codes.Unavailable, "failed to download %s: %v", desc.Digest, err)
+	}
+	return path, nil
+}
+
+// get requests a path of the repository from the registry mirror, until ctx is done or the request times out.
+func (s imageSource) get(ctx context.Context, path string, accept []string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/v2/%s/%s", s.mirror, s.repository, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to reach registry mirror: %v", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, status.Errorf(codes.NotFound, "%s not found in registry mirror %s", strings.TrimPrefix(url, s.mirror+"/v2/"), s.mirror)
+	default:
+		resp.Body.Close()
+		return nil, status.Errorf(codes.Unavailable, "registry mirror returned %s for %s", resp.Status, url)
+	}
+}
+
+// digestOf returns the sha256 digest of data.
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// layerCompression returns the compression of a layer from its media type.
+func layerCompression(mediaType string) (string, error) {
+	switch {
+	case strings.HasSuffix(mediaType, "+gzip"), strings.HasSuffix(mediaType, ".tar.gzip"):
+		return "gzip", nil
+	case strings.HasSuffix(mediaType, "+zstd"):
+		return "zstd", nil
+	case strings.HasSuffix(mediaType, ".tar"):
+		return "", nil
+	default:
+		return "", fmt.Errorf("unsupported layer media type %s", mediaType)
+	}
+}
+
+// unpackImage applies the layers of an image in order to dir. Blobs pulled from the registry
+// mirror are downloaded into blobDir, which is removed afterwards.
+func unpackImage(ctx context.Context, env *conf.Env, source imageSource, layers []descriptor, dir, blobDir string, preserveOwnership bool) error {
+	defer env.FS.RemoveAll(blobDir)
+
+	for _, layer := range layers {
+		path, err := source.fetchBlob(ctx, layer, blobDir)
+		if err != nil {
+			return err
+		}
+		if err := unpackLayer(env, path, layer, dir, preserveOwnership); err != nil {
+			return fmt.Errorf("layer %s: %v", layer.Digest, err)
+		}
+		if source.mirror != "" {
+			env.FS.Remove(path)
+		}
+	}
+	return nil
+}
+
+// imageSize returns the space the layers of an image take unpacked: the files of all layers,
+// each rounded up to whole blocks plus a block for its inode and directory entry, and a tenth
+// on top for the metadata and journal of the filesystem. Files hidden by whiteouts of upper
+// layers are counted too. Blobs pulled from the registry mirror are downloaded into blobDir
+// and kept for unpacking.
+func imageSize(ctx context.Context, env *conf.Env, source imageSource, layers []descriptor, blobDir string) (int64, error) {
+	var size int64
+	for _, layer := range layers {
+		path, err := source.fetchBlob(ctx, layer, blobDir)
+		if err != nil {
+			return 0, err
+		}
+		compression, err := layerCompression(layer.MediaType)
+		if err != nil {
+			return 0, err
+		}
+		err = walkLayer(env, path, compression, nil, func(tr *tar.Reader, header *tar.Header) error {
+			size += roundUpToBlock(header.Size) + blockSize
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("layer %s: %v", layer.Digest, err)
+		}
+	}
+	return roundUpToBlock(size + size/10), nil
+}
+
+// unpackLayer applies a layer to dir in two passes over its blob. The first pass verifies
+// the digest of the blob and removes the files of lower layers hidden by whiteouts, the
+// second extracts the entries of the layer, so whiteouts never hide entries of their own layer.
+func unpackLayer(env *conf.Env, path string, layer descriptor, dir string, preserveOwnership bool) error {
+	compression, err := layerCompression(layer.MediaType)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	err = walkLayer(env, path, compression, hash, func(tr *tar.Reader, header *tar.Header) error {
+		if strings.HasPrefix(filepath.Base(header.Name), whiteoutPrefix) {
+			return applyWhiteout(env, dir, header.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); digest != layer.Digest {
+		return fmt.Errorf("blob has digest %s", digest)
+	}
+
+	return walkLayer(env, path, compression, nil, func(tr *tar.Reader, header *tar.Header) error {
+		if strings.HasPrefix(filepath.Base(header.Name), whiteoutPrefix) {
+			return nil
+		}
+		return extractEntry(env, tr, header, dir, preserveOwnership)
+	})
+}
+
+// walkLayer calls fn for each entry of a layer blob. If hash is set, the whole blob
+// is written to it.
+func walkLayer(env *conf.Env, path, compression string, hash io.Writer, fn func(*tar.Reader, *tar.Header) error) error {
+	file, err := env.FS.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var blob io.Reader = file
+	if hash != nil {
+		blob = io.TeeReader(file, hash)
+	}
+	reader, err := decompress(blob, compression)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(tr, header); err != nil {
+			return fmt.Errorf("%s: %v", header.Name, err)
+		}
+	}
+
+	// Compressed streams may end before the blob does
+	_, err = io.Copy(io.Discard, blob)
+	return err
+}
+
+// applyWhiteout removes the files of lower layers a whiteout entry hides.
+func applyWhiteout(env *conf.Env, dir, name string) error {
+	name = filepath.Clean(name)
+	parent, base := filepath.Dir(name), filepath.Base(name)
+	if err := checkNoSymlinks(env, dir, parent); err != nil {
+		return err
+	}
+
+	if base == opaqueWhiteout {
+		if !filepath.IsLocal(parent) && parent != "." {
+			return fmt.Errorf("path escapes the volume")
+		}
+		entries, err := afero.ReadDir(env.FS, filepath.Join(dir, parent))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := env.FS.RemoveAll(filepath.Join(dir, parent, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	target := filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))
+	if !filepath.IsLocal(target) || filepath.Dir(target) != parent {
+		return fmt.Errorf("path escapes the volume")
+	}
+	return env.FS.RemoveAll(filepath.Join(dir, target))
+}
+
+// createImageVolume creates a new volume as a copy of the template of its source image, which
+// is a copy-on-write clone on filesystems supporting reflinks. Templates are kept as caches of
+// the pool, one per image, filesystem and ownership, so they count towards the cache capacity
+// of the pool and the least recently used ones are evicted. Templates are as small as the
+// unpacked image allows and shared by volumes of every size, whose copies are grown. A missing
+// template is built first by formatting a new image, mounting it on a staging directory and
+// unpacking the layers of the image into it, after the limits of the volume are checked.
+//
+// Returns an OutOfRange error if the unpacked image does not fit into the volume.
+func (ns *NodeServer) createImageVolume(ctx context.Context, pool config.Pool, volume state.Volume, volumeContext map[string]string) (state.Volume, error) {
+	ref, err := parseImageReference(volumeContext[sourceImageParameter])
+	if err != nil {
+		return state.Volume{}, err
+	}
+	preserveOwnership, err := preserveOwnership(volumeContext)
+	if err != nil {
+		return state.Volume{}, err
+	}
+
+	// Volumes that do not fit are refused before the image is downloaded,
+	// allocating the volume checks the limits again
+	ns.Env.Allocation.Lock()
+	err = checkLimits(ns.Env, ns.Config, ns.State, pool, volume.Namespace, volume.Size)
+	ns.Env.Allocation.Unlock()
+	if err != nil {
+		return state.Volume{}, err
+	}
+
+	source, err := newImageSource(ns.Env, ns.Config, ref.repository)
+	if err != nil {
+		return state.Volume{}, err
+	}
+	digest, layers, err := source.resolve(ctx, ref)
+	if err != nil {
+		return state.Volume{}, err
+	}
+
+	// Templates are shared by volumes of every size, the copies are grown
+	fields := []string{pool.Name, volume.Filesystem}
+	if preserveOwnership {
+		fields = append(fields, "owners")
+	}
+	key := fmt.Sprintf("image@%s/%s", digest, strings.Join(fields, "-"))
+
+	// A template is built once and not replaced while copied
+	defer ns.templates.Lock(key)()
+
+	template, ok := ns.State.GetCache(key)
+	if !ok {
+		minSize, _ := sizeLimits(pool, volume.Filesystem)
+		template = state.Cache{
+			Key:         key,
+			Pool:        pool.Name,
+			Filesystem:  volume.Filesystem,
+			BackingFile: cacheFilePath(pool.Path, key),
+			Size:        minSize,
+		}
+		klog.Infof("Building template of image %s@%s", ref.repository, digest)
+		template, err = buildTemplate(ctx, ns.Env, template, source, layers, preserveOwnership, volume.Size)
+		if err != nil {
+			return state.Volume{}, err
+		}
+	} else if template.Size > volume.Size {
+		return state.Volume{}, status.Errorf(codes.OutOfRange, "image %s needs %s unpacked, requested %s", ref.repository, formatBytes(template.Size), formatBytes(volume.Size))
+	}
+	volume.SourceImage = ref.repository + "@" + digest
+	volume.ResizePending = template.Size < volume.Size
+	template.LastUsedAt = ns.Env.Now()
+	if err := ns.State.PutCache(template); err != nil {
+		ns.Env.FS.Remove(template.BackingFile)
+		return state.Volume{}, err
+	}
+
+	klog.Infof("Creating volume %s from template of image %s", volume.ID, volume.SourceImage)
+	if err := allocateVolumeFrom(ctx, ns.Env, ns.Config, ns.State, pool, volume, template.BackingFile); err != nil {
+		return state.Volume{}, err
+	}
+	evictCaches(ns.Env, ns.Config, ns.State, pool.Name)
+	return volume, nil
+}
+
+// buildTemplate creates, formats and mounts the image of a template and unpacks the layers
+// of an image into it. The template is grown from its minimum size to the size of the unpacked
+// image, see imageSize, and returned. On failure, nothing is left behind.
+//
+// Returns an OutOfRange error if the unpacked image needs more than maxSize.
+func buildTemplate(ctx context.Context, env *conf.Env, template state.Cache, source imageSource, layers []descriptor, preserveOwnership bool, maxSize int64) (state.Cache, error) {
+	base := strings.TrimSuffix(template.BackingFile, ".img")
+	staging, blobDir := base+".staging", base+".blobs"
+	cleanup := func() {
+		env.FS.Remove(template.BackingFile)
+		env.FS.RemoveAll(staging)
+		env.FS.RemoveAll(blobDir)
+	}
+
+	size, err := imageSize(ctx, env, source, layers, blobDir)
+	if err != nil {
+		cleanup()
+		if _, ok := status.FromError(err); !ok {
+			err = status.Errorf(codes.InvalidArgument, "failed to unpack image %s: %v", source.repository, err)
+		}
+		return state.Cache{}, err
+	}
+	template.Size = max(template.Size, size)
+	if template.Size > maxSize {
+		cleanup()
+		return state.Cache{}, status.Errorf(codes.OutOfRange, "image %s needs %s unpacked, requested %s", source.repository, formatBytes(template.Size), formatBytes(maxSize))
+	}
+
+	env.FS.MkdirAll(filepath.Dir(template.BackingFile), 0755)
+	if err := env.Loop.Truncate(env.RealPath(template.BackingFile), template.Size); err != nil {
+		cleanup()
+		return state.Cache{}, fmt.Errorf("failed to create template: %v", err)
+	}
+	if err := formatBackingFile(ctx, env, template.Filesystem, template.BackingFile); err != nil {
+		cleanup()
+		return state.Cache{}, err
+	}
+
+	env.FS.MkdirAll(staging, 0755)
+	if err := env.Mounter.Mount(env.RealPath(template.BackingFile), env.RealPath(staging), template.Filesystem, []string{"loop"}); err != nil {
+		cleanup()
+		return state.Cache{}, fmt.Errorf("failed to mount template: %v", err)
+	}
+
+	err = unpackImage(ctx, env, source, layers, staging, blobDir, preserveOwnership)
+	if umountErr := env.Mounter.Unmount(env.RealPath(staging)); err == nil && umountErr != nil {
+		err = fmt.Errorf("failed to unmount template: %v", umountErr)
+	}
+	if err != nil {
+		cleanup()
+		if _, ok := status.FromError(err); !ok {
+			err = status.Errorf(codes.InvalidArgument, "failed to unpack image %s: %v", source.repository, err)
+		}
+		return state.Cache{}, err
+	}
+
+	env.FS.RemoveAll(staging)
+	return template, nil
+}
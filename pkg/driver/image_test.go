@@ -0,0 +1,485 @@
+// Volume seeding from OCI images tests.
+package driver
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testLayers are the layers of the test image. The second layer replaces a file,
+// removes a file through a whiteout and empties a directory through an opaque whiteout.
+var testLayers = []struct {
+	mediaType   string
+	compression string
+	entries     []tarEntry
+}{
+	{
+		mediaType:   "application/vnd.oci.image.layer.v1.tar+gzip",
+		compression: "gzip",
+		entries: []tarEntry{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/config", typeflag: tar.TypeReg, content: "v1"},
+			{name: "etc/old", typeflag: tar.TypeReg, content: "old"},
+			{name: "data/", typeflag: tar.TypeDir},
+			{name: "data/a", typeflag: tar.TypeReg, content: "a"},
+		},
+	},
+	{
+		mediaType:   "application/vnd.oci.image.layer.v1.tar+zstd",
+		compression: "zstd",
+		entries: []tarEntry{
+			{name: "etc/config", typeflag: tar.TypeReg, content: "v2"},
+			{name: "etc/.wh.old", typeflag: tar.TypeReg},
+			{name: "data/b", typeflag: tar.TypeReg, content: "b"},
+			{name: "data/.wh..wh..opq", typeflag: tar.TypeReg},
+		},
+	},
+}
+
+// writeBlob writes a blob into an OCI layout and returns its descriptor.
+func writeBlob(t *testing.T, env *conf.Env, layout, mediaType string, data []byte) descriptor {
+	desc := descriptor{MediaType: mediaType, Digest: digestOf(data), Size: int64(len(data))}
+	require.NoError(t, afero.WriteFile(env.FS, imageSource{layout: layout}.blobPath(desc.Digest), data, 0644))
+	return desc
+}
+
+// writeJSONBlob writes a JSON document as a blob into an OCI layout and returns its descriptor.
+func writeJSONBlob(t *testing.T, env *conf.Env, layout, mediaType string, v any) descriptor {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return writeBlob(t, env, layout, mediaType, data)
+}
+
+// writeLayout writes an OCI layout holding the test image under the tag "v1" and an index
+// of it under the tag "multi", and returns the digest of the image manifest.
+func writeLayout(t *testing.T, env *conf.Env, layout string) string {
+	var layers []descriptor
+	for _, layer := range testLayers {
+		layers = append(layers, writeBlob(t, env, layout, layer.mediaType, tarArchive(t, layer.compression, layer.entries)))
+	}
+	config := writeJSONBlob(t, env, layout, "application/vnd.oci.image.config.v1+json", map[string]any{})
+	image := writeJSONBlob(t, env, layout, manifestMediaTypes[0], map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     manifestMediaTypes[0],
+		"config":        config,
+		"layers":        layers,
+	})
+
+	platform := func(os, arch string) map[string]any {
+		return map[string]any{"mediaType": image.MediaType, "digest": image.Digest, "size": image.Size, "platform": map[string]string{"os": os, "architecture": arch}}
+	}
+	index := writeJSONBlob(t, env, layout, manifestMediaTypes[1], map[string]any{
+		"schemaVersion": 2,
+		"manifests":     []any{platform("plan9", "mips"), platform(runtime.GOOS, runtime.GOARCH)},
+	})
+
+	image.Annotations = map[string]string{refNameAnnotation: "v1"}
+	index.Annotations = map[string]string{refNameAnnotation: "multi"}
+	data, err := json.Marshal(map[string]any{"schemaVersion": 2, "manifests": []descriptor{image, index}})
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(env.FS, filepath.Join(layout, "index.json"), data, 0644))
+	return image.Digest
+}
+
+// registryMirror starts a registry serving the OCI layouts in the given catalog.
+func registryMirror(t *testing.T, env *conf.Env, catalog string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v2/")
+		var data []byte
+		var err error
+		if repository, reference, ok := strings.Cut(path, "/manifests/"); ok {
+			source := imageSource{env: env, layout: filepath.Join(catalog, repository), repository: repository}
+			ref := imageReference{repository: repository, tag: reference}
+			if strings.HasPrefix(reference, "sha256:") {
+				ref = imageReference{repository: repository, digest: reference}
+			}
+			data, err = source.manifest(context.Background(), ref)
+		} else if repository, digest, ok := strings.Cut(path, "/blobs/"); ok {
+			data, err = afero.ReadFile(env.FS, imageSource{layout: filepath.Join(catalog, repository)}.blobPath(digest))
+		}
+		if data == nil || err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestParseImageReference(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	tests := []struct {
+		name            string
+		value           string
+		want            imageReference
+		wantErrContains string
+	}{
+		{
+			name:  "defaults to the latest tag",
+			value: "models/bert",
+			want:  imageReference{repository: "models/bert", tag: "latest"},
+		},
+		{
+			name:  "parses tag",
+			value: "models/bert:v1.2",
+			want:  imageReference{repository: "models/bert", tag: "v1.2"},
+		},
+		{
+			name:  "parses digest",
+			value: "models/bert@" + digest,
+			want:  imageReference{repository: "models/bert", digest: digest},
+		},
+		{
+			name:            "fails on invalid digest",
+			value:           "models/bert@md5:abc",
+			wantErrContains: "digest must be sha256",
+		},
+		{
+			name:            "fails on invalid tag",
+			value:           "models/bert:-v1",
+			wantErrContains: "invalid tag",
+		},
+		{
+			name:            "fails on repository outside the catalog",
+			value:           "../models/bert",
+			wantErrContains: "invalid repository",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ref, err := parseImageReference(tt.value)
+
+			if tt.wantErrContains != "" {
+				require.Error(t, err)
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, ref)
+		})
+	}
+}
+
+func TestImageSource_Resolve(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	digest := writeLayout(t, env, "/var/lib/csi-loop-images/models/bert")
+	mirror := registryMirror(t, env, "/var/lib/csi-loop-images")
+
+	tests := []struct {
+		name            string
+		config          *config.Config
+		value           string
+		wantCode        codes.Code
+		wantErrContains string
+	}{
+		{
+			name:   "resolves tag in the catalog",
+			config: config.Default(),
+			value:  "models/bert:v1",
+		},
+		{
+			name:   "resolves digest in the catalog",
+			config: config.Default(),
+			value:  "models/bert@" + digest,
+		},
+		{
+			name:   "resolves index to the platform of the node",
+			config: config.Default(),
+			value:  "models/bert:multi",
+		},
+		{
+			name:   "resolves tag in the registry mirror",
+			config: &config.Config{ImageCatalog: "/var/lib/other-images", RegistryMirror: mirror},
+			value:  "models/bert:multi",
+		},
+		{
+			name:            "fails on missing tag",
+			config:          config.Default(),
+			value:           "models/bert:v2",
+			wantCode:        codes.NotFound,
+			wantErrContains: "image models/bert:v2 not found in /var/lib/csi-loop-images/models/bert",
+		},
+		{
+			name:            "fails on missing repository without mirror",
+			config:          config.Default(),
+			value:           "models/gpt",
+			wantCode:        codes.NotFound,
+			wantErrContains: "image models/gpt not found in /var/lib/csi-loop-images",
+		},
+		{
+			name:            "fails on missing repository in the mirror",
+			config:          &config.Config{RegistryMirror: mirror},
+			value:           "models/gpt",
+			wantCode:        codes.NotFound,
+			wantErrContains: "models/gpt/manifests/latest not found in registry mirror",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := parseImageReference(tt.value)
+			require.NoError(t, err)
+
+			source, err := newImageSource(env, tt.config, ref.repository)
+			var got string
+			var layers []descriptor
+			if err == nil {
+				got, layers, err = source.resolve(context.Background(), ref)
+			}
+
+			if tt.wantErrContains != "" {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, digest, got)
+			assert.Len(t, layers, len(testLayers))
+		})
+	}
+}
+
+func TestImageSource_Canceled(t *testing.T) {
+	t.Parallel()
+
+	// The mirror stalls until the request is abandoned
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+
+	env := conftest.New()
+	source, err := newImageSource(env, &config.Config{RegistryMirror: server.URL, ImageCatalog: "/var/lib/other-images"}, "models/bert")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, _, err = source.resolve(ctx, imageReference{repository: "models/bert", tag: "v1"})
+	require.Error(t, err)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.ErrorContains(t, err, "context canceled")
+}
+
+func TestUnpackImage(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	writeLayout(t, env, "/var/lib/csi-loop-images/models/bert")
+	mirror := registryMirror(t, env, "/var/lib/csi-loop-images")
+
+	for _, cfg := range []*config.Config{config.Default(), {RegistryMirror: mirror, ImageCatalog: "/var/lib/other-images"}} {
+		source, err := newImageSource(env, cfg, "models/bert")
+		require.NoError(t, err)
+		_, layers, err := source.resolve(context.Background(), imageReference{repository: "models/bert", tag: "v1"})
+		require.NoError(t, err)
+
+		target := "/mnt/image"
+		require.NoError(t, unpackImage(context.Background(), env, source, layers, target, "/tmp/blobs", false))
+
+		content, err := afero.ReadFile(env.FS, filepath.Join(target, "etc/config"))
+		require.NoError(t, err)
+		assert.Equal(t, "v2", string(content), "upper layers should replace files")
+		exists, _ := afero.Exists(env.FS, filepath.Join(target, "etc/old"))
+		assert.False(t, exists, "whiteouts should remove files of lower layers")
+		exists, _ = afero.Exists(env.FS, filepath.Join(target, "data/a"))
+		assert.False(t, exists, "opaque whiteouts should empty directories of lower layers")
+		exists, _ = afero.Exists(env.FS, filepath.Join(target, "data/b"))
+		assert.True(t, exists, "opaque whiteouts should keep files of their own layer")
+		exists, _ = afero.Exists(env.FS, filepath.Join(target, "data/.wh..wh..opq"))
+		assert.False(t, exists, "whiteouts should not be extracted")
+		exists, _ = afero.Exists(env.FS, "/tmp/blobs")
+		assert.False(t, exists, "downloaded blobs should be removed")
+
+		env.FS.RemoveAll(target)
+	}
+
+	// Layers not matching their digest are rejected
+	source := imageSource{env: env, layout: "/var/lib/csi-loop-images/models/bert", repository: "models/bert"}
+	_, layers, err := source.resolve(context.Background(), imageReference{repository: "models/bert", tag: "v1"})
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(env.FS, source.blobPath(layers[1].Digest), tarArchive(t, "zstd", nil), 0644))
+
+	err = unpackImage(context.Background(), env, source, layers, "/mnt/image", "/tmp/blobs", false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("layer %s: blob has digest", layers[1].Digest))
+}
+
+func TestImageSize(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	writeLayout(t, env, "/var/lib/csi-loop-images/models/bert")
+	mirror := registryMirror(t, env, "/var/lib/csi-loop-images")
+
+	for _, cfg := range []*config.Config{config.Default(), {RegistryMirror: mirror, ImageCatalog: "/var/lib/other-images"}} {
+		source, err := newImageSource(env, cfg, "models/bert")
+		require.NoError(t, err)
+		_, layers, err := source.resolve(context.Background(), imageReference{repository: "models/bert", tag: "v1"})
+		require.NoError(t, err)
+
+		// 5 files of a block and 9 entries of a block each, and a tenth on top
+		size, err := imageSize(context.Background(), env, source, layers, "/tmp/blobs")
+		require.NoError(t, err)
+		assert.Equal(t, roundUpToBlock(14*blockSize*11/10), size)
+	}
+	blobs, _ := afero.ReadDir(env.FS, "/tmp/blobs")
+	assert.Len(t, blobs, len(testLayers), "downloaded blobs should be kept for unpacking")
+}
+
+func TestApplyWhiteout(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	require.NoError(t, afero.WriteFile(env.FS, "/outside", []byte("x"), 0644))
+
+	for _, name := range []string{"../.wh.outside", ".wh...", "../.wh..wh..opq"} {
+		err := applyWhiteout(env, "/mnt/image", name)
+		require.Error(t, err, name)
+		assert.Contains(t, err.Error(), "path escapes the volume")
+	}
+	exists, _ := afero.Exists(env.FS, "/outside")
+	assert.True(t, exists)
+}
+
+func TestNodeServer_ImageVolume(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		switch name {
+		case "truncate":
+			return afero.WriteFile(env.FS, args[2], nil, 0644)
+		case "cp":
+			data, err := afero.ReadFile(env.FS, args[1])
+			if err != nil {
+				return err
+			}
+			return afero.WriteFile(env.FS, args[2], data, 0644)
+		}
+		return nil
+	})
+
+	mockStatfs(env, 1<<40, 1<<40)
+	digest := writeLayout(t, env, "/var/lib/csi-loop-images/models/bert")
+
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+	publish := func(volumeID, targetPath string, volumeContext map[string]string) error {
+		if volumeContext["size"] == "" {
+			volumeContext["size"] = "200Mi"
+		}
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       targetPath,
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeContext:    volumeContext,
+		})
+		return err
+	}
+
+	template := cacheFilePath(config.DefaultPoolPath, "image@"+digest+"/default-btrfs")
+	staging := strings.TrimSuffix(template, ".img") + ".staging"
+
+	// The first volume builds the template of the image at the minimum size, its copy is grown
+	require.NoError(t, publish("csi-1", "/mnt/a", map[string]string{sourceImageParameter: "models/bert:v1"}))
+	assert.Equal(t, []string{
+		"[truncate -s 114294784 " + template + "]",
+		"[mkfs.btrfs " + template + "]",
+		"[mount -o loop " + template + " " + staging + "]",
+		"[umount " + staging + "]",
+		"[cp --reflink=always " + template + " /var/lib/csi-loop/csi-1.img.tmp]",
+		"[truncate -s 209715200 /var/lib/csi-loop/csi-1.img.tmp]",
+		"[mount -o loop,nosuid,nodev /var/lib/csi-loop/csi-1.img /mnt/a]",
+		"[btrfs filesystem resize max /mnt/a]",
+	}, commands)
+	exists, _ := afero.Exists(env.FS, staging)
+	assert.False(t, exists, "staging directory should be removed")
+
+	volume, _ := ns.State.GetVolume("csi-1")
+	assert.Equal(t, "models/bert@"+digest, volume.SourceImage)
+	assert.False(t, volume.ResizePending, "filesystem should be grown")
+	cache, ok := ns.State.GetCache("image@" + digest + "/default-btrfs")
+	require.True(t, ok)
+	assert.Equal(t, template, cache.BackingFile)
+	assert.Equal(t, int64(114294784), cache.Size)
+
+	// Later volumes of the same image are copied from the template, whatever their size
+	commands = nil
+	require.NoError(t, publish("csi-2", "/mnt/b", map[string]string{sourceImageParameter: "models/bert@" + digest, "size": "300Mi"}))
+	assert.Equal(t, []string{
+		"[cp --reflink=always " + template + " /var/lib/csi-loop/csi-2.img.tmp]",
+		"[truncate -s 314572800 /var/lib/csi-loop/csi-2.img.tmp]",
+		"[mount -o loop,nosuid,nodev /var/lib/csi-loop/csi-2.img /mnt/b]",
+		"[btrfs filesystem resize max /mnt/b]",
+	}, commands)
+
+	// Source archives and images are mutually exclusive
+	err := publish("csi-3", "/mnt/c", map[string]string{sourceImageParameter: "models/bert", sourceParameter: "data.tar"})
+	require.Error(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Missing images fail publishing without leaving a volume behind
+	err = publish("csi-4", "/mnt/d", map[string]string{sourceImageParameter: "models/gpt"})
+	require.Error(t, err)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, ok = ns.State.GetVolume("csi-4")
+	assert.False(t, ok)
+}
+
+func TestNodeServer_ImageVolumeOverBudget(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		return nil
+	})
+
+	mockStatfs(env, 100<<20, 100<<20)
+	writeLayout(t, env, "/var/lib/csi-loop-images/models/bert")
+
+	// The volume does not fit into the pool, so the template is never built
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "csi-1",
+		TargetPath:       "/mnt/a",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{"size": "200Mi", sourceImageParameter: "models/bert:v1"},
+	})
+	require.Error(t, err)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Empty(t, commands)
+	assert.Empty(t, ns.State.Caches())
+}
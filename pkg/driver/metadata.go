@@ -0,0 +1,60 @@
+package driver
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"k8s.io/klog/v2"
+)
+
+// volumeMetadata is written next to each backing image as <volume-id>.json,
+// so operators inspecting a pool directory can tell who owns an image.
+// The driver never reads it back, volumes are looked up by ID in the state.
+type volumeMetadata struct {
+	VolumeID       string    `json:"volumeId"`
+	Namespace      string    `json:"namespace,omitempty"`
+	PodName        string    `json:"podName,omitempty"`
+	PodUID         string    `json:"podUid,omitempty"`
+	ServiceAccount string    `json:"serviceAccount,omitempty"`
+	RequestedSize  string    `json:"requestedSize,omitempty"`
+	Size           int64     `json:"size"`
+	Filesystem     string    `json:"fsType"`
+	Encrypted      bool      `json:"encrypted,omitempty"`
+	Source         string    `json:"source,omitempty"`
+	SourceImage    string    `json:"sourceImage,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// metadataFilePath returns the path of the metadata file of a backing image.
+func metadataFilePath(backingFile string) string {
+	return strings.TrimSuffix(backingFile, ".img") + ".json"
+}
+
+// writeMetadata writes the metadata file of a volume.
+// The file is informational only, so failures are logged and otherwise ignored.
+func writeMetadata(env *conf.Env, volume state.Volume) {
+	data, err := json.MarshalIndent(volumeMetadata{
+		VolumeID:       volume.ID,
+		Namespace:      volume.Namespace,
+		PodName:        volume.PodName,
+		PodUID:         volume.PodUID,
+		ServiceAccount: volume.ServiceAccount,
+		RequestedSize:  volume.RequestedSize,
+		Size:           volume.Size,
+		Filesystem:     volume.Filesystem,
+		Encrypted:      volume.Encrypted,
+		Source:         volume.Source,
+		SourceImage:    volume.SourceImage,
+		CreatedAt:      volume.CreatedAt,
+	}, "", "  ")
+	if err == nil {
+		err = afero.WriteFile(env.FS, metadataFilePath(volume.BackingFile), data, 0644)
+	}
+	if err != nil {
+		klog.Warningf("Failed to write metadata of volume %s: %v", volume.ID, err)
+	}
+}
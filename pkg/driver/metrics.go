@@ -0,0 +1,37 @@
+package driver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// warmPoolMetrics are the metrics of a warm pool, served by the metrics endpoint of the node.
+type warmPoolMetrics struct {
+	hits   *prometheus.CounterVec
+	misses *prometheus.CounterVec
+	images *prometheus.GaugeVec
+	paused *prometheus.GaugeVec
+}
+
+// newWarmPoolMetrics returns the metrics of a warm pool, registered with registry.
+func newWarmPoolMetrics(registry prometheus.Registerer) *warmPoolMetrics {
+	m := &warmPoolMetrics{
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "csi_loop_warm_pool_hits_total",
+			Help: "New inline volumes created from a pre-formatted image.",
+		}, []string{"pool", "fs_type"}),
+		misses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "csi_loop_warm_pool_misses_total",
+			Help: "New inline volumes formatted on publish in pools with a warm pool.",
+		}, []string{"pool", "fs_type"}),
+		images: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "csi_loop_warm_pool_images",
+			Help: "Pre-formatted images ready per size class.",
+		}, []string{"pool", "fs_type", "size_class"}),
+		paused: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "csi_loop_warm_pool_paused",
+			Help: "Whether filling the warm pool is paused under disk pressure.",
+		}, []string{"pool"}),
+	}
+	registry.MustRegister(m.hits, m.misses, m.images, m.paused)
+	return m
+}
@@ -0,0 +1,140 @@
+package driver
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mountOptionsParameter is the volume attribute holding comma-separated mount options of an
+// inline volume. Persistent volumes take them from the mountOptions of their StorageClass.
+const mountOptionsParameter = "mountOptions"
+
+// seLinuxContextOption is the prefix of the mount flag kubelet passes with the SELinux label of
+// the pod, if the CSIDriver sets seLinuxMount and the SELinuxMount feature applies to the volume.
+const seLinuxContextOption = "context="
+
+// hardenedMountOptions maps each relaxation of config.MountRelaxations to the hardened mount option it undoes.
+var hardenedMountOptions = map[string]string{
+	"suid": "nosuid",
+	"dev":  "nodev",
+	"exec": "noexec",
+}
+
+// managedMountOptions are the mount options the driver sets itself from the access mode,
+// the volume and kubelet, which a volume may not request.
+var managedMountOptions = []string{"ro", "rw", "defaults", "remount", "bind", "rbind", "loop"}
+
+// managedMountOptionPrefixes are the prefixes of managed mount options taking a value:
+// the SELinux labels, only taken from kubelet, and the userspace X- options like X-mount.idmap.
+var managedMountOptionPrefixes = []string{"context=", "fscontext=", "defcontext=", "rootcontext=", "X-"}
+
+// requestedMountOptions returns the mount options requested for a volume: those of the
+// mountOptions attribute of inline volumes and the mount flags of the volume capability,
+// except the SELinux context.
+func requestedMountOptions(volumeContext map[string]string, capability *csi.VolumeCapability) []string {
+	var options []string
+	for _, option := range strings.Split(volumeContext[mountOptionsParameter], ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			options = append(options, option)
+		}
+	}
+	for _, flag := range capability.GetMount().GetMountFlags() {
+		if !strings.HasPrefix(flag, seLinuxContextOption) {
+			options = append(options, flag)
+		}
+	}
+	return options
+}
+
+// seLinuxContext returns the context= mount flag of the volume capability, or "" without one.
+// The filesystem is mounted with it, so every file carries the SELinux label of the pod
+// without relabeling. Only kubelet passes it, it is never taken from volume attributes.
+//
+// Returns an InvalidArgument error if the flag is empty or given twice with different labels.
+func seLinuxContext(capability *csi.VolumeCapability) (string, error) {
+	var context string
+	for _, flag := range capability.GetMount().GetMountFlags() {
+		label, ok := strings.CutPrefix(flag, seLinuxContextOption)
+		if !ok {
+			continue
+		}
+		if strings.Trim(label, `"`) == "" {
+			return "", status.Errorf(codes.InvalidArgument, "mount flag %s has no SELinux label", flag)
+		}
+		if context != "" && context != flag {
+			return "", status.Errorf(codes.InvalidArgument, "conflicting SELinux mount flags %s and %s", context, flag)
+		}
+		context = flag
+	}
+	return context, nil
+}
+
+// mountOptions returns the mount options of a volume in the given namespace: the requested
+// options other than relaxations, e.g. noatime or compress=zstd, followed by the hardened ones.
+// The hardened options are nosuid and nodev, and noexec if the mount policy enforces it, less
+// the requested relaxations the mount policy allows in the namespace. Relaxing an option that is
+// not enforced is a no-op. The hardened options come last, so they win over options implying
+// their relaxation.
+//
+// Returns an InvalidArgument error if a requested option is managed by the driver, or a
+// PermissionDenied error if the namespace may not relax an option.
+func mountOptions(cfg *config.Config, namespace string, requested []string) ([]string, error) {
+	hardenedOptions := []string{"nosuid", "nodev"}
+	if cfg.MountPolicy.NoExec {
+		hardenedOptions = append(hardenedOptions, "noexec")
+	}
+
+	var options []string
+	for _, option := range requested {
+		hardened, ok := hardenedMountOptions[option]
+		if !ok {
+			if slices.Contains(managedMountOptions, option) || slices.ContainsFunc(managedMountOptionPrefixes, func(prefix string) bool { return strings.HasPrefix(option, prefix) }) {
+				return nil, status.Errorf(codes.InvalidArgument, "mount option %s is set by the driver and cannot be requested", option)
+			}
+			if !slices.Contains(options, option) {
+				options = append(options, option)
+			}
+			continue
+		}
+		if !slices.Contains(hardenedOptions, hardened) {
+			continue
+		}
+		if !cfg.MountPolicy.Allowed(namespace, option) {
+			return nil, status.Errorf(codes.PermissionDenied, "mount option %s is not allowed in namespace %q, it must be listed in mountPolicy.allow", option, namespace)
+		}
+		hardenedOptions = slices.DeleteFunc(hardenedOptions, func(o string) bool { return o == hardened })
+	}
+	return append(options, hardenedOptions...), nil
+}
+
+// volumeMount holds how a publish asks for a volume to be mounted.
+type volumeMount struct {
+	// requested lists the requested mount options, relaxing the hardened ones or passed through.
+	requested []string
+	// seLinuxContext is the context= mount flag passed by kubelet, or "".
+	seLinuxContext string
+	// idMap is the X-mount.idmap option mapping the IDs of the volume into the user namespace
+	// of the pod, or "". Kernel support is only checked once the filesystem is known.
+	idMap string
+}
+
+// parseVolumeMount returns how a publish to the target path asks for a volume to be mounted.
+//
+// Returns an InvalidArgument error if the SELinux context or ID mapping is invalid.
+func parseVolumeMount(env *conf.Env, volumeContext map[string]string, capability *csi.VolumeCapability, targetPath string) (volumeMount, error) {
+	context, err := seLinuxContext(capability)
+	if err != nil {
+		return volumeMount{}, err
+	}
+	idMap, err := volumeIDMap(env, volumeContext, targetPath)
+	if err != nil {
+		return volumeMount{}, err
+	}
+	return volumeMount{requested: requestedMountOptions(volumeContext, capability), seLinuxContext: context, idMap: idMap}, nil
+}
@@ -0,0 +1,331 @@
+// Hardened mount options tests.
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMountOptions(t *testing.T) {
+	t.Parallel()
+
+	policy := config.MountPolicy{Allow: map[string][]string{
+		"builds":             {"suid", "exec"},
+		config.AllNamespaces: {"dev"},
+	}}
+
+	tests := []struct {
+		name      string
+		noExec    bool
+		namespace string
+		requested []string
+		want      []string
+		wantCode  codes.Code
+	}{
+		{
+			name: "hardens by default",
+			want: []string{"nosuid", "nodev"},
+		},
+		{
+			name:   "adds noexec by policy",
+			noExec: true,
+			want:   []string{"nosuid", "nodev", "noexec"},
+		},
+		{
+			name:      "relaxes allowed options of the namespace",
+			noExec:    true,
+			namespace: "builds",
+			requested: []string{"suid", "exec"},
+			want:      []string{"nodev"},
+		},
+		{
+			name:      "relaxes options allowed in every namespace",
+			namespace: "web",
+			requested: []string{"dev"},
+			want:      []string{"nosuid"},
+		},
+		{
+			name:      "ignores relaxations of options not enforced",
+			namespace: "web",
+			requested: []string{"exec"},
+			want:      []string{"nosuid", "nodev"},
+		},
+		{
+			name:      "rejects relaxations not allowed in the namespace",
+			namespace: "web",
+			requested: []string{"suid"},
+			wantCode:  codes.PermissionDenied,
+		},
+		{
+			name:      "passes other options through before the hardened ones",
+			namespace: "web",
+			requested: []string{"noatime", "compress=zstd", "noatime"},
+			want:      []string{"noatime", "compress=zstd", "nosuid", "nodev"},
+		},
+		{
+			name:      "rejects options set by the driver",
+			namespace: "builds",
+			requested: []string{"rw"},
+			wantCode:  codes.InvalidArgument,
+		},
+		{
+			name:      "rejects SELinux labels",
+			namespace: "builds",
+			requested: []string{"fscontext=system_u:object_r:container_file_t:s0"},
+			wantCode:  codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := config.Default()
+			cfg.MountPolicy = policy
+			cfg.MountPolicy.NoExec = tt.noExec
+
+			got, err := mountOptions(cfg, tt.namespace, tt.requested)
+			if tt.wantCode != codes.OK {
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRequestedMountOptions(t *testing.T) {
+	t.Parallel()
+
+	capability := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	capability.GetMount().MountFlags = []string{"exec", `context="system_u:object_r:container_file_t:s0:c1,c2"`}
+
+	got := requestedMountOptions(map[string]string{mountOptionsParameter: "suid, dev,"}, capability)
+	assert.Equal(t, []string{"suid", "dev", "exec"}, got)
+}
+
+func TestSELinuxContext(t *testing.T) {
+	t.Parallel()
+
+	const label = `context="system_u:object_r:container_file_t:s0:c1,c2"`
+
+	tests := []struct {
+		name     string
+		flags    []string
+		want     string
+		wantCode codes.Code
+	}{
+		{
+			name:  "returns no context without the flag",
+			flags: []string{"exec"},
+		},
+		{
+			name:  "returns the context flag",
+			flags: []string{"exec", label},
+			want:  label,
+		},
+		{
+			name:  "accepts repeated flags of the same label",
+			flags: []string{label, label},
+			want:  label,
+		},
+		{
+			name:     "rejects an empty label",
+			flags:    []string{`context=""`},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "rejects conflicting labels",
+			flags:    []string{label, `context="system_u:object_r:container_file_t:s0:c3,c4"`},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			capability := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+			capability.GetMount().MountFlags = tt.flags
+
+			got, err := seLinuxContext(capability)
+			if tt.wantCode != codes.OK {
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNodeServer_MountPolicy(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		return nil
+	})
+	mockStatfs(env, 1<<40, 1<<40)
+
+	cfg := config.Default()
+	cfg.MountPolicy = config.MountPolicy{NoExec: true, Allow: map[string][]string{"builds": {"exec"}}}
+	ns := NewNodeServer(env, cfg, newTestState(t, env), nil)
+
+	// Inline volumes relax through their attribute, within the policy of the pod namespace
+	publish := func(volumeID, namespace string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       "/mnt/" + volumeID,
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeContext:    map[string]string{"size": "200Mi", podNamespaceKey: namespace, mountOptionsParameter: "exec"},
+		})
+		return err
+	}
+	err := publish("csi-1", "web")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Contains(t, err.Error(), `mount option exec is not allowed in namespace "web"`)
+	assert.Empty(t, commands, "rejected volumes should not be created")
+
+	require.NoError(t, publish("csi-2", "builds"))
+	assert.Contains(t, commands, "[mount -o loop,nosuid,nodev /var/lib/csi-loop/csi-2.img /mnt/csi-2]")
+
+	// Persistent volumes relax through the mount options of their StorageClass
+	backingFile := backingFilePath(config.DefaultPoolPath, "pvc-1")
+	require.NoError(t, afero.WriteFile(env.FS, backingFile, nil, 0644))
+	require.NoError(t, ns.State.PutVolume(state.Volume{ID: "pvc-1", Namespace: "web", BackingFile: backingFile, Size: 1 << 30}))
+	capability := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	capability.GetMount().MountFlags = []string{"exec"}
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		TargetPath:       "/mnt/pvc-1",
+		VolumeCapability: capability,
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	commands = nil
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		TargetPath:       "/mnt/pvc-1",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		Readonly:         true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"[mount -o loop,nosuid,nodev,noexec /var/lib/csi-loop/pvc-1.img /mnt/pvc-1]",
+		"[mount -o remount,bind,ro,nosuid,nodev,noexec /mnt/pvc-1]",
+	}, commands)
+}
+
+func TestNodeServer_PassThroughMountOptions(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		return nil
+	})
+	mockStatfs(env, 1<<40, 1<<40)
+
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+
+	// Inline volumes pass options other than relaxations through their attribute
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "csi-1",
+		TargetPath:       "/mnt/csi-1",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{"size": "200Mi", mountOptionsParameter: "noatime"},
+	})
+	require.NoError(t, err)
+	assert.Contains(t, commands, "[mount -o loop,noatime,nosuid,nodev /var/lib/csi-loop/csi-1.img /mnt/csi-1]")
+
+	// Persistent volumes through the mount options of their StorageClass, kept by remounts
+	backingFile := backingFilePath(config.DefaultPoolPath, "pvc-1")
+	require.NoError(t, afero.WriteFile(env.FS, backingFile, nil, 0644))
+	require.NoError(t, ns.State.PutVolume(state.Volume{ID: "pvc-1", BackingFile: backingFile, Size: 1 << 30}))
+	capability := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	capability.GetMount().MountFlags = []string{"noatime"}
+
+	commands = nil
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		TargetPath:       "/mnt/pvc-1",
+		VolumeCapability: capability,
+		Readonly:         true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"[mount -o loop,noatime,nosuid,nodev /var/lib/csi-loop/pvc-1.img /mnt/pvc-1]",
+		"[mount -o remount,bind,ro,noatime,nosuid,nodev /mnt/pvc-1]",
+	}, commands)
+}
+
+func TestNodeServer_SELinuxMount(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		return nil
+	})
+	mockStatfs(env, 1<<40, 1<<40)
+
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+	publish := func(volumeID, targetPath, label string) error {
+		capability := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)
+		capability.GetMount().MountFlags = []string{`context="system_u:object_r:container_file_t:s0:` + label + `"`}
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       targetPath,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"size": "200Mi"},
+		})
+		return err
+	}
+
+	// Inline volumes are mounted with the label of their pod
+	require.NoError(t, publish("csi-1", "/mnt/csi-1", "c1,c2"))
+	assert.Contains(t, commands, `[mount -o loop,nosuid,nodev,context="system_u:object_r:container_file_t:s0:c1,c2" /var/lib/csi-loop/csi-1.img /mnt/csi-1]`)
+	volume, _ := ns.State.GetVolume("csi-1")
+	assert.Equal(t, `context="system_u:object_r:container_file_t:s0:c1,c2"`, volume.SELinuxContext)
+
+	// Persistent volumes are labeled by their first mount, bind mounts must share the label
+	backingFile := backingFilePath(config.DefaultPoolPath, "pvc-1")
+	require.NoError(t, afero.WriteFile(env.FS, backingFile, nil, 0644))
+	require.NoError(t, ns.State.PutVolume(state.Volume{ID: "pvc-1", BackingFile: backingFile, Size: 1 << 30}))
+
+	commands = nil
+	require.NoError(t, publish("pvc-1", "/mnt/pvc-a", "c3,c4"))
+	require.NoError(t, publish("pvc-1", "/mnt/pvc-b", "c3,c4"))
+	assert.Equal(t, []string{
+		`[mount -o loop,nosuid,nodev,context="system_u:object_r:container_file_t:s0:c3,c4" /var/lib/csi-loop/pvc-1.img /mnt/pvc-a]`,
+		"[mount --bind /mnt/pvc-a /mnt/pvc-b]",
+		"[mount -o remount,bind,rw,nosuid,nodev /mnt/pvc-b]",
+	}, commands)
+
+	err := publish("pvc-1", "/mnt/pvc-c", "c5,c6")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Once unpublished everywhere, the volume can be mounted with another label
+	for _, targetPath := range []string{"/mnt/pvc-a", "/mnt/pvc-b"} {
+		_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: targetPath})
+		require.NoError(t, err)
+	}
+	require.NoError(t, publish("pvc-1", "/mnt/pvc-c", "c5,c6"))
+}
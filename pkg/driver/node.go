@@ -1,79 +1,633 @@
 package driver
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/marxus/csi-loop-driver/conf"
-	"k8s.io/apimachinery/pkg/api/resource"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/mount"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 )
 
-const backingFileDir = "/var/lib/csi-loop"
+// Pod info passed in the volume context by kubelet, see podInfoOnMount in the CSIDriver object.
+const (
+	podNameKey        = "csi.storage.k8s.io/pod.name"
+	podNamespaceKey   = "csi.storage.k8s.io/pod.namespace"
+	podUIDKey         = "csi.storage.k8s.io/pod.uid"
+	serviceAccountKey = "csi.storage.k8s.io/serviceAccount.name"
+)
+
+// topologyKey is the topology segment identifying the node a volume lives on.
+const topologyKey = "topology.loop.csi.k8s.io/node"
 
 // NodeServer implements the CSI Node service.
 // It handles volume mounting and unmounting operations on the node.
 type NodeServer struct {
+	// Env is the environment the service runs in: its filesystem, commands, mounts and clock.
+	Env *conf.Env
 	// NodeId is the unique identifier for this node.
 	NodeId string
+	// Config holds the driver configuration.
+	Config *config.Config
+	// State tracks persistent volumes and where they are mounted.
+	State *state.Store
+	// WarmPool holds the pre-formatted images new inline volumes are taken from, nil without.
+	WarmPool *WarmPool
+
+	// templates locks the image templates by key while they are built and copied.
+	templates keyedMutex
+}
+
+// NewNodeServer returns the node service of the node env runs on.
+// The warm pool is optional, inline volumes are formatted on publish without one.
+func NewNodeServer(env *conf.Env, cfg *config.Config, store *state.Store, warmPool *WarmPool) *NodeServer {
+	return &NodeServer{Env: env, NodeId: env.NodeId, Config: cfg, State: store, WarmPool: warmPool}
+}
+
+// allocateVolume creates the sparse backing file of a new volume in its pool and records it
+// in the state, provided it fits into the pool budget and the quota of its namespace.
+// Once recorded, the volume counts towards both limits, so the lock only covers the allocation.
+func allocateVolume(env *conf.Env, cfg *config.Config, store *state.Store, pool config.Pool, volume state.Volume) error {
+	return allocate(env, cfg, store, pool, volume, func() error {
+		if err := env.Loop.Truncate(env.RealPath(volume.BackingFile), volume.Size); err != nil {
+			return fmt.Errorf("failed to create backing file: %v", err)
+		}
+		return nil
+	})
+}
+
+// allocateVolumeFrom creates the backing file of a new volume as a copy of an image,
+// like allocateVolume, copying on a reservation, see allocateReserved. Copies of volumes
+// with a pending resize are grown to the size of the volume.
+func allocateVolumeFrom(ctx context.Context, env *conf.Env, cfg *config.Config, store *state.Store, pool config.Pool, volume state.Volume, image string) error {
+	return allocateReserved(env, cfg, store, pool, volume, func(path string) error {
+		if err := copyImage(ctx, env, image, path); err != nil {
+			return fmt.Errorf("failed to copy %s: %v", image, err)
+		}
+		if volume.ResizePending {
+			if err := env.Loop.Truncate(env.RealPath(path), volume.Size); err != nil {
+				return fmt.Errorf("failed to grow backing file: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// allocateReserved checks the limits and reserves a volume, creates its backing file with create
+// and records the volume. Only the check and reservation hold env.Allocation, so slow creates
+// like copies of large images do not block other volumes. create writes to a temporary path
+// next to the backing file, which does not count towards the pool budget while the reservation
+// does, and is moved into place once complete.
+//
+// Returns an Aborted error if the volume is being created already.
+func allocateReserved(env *conf.Env, cfg *config.Config, store *state.Store, pool config.Pool, volume state.Volume, create func(path string) error) error {
+	env.Allocation.Lock()
+	env.FS.MkdirAll(pool.Path, 0755)
+	err := checkLimits(env, cfg, store, pool, volume.Namespace, volume.Size)
+	if err == nil && !store.Reserve(volume) {
+		err = status.Errorf(codes.Aborted, "volume %s is already being created", volume.ID)
+	}
+	env.Allocation.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := volume.BackingFile + ".tmp"
+	if err := create(path); err != nil {
+		env.FS.Remove(path)
+		store.CancelReservation(volume.ID)
+		return err
+	}
+	if err := env.FS.Rename(path, volume.BackingFile); err != nil {
+		env.FS.Remove(path)
+		store.CancelReservation(volume.ID)
+		return fmt.Errorf("failed to move backing file into place: %v", err)
+	}
+	writeMetadata(env, volume)
+
+	if err := store.PutVolume(volume); err != nil {
+		env.FS.Remove(volume.BackingFile)
+		store.CancelReservation(volume.ID)
+		return err
+	}
+	return nil
+}
+
+// allocate checks the limits, creates the backing file of a volume with create and records the volume.
+// create runs under env.Allocation, slow creates use allocateReserved.
+func allocate(env *conf.Env, cfg *config.Config, store *state.Store, pool config.Pool, volume state.Volume, create func() error) error {
+	env.Allocation.Lock()
+	defer env.Allocation.Unlock()
+
+	// Make sure directory exists
+	env.FS.MkdirAll(pool.Path, 0755)
+
+	if err := checkLimits(env, cfg, store, pool, volume.Namespace, volume.Size); err != nil {
+		return err
+	}
+
+	if err := create(); err != nil {
+		return err
+	}
+	writeMetadata(env, volume)
+
+	if err := store.PutVolume(volume); err != nil {
+		env.FS.Remove(volume.BackingFile)
+		return err
+	}
+	return nil
+}
+
+// releaseVolume removes the backing file and metadata of a volume and forgets the volume.
+// The dm-crypt mapping of an encrypted ephemeral volume in use is closed first, discarding its key.
+// The backing file is wiped according to the wipe policy of its pool, see removeBackingFile.
+func releaseVolume(env *conf.Env, cfg *config.Config, store *state.Store, volume state.Volume) error {
+	if volume.Encrypted && volume.Ephemeral && volume.ReleasedAt == nil {
+		if err := closeEncryptedVolume(env, volume.ID); err != nil {
+			klog.Warningf("Volume %s: %v", volume.ID, err)
+		}
+	}
+	env.FS.Remove(metadataFilePath(volume.BackingFile))
+	removeBackingFile(env, cfg, store, volume)
+	return store.DeleteVolume(volume.ID)
+}
+
+// retireVolume disposes of an ephemeral volume that is no longer mounted.
+// Volumes with a cache key are written back to their cache, volumes with a retain key
+// are kept and marked released, volumes to archive are archived, others are released.
+// Retained encrypted volumes are locked until they are reattached.
+func retireVolume(env *conf.Env, cfg *config.Config, store *state.Store, volume state.Volume) error {
+	switch {
+	case volume.CacheKey != "":
+		return storeCache(env, cfg, store, volume)
+	case volume.RetainKey != "":
+		klog.Infof("Retaining volume %s for %s", volume.ID, volume.RetainKey)
+		if volume.Encrypted {
+			if err := closeEncryptedVolume(env, volume.ID); err != nil {
+				klog.Warningf("Volume %s: %v", volume.ID, err)
+			}
+		}
+		now := env.Now()
+		volume.ReleasedAt = &now
+		volume.TargetPaths = nil
+		return store.PutVolume(volume)
+	case volume.Archive:
+		return archiveVolume(env, cfg, store, volume)
+	default:
+		return releaseVolume(env, cfg, store, volume)
+	}
+}
+
+// discardVolume disposes of an ephemeral volume whose publish did not complete. It may be
+// unused or half-seeded, so it is neither written back to its cache nor archived, but released.
+// Volumes reattached for their retain key are retained again, see retireVolume.
+func discardVolume(env *conf.Env, cfg *config.Config, store *state.Store, volume state.Volume) error {
+	if volume.RetainKey != "" && volume.Source == "" {
+		return retireVolume(env, cfg, store, volume)
+	}
+	return releaseVolume(env, cfg, store, volume)
 }
 
 // NodePublishVolume mounts the volume to the target path.
-// It creates a backing file with the requested size, formats it with btrfs,
-// and mounts it as a loop device.
+// For ephemeral volumes it creates a backing file with the requested size, the pool's
+// default size, or a percentage of the pool's free space in the
+// pool selected by the pool attribute or the placement strategy, formats it with
+// the pool's filesystem, and mounts it as a loop device. Ephemeral volumes are
+// recorded with the pod they belong to and count towards the pod's namespace quota.
+// The pod is also written to a metadata file next to the backing file.
+// Volumes with retainPolicy keep are kept on unpublish, and reattached after a filesystem
+// check when a pod with the same namespace, name and volume name is published.
+// Volumes with a cacheKey start as a clone of their cache and are written back on unpublish,
+// volumes with archiveOnDelete are moved to the pool's archive on unpublish.
+// New volumes with a source are seeded from an archive of the source catalog before they are handed out.
+// Encrypted volumes are unlocked with the passphrase secret if one is passed.
+// Persistent volumes already have a formatted backing file and are only mounted.
+// Volumes are mounted read-only if requested or if the access mode is read-only, with the
+// requested options and the hardened options of the mount policy, and with the SELinux context kubelet passes in the mount
+// flags, which labels the filesystem for the pod without relabeling its files. Volumes of pods
+// in a user namespace are ID-mapped into it, if the kernel supports it.
 //
-// Returns an error if size parsing, file creation, formatting, or mounting fails.
+// Returns an error if the volume capability, pool or size is unsupported, the volume does not fit
+// into the pool budget or namespace quota, the source archive is missing or invalid, the passphrase is
+// wrong, a mount option is not allowed, or if size parsing, file creation, formatting, or mounting fails.
 func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
 	volumeContext := req.GetVolumeContext()
 
-	size := volumeContext["size"]
+	if err := validateCapability(req.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	accessMode := req.GetVolumeCapability().GetAccessMode().GetMode()
+	readOnly := req.GetReadonly() || accessMode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+	mount, err := parseVolumeMount(ns.Env, volumeContext, req.GetVolumeCapability(), targetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if volume, ok := ns.State.GetVolume(volumeID); ok && volume.ReleasedAt == nil {
+		if !volume.Ephemeral {
+			return ns.publishPersistentVolume(ctx, volume, targetPath, accessMode, readOnly, mount, req.GetSecrets())
+		}
+		if slices.Contains(volume.TargetPaths, targetPath) {
+			klog.Infof("Volume %s already mounted at %s", volumeID, targetPath)
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+		// A previous publish did not complete, start over
+		klog.Warningf("Discarding incomplete ephemeral volume %s", volumeID)
+		if err := discardVolume(ns.Env, ns.Config, ns.State, volume); err != nil {
+			return nil, err
+		}
+	}
 
-	klog.Infof("NodePublishVolume: volumeID=%s, targetPath=%s, size=%s", volumeID, targetPath, size)
+	size := volumeContext["size"]
+	namespace := volumeContext[podNamespaceKey]
+	podName := volumeContext[podNameKey]
 
-	// Step 1: Create backing file
-	backingFile := fmt.Sprintf("%s/%s.img", backingFileDir, volumeID)
-	klog.Infof("Creating backing file: %s", backingFile)
+	klog.Infof("NodePublishVolume: volumeID=%s, targetPath=%s, size=%s, pool=%s, pod=%s/%s", volumeID, targetPath, size, volumeContext[poolParameter], namespace, podName)
 
-	// Parse Kubernetes quantity format (1Gi, 500Mi) to bytes
-	quantity, err := resource.ParseQuantity(size)
+	// Step 1: Parse Kubernetes quantity format (1Gi, 500Mi) or percentage (10%) and the retain policy
+	sizeRequest, err := parseSize(size)
 	if err != nil {
-		return nil, fmt.Errorf("invalid size format %s: %v", size, err)
+		return nil, err
+	}
+	key, err := retainKey(volumeContext, targetPath)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := cacheKey(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" && cache != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "retainPolicy %s and %s are mutually exclusive", retainPolicyKeep, cacheKeyParameter)
+	}
+	if volumeContext[sourceParameter] != "" && volumeContext[sourceImageParameter] != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s and %s are mutually exclusive", sourceParameter, sourceImageParameter)
+	}
+	archive, err := archiveOnDelete(ns.Config, volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	volumeOptions, err := mountOptions(ns.Config, namespace, mount.requested)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, passphrase, err := encryptedVolume(volumeContext, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	defer clear(passphrase)
+	// Archives of encrypted volumes could never be decrypted
+	archive = archive && !encrypted
+	source, preserveOwnership, err := sourceArchive(ns.Env, ns.Config, volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	if image := volumeContext[sourceImageParameter]; image != "" {
+		if _, err := parseImageReference(image); err != nil {
+			return nil, err
+		}
 	}
-	sizeBytes := quantity.Value()
-	klog.Infof("Parsed size: %s -> %d bytes", size, sizeBytes)
-
-	// Make sure directory exists
-	conf.FS.MkdirAll(backingFileDir, 0755)
 
-	// Create the file with truncate
-	if err := conf.RunCommand("truncate", "-s", fmt.Sprintf("%d", sizeBytes), conf.RealPath(backingFile)); err != nil {
-		return nil, fmt.Errorf("failed to create backing file: %v", err)
+	volume := state.Volume{
+		ID:             volumeID,
+		Ephemeral:      true,
+		Namespace:      namespace,
+		PodName:        podName,
+		PodUID:         volumeContext[podUIDKey],
+		ServiceAccount: volumeContext[serviceAccountKey],
+		RequestedSize:  size,
+		Archive:        archive,
+		Encrypted:      encrypted,
+		CacheKey:       cache,
+		RetainKey:      key,
+		CreatedAt:      ns.Env.Now(),
 	}
 
-	// Step 2: Format with mkfs.btrfs
-	klog.Infof("Formatting with mkfs.btrfs")
-	if err := conf.RunCommand("mkfs.btrfs", conf.RealPath(backingFile)); err != nil {
-		return nil, fmt.Errorf("failed to format: %v", err)
+	// Step 2: Reattach the volume retained for the pod, check out its cache, or create and format a new one
+	expireRetainedVolumes(ns.Env, ns.Config, ns.State)
+	retained, isRetained := retainedVolume(ns.State, key)
+	cached, isCached := ns.State.GetCache(cache)
+	switch {
+	case key != "" && isRetained:
+		volume, err = ns.reattachVolume(ctx, retained, volume, volumeContext, req.GetVolumeCapability(), sizeRequest, passphrase)
+	case cache != "" && isCached:
+		volume, err = ns.checkoutCache(ctx, cached, volume, volumeContext, req.GetVolumeCapability(), sizeRequest)
+	default:
+		volume, err = ns.createEphemeralVolume(ctx, volume, volumeContext, req.GetVolumeCapability(), sizeRequest, passphrase)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	// Step 3: Mount with loop
 	klog.Infof("Mounting to %s", targetPath)
-	conf.FS.MkdirAll(targetPath, 0755)
+	ns.Env.FS.MkdirAll(targetPath, 0755)
 
-	if err := conf.RunCommand("mount", "-o", "loop", conf.RealPath(backingFile), conf.RealPath(targetPath)); err != nil {
+	// Encrypted volumes are mounted through their dm-crypt mapping, which has its own loop device
+	device, base := volumeDevice(ns.Env, volume), []string{"loop"}
+	if volume.Encrypted {
+		base = nil
+	}
+	idMap := supportedIDMap(ns.Env, mount.idMap, volume.Filesystem, volumeID)
+	mountOptions := func(seeding bool) []string {
+		options := slices.Clone(base)
+		// A volume is seeded through a writable mount, which is remounted read-only afterwards
+		if readOnly && !seeding {
+			options = append(options, "ro")
+		}
+		options = append(options, volumeOptions...)
+		// The pod's SELinux label is set by the first mount, nothing is relabeled
+		if mount.seLinuxContext != "" {
+			options = append(options, mount.seLinuxContext)
+		}
+		// The driver seeds as host root, which an ID-mapped mount does not map
+		if idMap != "" && !seeding {
+			options = append(options, idMap)
+		}
+		return options
+	}
+	// Volumes taken from the warm pool are grown from the size of their image
+	if volume.ResizePending && growsOffline(volume.Filesystem) {
+		if err := growFilesystem(ctx, ns.Env, volume.Filesystem, device, targetPath); err != nil {
+			releaseVolume(ns.Env, ns.Config, ns.State, volume)
+			return nil, err
+		}
+		volume.ResizePending = false
+	}
+	if err := ns.Env.Mounter.Mount(device, ns.Env.RealPath(targetPath), volume.Filesystem, mountOptions(volume.Source != "")); err != nil {
+		discardVolume(ns.Env, ns.Config, ns.State, volume)
 		return nil, fmt.Errorf("failed to mount: %v", err)
 	}
+	if volume.ResizePending {
+		if err := growFilesystem(ctx, ns.Env, volume.Filesystem, device, targetPath); err != nil {
+			ns.Env.Mounter.Unmount(ns.Env.RealPath(targetPath))
+			releaseVolume(ns.Env, ns.Config, ns.State, volume)
+			return nil, err
+		}
+		volume.ResizePending = false
+	}
+
+	// Step 4: Seed a new volume from its source archive
+	if volume.Source != "" {
+		klog.Infof("Extracting %s into volume %s", source, volumeID)
+		err := extractArchive(ns.Env, source, targetPath, preserveOwnership)
+		if err != nil {
+			err = status.Errorf(codes.InvalidArgument, "failed to extract source %s: %v", volume.Source, err)
+		} else if idMap != "" {
+			// Only a new mount is ID-mapped
+			ns.Env.Mounter.Unmount(ns.Env.RealPath(targetPath))
+			if err = ns.Env.Mounter.Mount(device, ns.Env.RealPath(targetPath), volume.Filesystem, mountOptions(false)); err != nil {
+				err = fmt.Errorf("failed to mount: %v", err)
+			}
+		} else if readOnly {
+			// A remount resets the flags of the mount, the mount options of the volume are passed again
+			if err = ns.Env.Mounter.Remount(ns.Env.RealPath(targetPath), append([]string{"ro"}, volumeOptions...)); err != nil {
+				err = fmt.Errorf("failed to remount read-only: %v", err)
+			}
+		}
+		if err != nil {
+			ns.Env.Mounter.Unmount(ns.Env.RealPath(targetPath))
+			releaseVolume(ns.Env, ns.Config, ns.State, volume)
+			return nil, err
+		}
+	}
+
+	volume.TargetPaths = []string{targetPath}
+	volume.SELinuxContext = mount.seLinuxContext
+	volume.IDMap = idMap
+	if err := ns.State.PutVolume(volume); err != nil {
+		return nil, err
+	}
 
 	klog.Infof("Volume %s successfully mounted", volumeID)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// createEphemeralVolume places a new ephemeral volume in a pool, creates its backing file
+// within the pool budget and namespace quota, and formats it. Volumes with a source image
+// are copied from the template of the image instead, other volumes are taken from the warm
+// pool if it has an image ready. Encrypted volumes are formatted with the given passphrase,
+// or a throwaway key without.
+func (ns *NodeServer) createEphemeralVolume(ctx context.Context, volume state.Volume, volumeContext map[string]string, capability *csi.VolumeCapability, sizeRequest sizeRequest, passphrase []byte) (state.Volume, error) {
+	pool, err := selectPool(ns.Env, ns.Config, ns.State, volumeContext[poolParameter], sizeRequest.bytes)
+	if err != nil {
+		return state.Volume{}, err
+	}
+	fsType, err := volumeFilesystem(pool, capability)
+	if err != nil {
+		return state.Volume{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	sizeBytes, err := ephemeralSize(ns.Env, pool, fsType, sizeRequest)
+	if err != nil {
+		return state.Volume{}, err
+	}
+	klog.Infof("Parsed size: %s -> %d bytes", volume.RequestedSize, sizeBytes)
+
+	volume.Pool = pool.Name
+	volume.Filesystem = fsType
+	volume.BackingFile = backingFilePath(pool.Path, volume.ID)
+	volume.Size = sizeBytes
+	// Only new volumes are seeded, reused volumes already hold their data
+	volume.Source = volumeContext[sourceParameter]
+	if volumeContext[sourceImageParameter] != "" {
+		return ns.createImageVolume(ctx, pool, volume, volumeContext)
+	}
+
+	// Encrypted volumes are formatted through their mapping, images of the warm pool are not encrypted
+	if !volume.Encrypted {
+		warmVolume, warm, err := ns.WarmPool.allocateVolume(ns.State, pool, volume)
+		if err != nil || warm {
+			return warmVolume, err
+		}
+	}
+
+	klog.Infof("Creating backing file: %s", volume.BackingFile)
+	if err := allocateVolume(ns.Env, ns.Config, ns.State, pool, volume); err != nil {
+		return state.Volume{}, err
+	}
+
+	if volume.Encrypted {
+		err = formatEncryptedVolume(ctx, ns.Env, volume, passphrase)
+	} else {
+		err = formatBackingFile(ctx, ns.Env, fsType, volume.BackingFile)
+	}
+	if err != nil {
+		releaseVolume(ns.Env, ns.Config, ns.State, volume)
+		return state.Volume{}, err
+	}
+	return volume, nil
+}
+
+// publishPersistentVolume mounts the existing backing file of a persistent volume.
+// The first publish mounts the backing file through a loop device; further publishes
+// on the same node share that filesystem through bind mounts, so several pods can
+// use the volume at once. Read-only publishes remount their mount read-only, and binds of
+// later publishes are remounted read-write or read-only, since they would otherwise inherit
+// read-only from the mount they are made from.
+// If the backing file was grown since the filesystem was created, the filesystem
+// is grown to match once mounted. Publishing to a known target path is a no-op.
+// Encrypted volumes are unlocked by the first publish with the passphrase secret, and
+// formatted with it if they were never published before. Volumes are mounted with the hardened
+// mount options, less the requested relaxations the mount policy allows in their namespace;
+// bind mounts share the options, SELinux context and ID mapping of the first mount, so a
+// publish with another SELinux context or ID mapping is refused.
+func (ns *NodeServer) publishPersistentVolume(ctx context.Context, volume state.Volume, targetPath string, accessMode csi.VolumeCapability_AccessMode_Mode, readOnly bool, mount volumeMount, secrets map[string]string) (*csi.NodePublishVolumeResponse, error) {
+	klog.Infof("NodePublishVolume: persistent volumeID=%s, targetPath=%s, accessMode=%s, readOnly=%v", volume.ID, targetPath, accessMode, readOnly)
+
+	volumeOptions, err := mountOptions(ns.Config, volume.Namespace, mount.requested)
+	if err != nil {
+		return nil, err
+	}
+
+	if slices.Contains(volume.TargetPaths, targetPath) {
+		klog.Infof("Volume %s already mounted at %s", volume.ID, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if accessMode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER && len(volume.TargetPaths) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s allows a single writer and is already published at %v", volume.ID, volume.TargetPaths)
+	}
+
+	fsType := cmp.Or(volume.Filesystem, config.DefaultFilesystem)
+	idMap := supportedIDMap(ns.Env, mount.idMap, fsType, volume.ID)
+	if len(volume.TargetPaths) > 0 && mount.seLinuxContext != volume.SELinuxContext {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is mounted with SELinux context %q and cannot be shared with context %q", volume.ID, volume.SELinuxContext, mount.seLinuxContext)
+	}
+	if len(volume.TargetPaths) > 0 && idMap != volume.IDMap {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is mounted with ID mapping %q and cannot be shared with %q", volume.ID, volume.IDMap, idMap)
+	}
+
+	ns.Env.FS.MkdirAll(targetPath, 0755)
+
+	if len(volume.TargetPaths) == 0 {
+		options := []string{"loop"}
+		if volume.Encrypted {
+			if volume, err = ns.unlockPersistentVolume(ctx, volume, fsType, secrets); err != nil {
+				return nil, err
+			}
+			options = nil
+		}
+		options = append(options, volumeOptions...)
+		if mount.seLinuxContext != "" {
+			options = append(options, mount.seLinuxContext)
+		}
+		if idMap != "" {
+			options = append(options, idMap)
+		}
+		volume.SELinuxContext = mount.seLinuxContext
+		volume.IDMap = idMap
+		// Without a mount, the dm-crypt mapping of an encrypted volume is closed again
+		lock := func() {
+			if volume.Encrypted {
+				closeEncryptedVolume(ns.Env, volume.ID)
+			}
+		}
+		device := volumeDevice(ns.Env, volume)
+
+		if volume.ResizePending && growsOffline(fsType) {
+			klog.Infof("Growing filesystem of volume %s to %d bytes", volume.ID, volume.Size)
+			if err := growFilesystem(ctx, ns.Env, fsType, device, targetPath); err != nil {
+				lock()
+				return nil, err
+			}
+			volume.ResizePending = false
+		}
+
+		if err := ns.Env.Mounter.Mount(device, ns.Env.RealPath(targetPath), fsType, options); err != nil {
+			lock()
+			return nil, fmt.Errorf("failed to mount: %v", err)
+		}
+
+		if volume.ResizePending {
+			klog.Infof("Growing filesystem of volume %s to %d bytes", volume.ID, volume.Size)
+			if err := growFilesystem(ctx, ns.Env, fsType, device, targetPath); err != nil {
+				ns.Env.Mounter.Unmount(ns.Env.RealPath(targetPath))
+				lock()
+				return nil, err
+			}
+			volume.ResizePending = false
+		}
+	} else {
+		// The filesystem is already mounted on this node, share it instead of
+		// attaching the backing file to a second loop device
+		if err := ns.Env.Mounter.BindMount(ns.Env.RealPath(volume.TargetPaths[0]), ns.Env.RealPath(targetPath)); err != nil {
+			return nil, fmt.Errorf("failed to mount: %v", err)
+		}
+	}
+
+	// Bind mounts copy the flags of the mount they are made from, so a later publish sets its
+	// access mode explicitly instead of inheriting read-only from an earlier reader.
+	// A bind remount resets the flags of the mount, the mount options of the volume are passed again.
+	if readOnly || len(volume.TargetPaths) > 0 {
+		access := "rw"
+		if readOnly {
+			access = "ro"
+		}
+		if err := ns.Env.Mounter.Remount(ns.Env.RealPath(targetPath), append([]string{"bind", access}, volumeOptions...)); err != nil {
+			ns.Env.Mounter.Unmount(ns.Env.RealPath(targetPath))
+			return nil, fmt.Errorf("failed to remount %s: %v", access, err)
+		}
+	}
+
+	volume.TargetPaths = append(volume.TargetPaths, targetPath)
+	if err := ns.State.PutVolume(volume); err != nil {
+		return nil, err
+	}
+
+	klog.Infof("Volume %s successfully mounted", volume.ID)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// unlockPersistentVolume opens the dm-crypt mapping of an encrypted persistent volume with the
+// passphrase secret. A volume that was never published is formatted with the passphrase first,
+// since the controller never sees it.
+//
+// Returns an error if the secret is missing, the passphrase is wrong, or formatting fails.
+func (ns *NodeServer) unlockPersistentVolume(ctx context.Context, volume state.Volume, fsType string, secrets map[string]string) (state.Volume, error) {
+	passphrase, err := volumePassphrase(volume.ID, secrets)
+	if err != nil {
+		return volume, err
+	}
+	defer clear(passphrase)
+
+	if !volume.Unformatted {
+		return volume, openEncryptedVolume(ctx, ns.Env, volume.BackingFile, volume.ID, passphrase)
+	}
+
+	formatted := volume
+	formatted.Filesystem = fsType
+	if err := formatEncryptedVolume(ctx, ns.Env, formatted, passphrase); err != nil {
+		return volume, status.Error(codes.Internal, err.Error())
+	}
+	// The filesystem is created at the full size of the backing file
+	volume.Unformatted = false
+	volume.ResizePending = false
+	if err := ns.State.PutVolume(volume); err != nil {
+		closeEncryptedVolume(ns.Env, volume.ID)
+		return volume, err
+	}
+	return volume, nil
+}
+
 // NodeUnpublishVolume unmounts the volume and cleans up resources.
-// It unmounts the loop device, removes the backing file, and removes the mount directory.
-// Unmount failures are logged but do not cause the operation to fail.
+// It unmounts the loop device, removes the backing file and its metadata, and removes the mount directory.
+// Backing files of persistent volumes are kept until DeleteVolume, those of retained
+// ephemeral volumes until a pod with the same identity reuses them or the retain TTL passes.
+// Backing files of cache volumes become the new cache image, those of archived volumes are archived.
+// Encrypted persistent volumes are locked once their last target path is unpublished.
+// Unmount failures are logged but do not cause the operation to fail, unless the mount is busy.
 func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
@@ -81,42 +635,91 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	klog.Infof("NodeUnpublishVolume: volumeID=%s, targetPath=%s", volumeID, targetPath)
 
 	// Step 1: Unmount
-	if err := conf.RunCommand("umount", conf.RealPath(targetPath)); err != nil {
-		klog.Warningf("Failed to unmount (may not be mounted): %v", err)
+	if err := ns.Env.Mounter.Unmount(ns.Env.RealPath(targetPath)); err != nil {
+		// Removing the backing file of a busy mount would lose its data, kubelet retries
+		if errors.Is(err, unix.EBUSY) {
+			return nil, status.Errorf(codes.Internal, "volume %s is still in use at %s: %v", volumeID, targetPath, err)
+		}
+		if !mount.IsNotMounted(err) {
+			klog.Warningf("Failed to unmount: %v", err)
+		}
 	}
 
-	// Step 2: Remove backing file
-	backingFile := fmt.Sprintf("%s/%s.img", backingFileDir, volumeID)
-	conf.FS.Remove(backingFile)
+	// Step 2: Remove backing file, or forget the target path of a persistent volume
+	volume, ok := ns.State.GetVolume(volumeID)
+	switch {
+	case ok && !volume.Ephemeral:
+		published := len(volume.TargetPaths)
+		volume.TargetPaths = slices.DeleteFunc(volume.TargetPaths, func(path string) bool { return path == targetPath })
+		// The next first mount may carry another SELinux context and ID mapping
+		if len(volume.TargetPaths) == 0 {
+			volume.SELinuxContext = ""
+			volume.IDMap = ""
+		}
+		if err := ns.State.PutVolume(volume); err != nil {
+			return nil, err
+		}
+		if volume.Encrypted && published > 0 && len(volume.TargetPaths) == 0 {
+			if err := closeEncryptedVolume(ns.Env, volume.ID); err != nil {
+				klog.Warningf("Volume %s: %v", volume.ID, err)
+			}
+		}
+	case ok && volume.ReleasedAt == nil:
+		if err := retireVolume(ns.Env, ns.Config, ns.State, volume); err != nil {
+			return nil, err
+		}
+	case ok:
+		// Already retained by a previous unpublish
+	default:
+		for _, pool := range ns.Config.AllPools() {
+			ns.Env.FS.Remove(backingFilePath(pool.Path, volumeID))
+			ns.Env.FS.Remove(metadataFilePath(backingFilePath(pool.Path, volumeID)))
+		}
+	}
 
 	// Step 3: Remove mount directory
-	conf.FS.Remove(targetPath)
+	ns.Env.FS.Remove(targetPath)
+	expireRetainedVolumes(ns.Env, ns.Config, ns.State)
 
 	klog.Infof("Volume %s successfully unpublished", volumeID)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 // NodeGetCapabilities returns node capabilities.
-// Returns an empty list since ephemeral-only drivers require no special node capabilities.
+// Single-node multi-writer is advertised, since several pods on this node
+// may share a persistent volume.
 func (ns *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: []*csi.NodeServiceCapability{},
+		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+					},
+				},
+			},
+		},
 	}, nil
 }
 
 // NodeGetInfo returns node information including the node ID.
+// The node topology lets the scheduler match capacity reports to this node,
+// and advertises each storage pool so StorageClasses can be restricted to nodes having it.
 func (ns *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	return &csi.NodeGetInfoResponse{
 		NodeId: ns.NodeId,
+		AccessibleTopology: &csi.Topology{
+			Segments: nodeTopology(ns.Config, ns.NodeId),
+		},
 	}, nil
 }
 
-// NodeStageVolume is not implemented since this driver only supports ephemeral volumes.
+// NodeStageVolume is not implemented since volumes are mounted directly on publish.
 func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	return nil, fmt.Errorf("not implemented")
 }
 
-// NodeUnstageVolume is not implemented since this driver only supports ephemeral volumes.
+// NodeUnstageVolume is not implemented since volumes are mounted directly on publish.
 func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	return nil, fmt.Errorf("not implemented")
 }
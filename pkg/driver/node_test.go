@@ -3,41 +3,87 @@ package driver
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/command"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// newTestState returns an empty state store in the filesystem of env.
+func newTestState(t *testing.T, env *conf.Env) *state.Store {
+	store, err := state.Open(env.FS, "/var/lib/csi-loop/state.json")
+	require.NoError(t, err)
+	return store
+}
+
+// mockCommands hands the commands run in env to run instead of running them.
+// They write nothing to stdout.
+func mockCommands(env *conf.Env, run func(name string, args ...string) error) {
+	env.Runner = &command.Fake{Script: func(input []byte, name string, args ...string) (string, error) {
+		return "", run(name, args...)
+	}}
+}
+
 func TestNodeServer_GetInfo(t *testing.T) {
-	ns := &NodeServer{NodeId: "test-node-123"}
+	t.Parallel()
+
+	cfg := config.Default()
+	cfg.Pools = map[string]config.Pool{
+		"nvme": {Path: "/mnt/nvme"},
+		"sata": {Path: "/mnt/sata"},
+	}
+	env := conftest.New()
+	env.NodeId = "test-node-123"
+	ns := NewNodeServer(env, cfg, nil, nil)
 
 	resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
 
 	require.NoError(t, err)
 	assert.Equal(t, "test-node-123", resp.NodeId)
+	assert.Equal(t, map[string]string{
+		topologyKey:                 "test-node-123",
+		"pool.loop.csi.k8s.io/nvme": "true",
+		"pool.loop.csi.k8s.io/sata": "true",
+	}, resp.AccessibleTopology.Segments)
 }
 
 func TestNodeServer_GetCapabilities(t *testing.T) {
+	t.Parallel()
+
 	ns := &NodeServer{NodeId: "test-node"}
 
 	resp, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
 
 	require.NoError(t, err)
-	assert.Empty(t, resp.Capabilities, "ephemeral-only driver should have no node capabilities")
+	require.Len(t, resp.Capabilities, 1)
+	assert.Equal(t, csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER, resp.Capabilities[0].GetRpc().GetType())
 }
 
 func TestNodeServer_PublishVolume(t *testing.T) {
+	t.Parallel()
+
 	tests := []struct {
 		name            string
 		volumeID        string
 		size            string
 		targetPath      string
+		accessMode      csi.VolumeCapability_AccessMode_Mode
 		mockCommands    map[string]error
+		canceled        bool
 		wantErr         bool
 		wantErrContains string
 	}{
@@ -47,9 +93,9 @@ func TestNodeServer_PublishVolume(t *testing.T) {
 			size:       "1Gi",
 			targetPath: "/mnt/test",
 			mockCommands: map[string]error{
-				"truncate":    nil,
-				"mkfs.btrfs":  nil,
-				"mount":       nil,
+				"truncate":   nil,
+				"mkfs.btrfs": nil,
+				"mount":      nil,
 			},
 			wantErr: false,
 		},
@@ -59,9 +105,9 @@ func TestNodeServer_PublishVolume(t *testing.T) {
 			size:       "500Mi",
 			targetPath: "/mnt/test2",
 			mockCommands: map[string]error{
-				"truncate":    nil,
-				"mkfs.btrfs":  nil,
-				"mount":       nil,
+				"truncate":   nil,
+				"mkfs.btrfs": nil,
+				"mount":      nil,
 			},
 			wantErr: false,
 		},
@@ -73,6 +119,36 @@ func TestNodeServer_PublishVolume(t *testing.T) {
 			wantErr:         true,
 			wantErrContains: "invalid size format",
 		},
+		{
+			name:       "publishes default size when size is omitted",
+			volumeID:   "vol-default",
+			targetPath: "/mnt/default",
+		},
+		{
+			name:            "fails on size below filesystem minimum",
+			volumeID:        "vol-tiny",
+			size:            "10Mi",
+			targetPath:      "/mnt/tiny",
+			wantErr:         true,
+			wantErrContains: "size 10Mi is out of range for pool default with btrfs, allowed at least 109Mi",
+		},
+		{
+			name:            "fails on multi-node access mode",
+			volumeID:        "vol-multi",
+			size:            "1Gi",
+			targetPath:      "/mnt/multi",
+			accessMode:      csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+			wantErr:         true,
+			wantErrContains: "access mode MULTI_NODE_MULTI_WRITER is not supported",
+		},
+		{
+			name:            "fails when node budget is exhausted",
+			volumeID:        "vol-huge",
+			size:            "2Ti",
+			targetPath:      "/mnt/huge",
+			wantErr:         true,
+			wantErrContains: "insufficient capacity in pool default: used 0, requested 2Ti, available 1Ti",
+		},
 		{
 			name:       "fails when truncate fails",
 			volumeID:   "vol-fail",
@@ -96,6 +172,26 @@ func TestNodeServer_PublishVolume(t *testing.T) {
 			wantErr:         true,
 			wantErrContains: "failed to format",
 		},
+		{
+			name:       "reports the stderr of failed commands",
+			volumeID:   "vol-mkfs-stderr",
+			size:       "1Gi",
+			targetPath: "/mnt/mkfs-stderr",
+			mockCommands: map[string]error{
+				"mkfs.btrfs": &command.Error{Name: "mkfs.btrfs", Stderr: "ERROR: not enough free space\n", Err: fmt.Errorf("exit status 1")},
+			},
+			wantErr:         true,
+			wantErrContains: "failed to format: mkfs.btrfs: exit status 1: ERROR: not enough free space",
+		},
+		{
+			name:            "stops running commands when the request is canceled",
+			volumeID:        "vol-canceled",
+			size:            "1Gi",
+			targetPath:      "/mnt/canceled",
+			canceled:        true,
+			wantErr:         true,
+			wantErrContains: "failed to format: mkfs.btrfs: context canceled",
+		},
 		{
 			name:       "fails when mount fails",
 			volumeID:   "vol-mount-fail",
@@ -113,34 +209,43 @@ func TestNodeServer_PublishVolume(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Setup mock
-			originalRunCommand := conf.RunCommand
-			defer func() { conf.RunCommand = originalRunCommand }()
+			t.Parallel()
+
+			env := conftest.New()
 
-			conf.RunCommand = func(name string, args ...string) error {
+			// Setup mock
+			mockCommands(env, func(name string, args ...string) error {
 				if tt.mockCommands != nil {
 					if err, ok := tt.mockCommands[name]; ok {
 						return err
 					}
 				}
 				return nil
-			}
+			})
+
+			mockStatfs(env, 1<<40, 1<<40)
 
-			// Clean up test files
-			backingFile := fmt.Sprintf("%s/%s.img", backingFileDir, tt.volumeID)
-			defer conf.FS.Remove(backingFile)
-			defer conf.FS.Remove(tt.targetPath)
+			accessMode := tt.accessMode
+			if accessMode == csi.VolumeCapability_AccessMode_UNKNOWN {
+				accessMode = csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+			}
 
-			ns := &NodeServer{NodeId: "test-node"}
+			ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
 			req := &csi.NodePublishVolumeRequest{
-				VolumeId:   tt.volumeID,
-				TargetPath: tt.targetPath,
+				VolumeId:         tt.volumeID,
+				TargetPath:       tt.targetPath,
+				VolumeCapability: mountCapability(accessMode),
 				VolumeContext: map[string]string{
 					"size": tt.size,
 				},
 			}
 
-			resp, err := ns.NodePublishVolume(context.Background(), req)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.canceled {
+				cancel()
+			}
+			resp, err := ns.NodePublishVolume(ctx, req)
 
 			if tt.wantErr {
 				require.Error(t, err)
@@ -151,11 +256,11 @@ func TestNodeServer_PublishVolume(t *testing.T) {
 				assert.NotNil(t, resp)
 
 				// Verify directories were created
-				exists, err := afero.DirExists(conf.FS, backingFileDir)
+				exists, err := afero.DirExists(env.FS, config.DefaultPoolPath)
 				require.NoError(t, err)
 				assert.True(t, exists, "backing file directory should exist")
 
-				exists, err = afero.DirExists(conf.FS, tt.targetPath)
+				exists, err = afero.DirExists(env.FS, tt.targetPath)
 				require.NoError(t, err)
 				assert.True(t, exists, "target path should exist")
 			}
@@ -163,14 +268,73 @@ func TestNodeServer_PublishVolume(t *testing.T) {
 	}
 }
 
+func TestNodeServer_PublishVolumeFailedMount(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+	}{
+		{
+			name:          "does not write a volume back to its cache",
+			volumeContext: map[string]string{cacheKeyParameter: "go-mod"},
+		},
+		{
+			name:          "does not archive a volume",
+			volumeContext: map[string]string{archiveOnDeleteParameter: "true"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			mockCommands(env, func(name string, args ...string) error {
+				switch name {
+				case "truncate":
+					return afero.WriteFile(env.FS, args[2], nil, 0644)
+				case "mount":
+					return fmt.Errorf("mount error")
+				}
+				return nil
+			})
+			mockStatfs(env, 1<<40, 1<<40)
+
+			volumeContext := map[string]string{"size": "200Mi", podNamespaceKey: "ci"}
+			for key, value := range tt.volumeContext {
+				volumeContext[key] = value
+			}
+			ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:         "csi-1",
+				TargetPath:       "/mnt/build",
+				VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				VolumeContext:    volumeContext,
+			})
+			require.ErrorContains(t, err, "failed to mount")
+
+			_, ok := ns.State.GetVolume("csi-1")
+			assert.False(t, ok)
+			assert.Empty(t, ns.State.Caches())
+			images, _ := afero.Glob(env.FS, "/var/lib/csi-loop/*/*.img")
+			assert.Empty(t, images, "volume should be neither cached nor archived")
+			exists, _ := afero.Exists(env.FS, backingFilePath(config.DefaultPoolPath, "csi-1"))
+			assert.False(t, exists, "backing file should be removed")
+		})
+	}
+}
+
 func TestNodeServer_UnpublishVolume(t *testing.T) {
+	t.Parallel()
+
 	tests := []struct {
-		name         string
-		volumeID     string
-		targetPath   string
-		setupFiles   bool
-		mockUmount   error
-		wantErr      bool
+		name       string
+		volumeID   string
+		targetPath string
+		setupFiles bool
+		mockUmount error
+		wantErr    bool
 	}{
 		{
 			name:       "successfully unpublishes volume",
@@ -196,30 +360,39 @@ func TestNodeServer_UnpublishVolume(t *testing.T) {
 			mockUmount: fmt.Errorf("not mounted"),
 			wantErr:    false,
 		},
+		{
+			name:       "fails while the mount is busy",
+			volumeID:   "vol-busy",
+			targetPath: "/mnt/test4",
+			setupFiles: true,
+			mockUmount: &os.PathError{Op: "umount", Path: "/mnt/test4", Err: unix.EBUSY},
+			wantErr:    true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Setup mock
-			originalRunCommand := conf.RunCommand
-			defer func() { conf.RunCommand = originalRunCommand }()
+			t.Parallel()
+
+			env := conftest.New()
 
-			conf.RunCommand = func(name string, args ...string) error {
+			// Setup mock
+			mockCommands(env, func(name string, args ...string) error {
 				if name == "umount" {
 					return tt.mockUmount
 				}
 				return nil
-			}
+			})
 
 			// Setup test files if needed
-			backingFile := fmt.Sprintf("%s/%s.img", backingFileDir, tt.volumeID)
+			backingFile := fmt.Sprintf("%s/%s.img", config.DefaultPoolPath, tt.volumeID)
 			if tt.setupFiles {
-				conf.FS.MkdirAll(backingFileDir, 0755)
-				afero.WriteFile(conf.FS, backingFile, []byte("fake-image"), 0644)
-				conf.FS.MkdirAll(tt.targetPath, 0755)
+				env.FS.MkdirAll(config.DefaultPoolPath, 0755)
+				afero.WriteFile(env.FS, backingFile, []byte("fake-image"), 0644)
+				env.FS.MkdirAll(tt.targetPath, 0755)
 			}
 
-			ns := &NodeServer{NodeId: "test-node"}
+			ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
 			req := &csi.NodeUnpublishVolumeRequest{
 				VolumeId:   tt.volumeID,
 				TargetPath: tt.targetPath,
@@ -229,22 +402,342 @@ func TestNodeServer_UnpublishVolume(t *testing.T) {
 
 			if tt.wantErr {
 				require.Error(t, err)
+
+				// Verify the backing file of the busy mount was kept
+				exists, _ := afero.Exists(env.FS, backingFile)
+				assert.True(t, exists, "backing file should be kept")
+				env.FS.Remove(backingFile)
 			} else {
 				require.NoError(t, err)
 				assert.NotNil(t, resp)
 
 				// Verify files were removed
-				exists, _ := afero.Exists(conf.FS, backingFile)
+				exists, _ := afero.Exists(env.FS, backingFile)
 				assert.False(t, exists, "backing file should be removed")
 
-				exists, _ = afero.Exists(conf.FS, tt.targetPath)
+				exists, _ = afero.Exists(env.FS, tt.targetPath)
 				assert.False(t, exists, "target path should be removed")
 			}
 		})
 	}
 }
 
+func TestNodeServer_EphemeralVolumeQuota(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	mockCommands(env, func(name string, args ...string) error {
+		return nil
+	})
+
+	mockStatfs(env, 1<<40, 1<<40)
+
+	maxVolumes := 1
+	cfg := config.Default()
+	cfg.NamespaceQuotas.Default.MaxVolumes = &maxVolumes
+
+	ns := NewNodeServer(env, cfg, newTestState(t, env), nil)
+	publish := func(volumeID, targetPath string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       targetPath,
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeContext: map[string]string{
+				"size":            "200Mi",
+				podNamespaceKey:   "team-a",
+				podNameKey:        "web-0",
+				podUIDKey:         "uid-0",
+				serviceAccountKey: "web",
+			},
+		})
+		return err
+	}
+
+	// First volume is recorded with its pod and counts towards the quota
+	require.NoError(t, publish("csi-1", "/mnt/eph-1"))
+	volume, ok := ns.State.GetVolume("csi-1")
+	require.True(t, ok)
+	assert.True(t, volume.Ephemeral)
+	assert.Equal(t, "team-a", volume.Namespace)
+	assert.Equal(t, "web-0", volume.PodName)
+	assert.Equal(t, "uid-0", volume.PodUID)
+	assert.Equal(t, []string{"/mnt/eph-1"}, volume.TargetPaths)
+
+	// The pod is written to the metadata file next to the backing file
+	metadataFile := metadataFilePath(backingFilePath(config.DefaultPoolPath, "csi-1"))
+	data, err := afero.ReadFile(env.FS, metadataFile)
+	require.NoError(t, err)
+	var metadata volumeMetadata
+	require.NoError(t, json.Unmarshal(data, &metadata))
+	assert.True(t, volume.CreatedAt.Equal(metadata.CreatedAt))
+	metadata.CreatedAt = time.Time{}
+	assert.Equal(t, volumeMetadata{
+		VolumeID:       "csi-1",
+		Namespace:      "team-a",
+		PodName:        "web-0",
+		PodUID:         "uid-0",
+		ServiceAccount: "web",
+		RequestedSize:  "200Mi",
+		Size:           200 << 20,
+		Filesystem:     "btrfs",
+	}, metadata)
+
+	// Publishing again to the same target is a no-op
+	require.NoError(t, publish("csi-1", "/mnt/eph-1"))
+
+	// Second volume exceeds the quota
+	err = publish("csi-2", "/mnt/eph-2")
+	require.Error(t, err)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Contains(t, err.Error(), "namespace team-a exceeds its volume quota: 1 of 1 volumes in use")
+	_, ok = ns.State.GetVolume("csi-2")
+	assert.False(t, ok)
+
+	// Unpublishing releases the quota
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-1", TargetPath: "/mnt/eph-1"})
+	require.NoError(t, err)
+	_, ok = ns.State.GetVolume("csi-1")
+	assert.False(t, ok)
+	exists, _ := afero.Exists(env.FS, backingFilePath(config.DefaultPoolPath, "csi-1"))
+	assert.False(t, exists, "backing file should be removed")
+	exists, _ = afero.Exists(env.FS, metadataFile)
+	assert.False(t, exists, "metadata file should be removed")
+
+	require.NoError(t, publish("csi-2", "/mnt/eph-2"))
+}
+
+func TestNodeServer_PersistentVolume(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		resizePending bool
+		filesystem    string
+		accessMode    csi.VolumeCapability_AccessMode_Mode
+		readOnly      bool
+		wantCommands  []string
+	}{
+		{
+			name:         "mounts existing backing file without formatting",
+			accessMode:   csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			wantCommands: []string{"[mount -o loop,nosuid,nodev /var/lib/csi-loop/pvc-123.img /mnt/pvc]", "[umount /mnt/pvc]"},
+		},
+		{
+			name:          "grows filesystem when resize is pending",
+			resizePending: true,
+			accessMode:    csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			wantCommands: []string{
+				"[mount -o loop,nosuid,nodev /var/lib/csi-loop/pvc-123.img /mnt/pvc]",
+				"[btrfs filesystem resize max /mnt/pvc]",
+				"[umount /mnt/pvc]",
+			},
+		},
+		{
+			name:          "grows xfs filesystem once mounted",
+			resizePending: true,
+			filesystem:    "xfs",
+			accessMode:    csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			wantCommands: []string{
+				"[mount -o loop,nosuid,nodev /var/lib/csi-loop/pvc-123.img /mnt/pvc]",
+				"[xfs_growfs /mnt/pvc]",
+				"[umount /mnt/pvc]",
+			},
+		},
+		{
+			name:          "grows ext4 filesystem before mounting",
+			resizePending: true,
+			filesystem:    "ext4",
+			accessMode:    csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			wantCommands: []string{
+				"[e2fsck -f -p /var/lib/csi-loop/pvc-123.img]",
+				"[resize2fs /var/lib/csi-loop/pvc-123.img]",
+				"[mount -o loop,nosuid,nodev /var/lib/csi-loop/pvc-123.img /mnt/pvc]",
+				"[umount /mnt/pvc]",
+			},
+		},
+		{
+			name:       "remounts read-only for reader access mode",
+			accessMode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+			wantCommands: []string{
+				"[mount -o loop,nosuid,nodev /var/lib/csi-loop/pvc-123.img /mnt/pvc]",
+				"[mount -o remount,bind,ro,nosuid,nodev /mnt/pvc]",
+				"[umount /mnt/pvc]",
+			},
+		},
+		{
+			name:       "remounts read-only when requested",
+			accessMode: csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+			readOnly:   true,
+			wantCommands: []string{
+				"[mount -o loop,nosuid,nodev /var/lib/csi-loop/pvc-123.img /mnt/pvc]",
+				"[mount -o remount,bind,ro,nosuid,nodev /mnt/pvc]",
+				"[umount /mnt/pvc]",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+
+			// Setup mock
+			var commands []string
+			mockCommands(env, func(name string, args ...string) error {
+				commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+				return nil
+			})
+
+			// Setup persistent volume
+			store := newTestState(t, env)
+			backingFile := backingFilePath(config.DefaultPoolPath, "pvc-123")
+			require.NoError(t, afero.WriteFile(env.FS, backingFile, []byte("fake-image"), 0644))
+			require.NoError(t, store.PutVolume(state.Volume{
+				ID:            "pvc-123",
+				BackingFile:   backingFile,
+				Size:          1 << 30,
+				ResizePending: tt.resizePending,
+				Filesystem:    tt.filesystem,
+			}))
+
+			ns := NewNodeServer(env, config.Default(), store, nil)
+			req := &csi.NodePublishVolumeRequest{
+				VolumeId:         "pvc-123",
+				TargetPath:       "/mnt/pvc",
+				VolumeCapability: mountCapability(tt.accessMode),
+				Readonly:         tt.readOnly,
+			}
+
+			_, err := ns.NodePublishVolume(context.Background(), req)
+			require.NoError(t, err)
+
+			volume, _ := store.GetVolume("pvc-123")
+			assert.Equal(t, []string{"/mnt/pvc"}, volume.TargetPaths)
+			assert.False(t, volume.ResizePending)
+
+			// Publishing to the same target again is a no-op
+			_, err = ns.NodePublishVolume(context.Background(), req)
+			require.NoError(t, err)
+
+			_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   "pvc-123",
+				TargetPath: "/mnt/pvc",
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.wantCommands, commands)
+
+			volume, _ = store.GetVolume("pvc-123")
+			assert.Empty(t, volume.TargetPaths)
+
+			exists, _ := afero.Exists(env.FS, backingFile)
+			assert.True(t, exists, "persistent backing file should be kept")
+		})
+	}
+}
+
+func TestNodeServer_SharedPersistentVolume(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		accessMode   csi.VolumeCapability_AccessMode_Mode
+		wantCode     codes.Code
+		wantCommands []string
+	}{
+		{
+			name:         "shares filesystem with second pod through bind mount",
+			accessMode:   csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+			wantCommands: []string{"[mount --bind /mnt/pod-a /mnt/pod-b]", "[mount -o remount,bind,rw,nosuid,nodev /mnt/pod-b]"},
+		},
+		{
+			name:       "refuses second publish of single-writer volume",
+			accessMode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+			wantCode:   codes.FailedPrecondition,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+
+			// Setup mock
+			var commands []string
+			mockCommands(env, func(name string, args ...string) error {
+				commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+				return nil
+			})
+
+			// Setup persistent volume already mounted for another pod
+			store := newTestState(t, env)
+			require.NoError(t, store.PutVolume(state.Volume{
+				ID:          "pvc-123",
+				BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-123"),
+				TargetPaths: []string{"/mnt/pod-a"},
+			}))
+
+			ns := NewNodeServer(env, config.Default(), store, nil)
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:         "pvc-123",
+				TargetPath:       "/mnt/pod-b",
+				VolumeCapability: mountCapability(tt.accessMode),
+			})
+
+			assert.Equal(t, tt.wantCommands, commands)
+
+			if tt.wantCode != codes.OK {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+
+			require.NoError(t, err)
+			volume, _ := store.GetVolume("pvc-123")
+			assert.Equal(t, []string{"/mnt/pod-a", "/mnt/pod-b"}, volume.TargetPaths)
+		})
+	}
+}
+
+func TestNodeServer_ReadOnlyThenWritablePublish(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		return nil
+	})
+
+	store := newTestState(t, env)
+	require.NoError(t, store.PutVolume(state.Volume{ID: "pvc-123", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-123")}))
+	ns := NewNodeServer(env, config.Default(), store, nil)
+	publish := func(targetPath string, readOnly bool) {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         "pvc-123",
+			TargetPath:       targetPath,
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER),
+			Readonly:         readOnly,
+		})
+		require.NoError(t, err)
+	}
+
+	// The reader makes its mount read-only, the bind of the writer must not inherit it
+	publish("/mnt/reader", true)
+	publish("/mnt/writer", false)
+	assert.Equal(t, []string{
+		"[mount -o loop,nosuid,nodev /var/lib/csi-loop/pvc-123.img /mnt/reader]",
+		"[mount -o remount,bind,ro,nosuid,nodev /mnt/reader]",
+		"[mount --bind /mnt/reader /mnt/writer]",
+		"[mount -o remount,bind,rw,nosuid,nodev /mnt/writer]",
+	}, commands)
+}
+
 func TestNodeServer_UnimplementedMethods(t *testing.T) {
+	t.Parallel()
+
 	ns := &NodeServer{NodeId: "test-node"}
 
 	t.Run("NodeStageVolume returns not implemented", func(t *testing.T) {
@@ -0,0 +1,94 @@
+package driver
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// candidate is a pool eligible for a new volume.
+type candidate struct {
+	pool      config.Pool
+	available int64
+	volumes   int
+}
+
+// selectPool returns the pool a new volume of the given size is placed in.
+// A pool named by the volume is always used. Otherwise the configured placement
+// strategy chooses among the healthy pools with room for the volume, and without
+// a strategy the default pool is used.
+//
+// Returns an InvalidArgument error for unknown pools, or a ResourceExhausted error
+// if no pool is eligible.
+func selectPool(env *conf.Env, cfg *config.Config, store *state.Store, name string, size int64) (config.Pool, error) {
+	if name != "" || cfg.Placement == "" {
+		return resolvePool(cfg, name)
+	}
+
+	candidates := eligiblePools(env, cfg, store, size)
+	if len(candidates) == 0 {
+		return config.Pool{}, status.Errorf(codes.ResourceExhausted, "no healthy pool has room for %s", formatBytes(size))
+	}
+
+	var chosen candidate
+	switch cfg.Placement {
+	case config.PlacementRoundRobin:
+		chosen = candidates[(env.Placements.Add(1)-1)%uint64(len(candidates))]
+	case config.PlacementLeastVolumes:
+		chosen = slices.MinFunc(candidates, func(a, b candidate) int { return cmp.Compare(a.volumes, b.volumes) })
+	default:
+		chosen = slices.MaxFunc(candidates, func(a, b candidate) int { return cmp.Compare(a.available, b.available) })
+	}
+
+	klog.Infof("Placing volume of %s in pool %s (%s)", formatBytes(size), chosen.pool.Name, cfg.Placement)
+	return chosen.pool, nil
+}
+
+// eligiblePools returns the pools that are healthy and have room for a volume of the given size,
+// sorted by name. Pools whose directory is not writable, e.g. on a read-only filesystem,
+// or whose filesystem cannot be inspected are excluded, as are full pools.
+func eligiblePools(env *conf.Env, cfg *config.Config, store *state.Store, size int64) []candidate {
+	volumes := map[string]int{}
+	for _, volume := range store.Volumes() {
+		volumes[cmp.Or(volume.Pool, config.DefaultPoolName)]++
+	}
+
+	var candidates []candidate
+	for _, pool := range cfg.AllPools() {
+		if err := checkPoolHealth(env, pool); err != nil {
+			klog.Warningf("Excluding pool %s from placement: %v", pool.Name, err)
+			continue
+		}
+
+		available, err := availableCapacity(env, cfg, pool)
+		if err != nil {
+			klog.Warningf("Excluding pool %s from placement: failed to compute capacity: %v", pool.Name, err)
+			continue
+		}
+		if available < size {
+			klog.V(5).Infof("Excluding pool %s from placement: %s available", pool.Name, formatBytes(available))
+			continue
+		}
+
+		candidates = append(candidates, candidate{pool: pool, available: available, volumes: volumes[pool.Name]})
+	}
+	return candidates
+}
+
+// checkPoolHealth verifies that backing files can be created in the directory of a pool.
+func checkPoolHealth(env *conf.Env, pool config.Pool) error {
+	if err := env.FS.MkdirAll(pool.Path, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	if err := env.Writable(pool.Path); err != nil {
+		return fmt.Errorf("directory is not writable: %v", err)
+	}
+	return nil
+}
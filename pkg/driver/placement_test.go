@@ -0,0 +1,129 @@
+// Automatic pool placement tests.
+package driver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mockPools makes each pool directory of env report the given free bytes and
+// fails the writability check of the read-only ones.
+func mockPools(env *conf.Env, free map[string]int64, readOnly ...string) {
+	env.Statfs = func(path string) (int64, int64, error) {
+		return 100 << 10, free[path], nil
+	}
+	env.Writable = func(path string) error {
+		for _, dir := range readOnly {
+			if path == dir {
+				return fmt.Errorf("read-only file system")
+			}
+		}
+		return nil
+	}
+}
+
+func TestSelectPool(t *testing.T) {
+	t.Parallel()
+
+	pools := map[string]config.Pool{
+		"a": {Path: "/mnt/a"},
+		"b": {Path: "/mnt/b"},
+		"c": {Path: "/mnt/c"},
+	}
+
+	tests := []struct {
+		name      string
+		placement string
+		pool      string
+		size      int64
+		free      map[string]int64
+		readOnly  []string
+		want      []string
+		wantCode  codes.Code
+	}{
+		{
+			name:      "picks pool with most free space",
+			placement: config.PlacementMostFreeSpace,
+			size:      1 << 10,
+			free:      map[string]int64{"/mnt/a": 10 << 10, "/mnt/b": 30 << 10, "/mnt/c": 20 << 10},
+			want:      []string{"b"},
+		},
+		{
+			name:      "picks pool with fewest volumes",
+			placement: config.PlacementLeastVolumes,
+			size:      1 << 10,
+			free:      map[string]int64{"/mnt/a": 10 << 10, "/mnt/b": 10 << 10, "/mnt/c": 10 << 10},
+			want:      []string{"c"},
+		},
+		{
+			name:      "cycles through pools",
+			placement: config.PlacementRoundRobin,
+			size:      1 << 10,
+			free:      map[string]int64{"/mnt/a": 10 << 10, "/mnt/b": 10 << 10, "/mnt/c": 10 << 10},
+			want:      []string{"a", "b", "c", "a"},
+		},
+		{
+			name:      "skips read-only and full pools",
+			placement: config.PlacementRoundRobin,
+			size:      5 << 10,
+			free:      map[string]int64{"/mnt/a": 10 << 10, "/mnt/b": 10 << 10, "/mnt/c": 1 << 10},
+			readOnly:  []string{"/mnt/a"},
+			want:      []string{"b", "b"},
+		},
+		{
+			name:      "honors pool selected by volume",
+			placement: config.PlacementMostFreeSpace,
+			pool:      "a",
+			size:      1 << 10,
+			free:      map[string]int64{"/mnt/a": 10 << 10, "/mnt/b": 30 << 10},
+			want:      []string{"a"},
+		},
+		{
+			name:      "fails without eligible pool",
+			placement: config.PlacementMostFreeSpace,
+			size:      50 << 10,
+			free:      map[string]int64{"/mnt/a": 10 << 10, "/mnt/b": 10 << 10, "/mnt/c": 10 << 10},
+			wantCode:  codes.ResourceExhausted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			mockPools(env, tt.free, tt.readOnly...)
+
+			store := newTestState(t, env)
+			require.NoError(t, store.PutVolume(state.Volume{ID: "pvc-1", Pool: "a"}))
+			require.NoError(t, store.PutVolume(state.Volume{ID: "pvc-2", Pool: "a"}))
+			require.NoError(t, store.PutVolume(state.Volume{ID: "pvc-3", Pool: "b"}))
+
+			cfg := &config.Config{OvercommitRatio: 1.0, Pools: pools, Placement: tt.placement}
+
+			if tt.wantCode != codes.OK {
+				_, err := selectPool(env, cfg, store, tt.pool, tt.size)
+				require.Error(t, err)
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+
+			var got []string
+			for range tt.want {
+				pool, err := selectPool(env, cfg, store, tt.pool, tt.size)
+				require.NoError(t, err)
+				got = append(got, pool.Name)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
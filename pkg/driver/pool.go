@@ -0,0 +1,100 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// poolParameter is the volume attribute, or StorageClass parameter, selecting the storage pool.
+const poolParameter = "pool"
+
+// poolTopologyPrefix prefixes the topology keys advertising the pools of a node,
+// e.g. pool.loop.csi.k8s.io/nvme=true.
+const poolTopologyPrefix = "pool.loop.csi.k8s.io/"
+
+// snapshotSubdir is the directory inside a pool holding snapshot images.
+const snapshotSubdir = "snapshots"
+
+// cacheSubdir is the directory inside a pool holding cache images.
+const cacheSubdir = "caches"
+
+// archiveSubdir is the directory inside a pool holding archived volumes.
+const archiveSubdir = "archive"
+
+// warmSubdir is the directory inside a pool holding pre-formatted images.
+const warmSubdir = "warm"
+
+// wipeSubdir is the directory inside a pool holding backing files queued for wiping.
+const wipeSubdir = "wipe"
+
+// resolvePool returns the pool with the given name, or the default pool if the name is empty.
+//
+// Returns an InvalidArgument error if the pool is unknown or no default pool is configured.
+func resolvePool(cfg *config.Config, name string) (config.Pool, error) {
+	pool, ok := cfg.Pool(name)
+	if ok {
+		return pool, nil
+	}
+
+	var names []string
+	for _, pool := range cfg.AllPools() {
+		names = append(names, pool.Name)
+	}
+	if name == "" {
+		return config.Pool{}, status.Errorf(codes.InvalidArgument, "%s attribute is required, available pools: %v", poolParameter, names)
+	}
+	return config.Pool{}, status.Errorf(codes.InvalidArgument, "unknown pool %s, available pools: %v", name, names)
+}
+
+// poolTopologyKey returns the topology key advertising the given pool.
+func poolTopologyKey(pool string) string {
+	return poolTopologyPrefix + pool
+}
+
+// nodeTopology returns the topology segments of this node: the node itself and each of its pools.
+func nodeTopology(cfg *config.Config, nodeID string) map[string]string {
+	segments := map[string]string{topologyKey: nodeID}
+	for _, pool := range cfg.AllPools() {
+		segments[poolTopologyKey(pool.Name)] = "true"
+	}
+	return segments
+}
+
+// volumeTopology returns the topology of a volume living in the given pool of this node.
+func volumeTopology(nodeID, pool string) *csi.Topology {
+	return &csi.Topology{Segments: map[string]string{
+		topologyKey:           nodeID,
+		poolTopologyKey(pool): "true",
+	}}
+}
+
+// matchesTopology reports whether every segment of the topology is satisfied by the node segments.
+func matchesTopology(topology *csi.Topology, node map[string]string) bool {
+	for key, value := range topology.GetSegments() {
+		if node[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// backingFilePath returns the path of the backing image for a volume in the given directory.
+func backingFilePath(dir, volumeID string) string {
+	return fmt.Sprintf("%s/%s.img", dir, volumeID)
+}
+
+// cacheFilePath returns the path of the image of a cache in the given pool directory.
+func cacheFilePath(dir, key string) string {
+	return backingFilePath(filepath.Join(dir, cacheSubdir), strings.ReplaceAll(key, "/", "_"))
+}
+
+// snapshotFilePath returns the path of the image of a snapshot taken in the given pool directory.
+func snapshotFilePath(dir, snapshotID string) string {
+	return backingFilePath(filepath.Join(dir, snapshotSubdir), snapshotID)
+}
@@ -0,0 +1,91 @@
+// Storage pool selection and topology tests.
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResolvePool(t *testing.T) {
+	t.Parallel()
+
+	pools := map[string]config.Pool{
+		"nvme": {Path: "/mnt/nvme"},
+		"sata": {Path: "/mnt/sata", Filesystem: "xfs"},
+	}
+
+	tests := []struct {
+		name            string
+		cfg             *config.Config
+		pool            string
+		wantPath        string
+		wantFilesystem  string
+		wantErrContains string
+	}{
+		{
+			name:           "uses implicit pool without configured pools",
+			cfg:            config.Default(),
+			wantPath:       config.DefaultPoolPath,
+			wantFilesystem: "btrfs",
+		},
+		{
+			name:           "selects named pool",
+			cfg:            &config.Config{OvercommitRatio: 1.0, Pools: pools},
+			pool:           "sata",
+			wantPath:       "/mnt/sata",
+			wantFilesystem: "xfs",
+		},
+		{
+			name:           "falls back to default pool",
+			cfg:            &config.Config{OvercommitRatio: 1.0, Pools: pools, DefaultPool: "nvme"},
+			wantPath:       "/mnt/nvme",
+			wantFilesystem: "btrfs",
+		},
+		{
+			name:            "requires pool without default pool",
+			cfg:             &config.Config{OvercommitRatio: 1.0, Pools: pools},
+			wantErrContains: "pool attribute is required, available pools: [nvme sata]",
+		},
+		{
+			name:            "rejects unknown pool",
+			cfg:             config.Default(),
+			pool:            "nvme",
+			wantErrContains: "unknown pool nvme, available pools: [default]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			pool, err := resolvePool(tt.cfg, tt.pool)
+
+			if tt.wantErrContains != "" {
+				require.Error(t, err)
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPath, pool.Path)
+			assert.Equal(t, tt.wantFilesystem, pool.Filesystem)
+		})
+	}
+}
+
+func TestMatchesTopology(t *testing.T) {
+	t.Parallel()
+
+	node := map[string]string{topologyKey: "node-1", poolTopologyKey("nvme"): "true"}
+
+	assert.True(t, matchesTopology(&csi.Topology{Segments: map[string]string{topologyKey: "node-1"}}, node))
+	assert.True(t, matchesTopology(&csi.Topology{Segments: map[string]string{poolTopologyKey("nvme"): "true"}}, node))
+	assert.False(t, matchesTopology(&csi.Topology{Segments: map[string]string{topologyKey: "node-2"}}, node))
+	assert.False(t, matchesTopology(&csi.Topology{Segments: map[string]string{poolTopologyKey("sata"): "true"}}, node))
+}
@@ -0,0 +1,51 @@
+package driver
+
+import (
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkLimits verifies that a new volume fits into the budget of its pool and the
+// quota of its namespace. Callers allocating the volume afterwards must hold env.Allocation.
+func checkLimits(env *conf.Env, cfg *config.Config, store *state.Store, pool config.Pool, namespace string, requested int64) error {
+	if err := checkBudget(env, cfg, store, pool, requested); err != nil {
+		return err
+	}
+	return checkQuota(cfg, store, namespace, requested)
+}
+
+// checkQuota verifies that a new volume fits into the quota of its namespace.
+// Volumes without a namespace, e.g. when pod info is unavailable, are not limited.
+//
+// Returns a ResourceExhausted error if the namespace would exceed its volume count
+// or storage limit on this node.
+func checkQuota(cfg *config.Config, store *state.Store, namespace string, requested int64) error {
+	if namespace == "" {
+		return nil
+	}
+
+	var used int64
+	var count int
+	for _, volume := range append(store.Volumes(), store.Reservations()...) {
+		if volume.Namespace == namespace {
+			used += volume.Size
+			count++
+		}
+	}
+
+	quota := cfg.NamespaceQuotas.For(namespace)
+
+	if quota.MaxVolumes != nil && count+1 > *quota.MaxVolumes {
+		return status.Errorf(codes.ResourceExhausted, "namespace %s exceeds its volume quota: %d of %d volumes in use",
+			namespace, count, *quota.MaxVolumes)
+	}
+
+	if quota.MaxBytes != nil && used+requested > quota.MaxBytes.Value() {
+		return status.Errorf(codes.ResourceExhausted, "namespace %s exceeds its storage quota: used %s, requested %s, limit %s",
+			namespace, formatBytes(used), formatBytes(requested), formatBytes(quota.MaxBytes.Value()))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Namespace quota tests.
+package driver
+
+import (
+	"testing"
+
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestCheckQuota(t *testing.T) {
+	t.Parallel()
+
+	maxBytes := resource.MustParse("100Ki")
+	maxVolumes := 3
+	unlimited := 0
+
+	cfg := &config.Config{
+		OvercommitRatio: 1.0,
+		NamespaceQuotas: config.NamespaceQuotas{
+			Default: config.Quota{MaxBytes: &maxBytes, MaxVolumes: &maxVolumes},
+			Namespaces: map[string]config.Quota{
+				"ci":     {MaxVolumes: &unlimited},
+				"system": {},
+			},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		namespace       string
+		requested       int64
+		wantCode        codes.Code
+		wantErrContains string
+	}{
+		{
+			name:      "accepts volume within default quota",
+			namespace: "team-b",
+			requested: 100 << 10,
+		},
+		{
+			name:            "rejects volume exceeding storage quota",
+			namespace:       "team-a",
+			requested:       61 << 10,
+			wantCode:        codes.ResourceExhausted,
+			wantErrContains: "namespace team-a exceeds its storage quota: used 40Ki, requested 61Ki, limit 100Ki",
+		},
+		{
+			name:      "accepts volume filling the storage quota",
+			namespace: "team-a",
+			requested: 60 << 10,
+		},
+		{
+			name:            "rejects volume exceeding volume quota",
+			namespace:       "team-c",
+			requested:       1 << 10,
+			wantCode:        codes.ResourceExhausted,
+			wantErrContains: "namespace team-c exceeds its volume quota: 3 of 3 volumes in use",
+		},
+		{
+			name:            "namespace override replaces default quota",
+			namespace:       "ci",
+			requested:       1 << 10,
+			wantCode:        codes.ResourceExhausted,
+			wantErrContains: "namespace ci exceeds its volume quota: 0 of 0 volumes in use",
+		},
+		{
+			name:      "override without limits is unlimited",
+			namespace: "system",
+			requested: 1 << 30,
+		},
+		{
+			name:      "volumes without namespace are not limited",
+			requested: 1 << 30,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			store := newTestState(t, env)
+			require.NoError(t, store.PutVolume(state.Volume{ID: "pvc-1", Namespace: "team-a", Size: 30 << 10}))
+			require.NoError(t, store.PutVolume(state.Volume{ID: "csi-2", Namespace: "team-a", Size: 10 << 10, Ephemeral: true}))
+			for _, id := range []string{"pvc-3", "pvc-4", "pvc-5"} {
+				require.NoError(t, store.PutVolume(state.Volume{ID: id, Namespace: "team-c", Size: 1 << 10}))
+			}
+
+			err := checkQuota(cfg, store, tt.namespace, tt.requested)
+
+			if tt.wantCode == codes.OK {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tt.wantCode, status.Code(err))
+			assert.Contains(t, err.Error(), tt.wantErrContains)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// retainPolicyParameter is the volume attribute choosing what happens to an inline volume
+// once its pod is gone.
+const retainPolicyParameter = "retainPolicy"
+
+// Retain policies of inline volumes.
+const (
+	// retainPolicyDelete removes the backing file on unpublish.
+	retainPolicyDelete = "delete"
+	// retainPolicyKeep keeps the backing file for the next pod with the same identity.
+	retainPolicyKeep = "keep"
+)
+
+// retainInterval is how often retained volumes are checked for expiry.
+const retainInterval = time.Minute
+
+// retainKey returns the identity an inline volume is kept for after unpublishing, or an empty
+// key if the volume is deleted. The identity is the namespace and name of the pod and the name
+// of the volume in the pod spec, which kubelet uses as the parent directory of the target path.
+//
+// Returns an error if the policy is unknown or kubelet did not pass the pod info.
+func retainKey(volumeContext map[string]string, targetPath string) (string, error) {
+	switch policy := volumeContext[retainPolicyParameter]; policy {
+	case "", retainPolicyDelete:
+		return "", nil
+	case retainPolicyKeep:
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "retainPolicy %s is not supported, use %s or %s", policy, retainPolicyDelete, retainPolicyKeep)
+	}
+
+	namespace, podName := volumeContext[podNamespaceKey], volumeContext[podNameKey]
+	if namespace == "" || podName == "" {
+		return "", status.Errorf(codes.InvalidArgument, "retainPolicy %s requires the pod info, enable podInfoOnMount", retainPolicyKeep)
+	}
+	return fmt.Sprintf("%s/%s/%s", namespace, podName, filepath.Base(filepath.Dir(targetPath))), nil
+}
+
+// retainedVolume returns the unpublished volume kept for the given identity.
+func retainedVolume(store *state.Store, key string) (state.Volume, bool) {
+	for _, volume := range store.Volumes() {
+		if volume.RetainKey == key && volume.ReleasedAt != nil {
+			return volume, true
+		}
+	}
+	return state.Volume{}, false
+}
+
+// ExpireRetained releases the expired retained volumes until ctx is done, on start and periodically,
+// so volumes of pods that never come back expire without another volume being published.
+func (ns *NodeServer) ExpireRetained(ctx context.Context) {
+	for {
+		expireRetainedVolumes(ns.Env, ns.Config, ns.State)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retainInterval):
+		}
+	}
+}
+
+// expireRetainedVolumes releases the retained volumes whose pod did not come back within the retain TTL.
+func expireRetainedVolumes(env *conf.Env, cfg *config.Config, store *state.Store) {
+	for _, volume := range store.Volumes() {
+		if volume.ReleasedAt == nil || env.Now().Sub(*volume.ReleasedAt) <= cfg.RetainDuration() {
+			continue
+		}
+		klog.Infof("Retained volume %s of %s expired", volume.ID, volume.RetainKey)
+		if err := releaseVolume(env, cfg, store, volume); err != nil {
+			klog.Warningf("Failed to release retained volume %s: %v", volume.ID, err)
+		}
+	}
+}
+
+// reattachVolume hands a retained volume over to a new pod with the same identity.
+// The retained volume must match the requested pool and filesystem and be at least the
+// requested size. Its filesystem is checked, then its backing file and record are moved
+// to the ID of the new volume, which keeps the pod info of the new pod. An encrypted volume
+// is unlocked with the given passphrase under the ID of the new volume first.
+//
+// Returns an error if the retained volume does not match the request, the passphrase is wrong,
+// or the volume fails the check.
+func (ns *NodeServer) reattachVolume(ctx context.Context, retained, volume state.Volume, volumeContext map[string]string, capability *csi.VolumeCapability, sizeRequest sizeRequest, passphrase []byte) (state.Volume, error) {
+	klog.Infof("Reattaching retained volume %s of %s as %s", retained.ID, retained.RetainKey, volume.ID)
+
+	pool, ok := ns.Config.Pool(retained.Pool)
+	if !ok {
+		return state.Volume{}, status.Errorf(codes.FailedPrecondition, "retained volume %s is in pool %s, which is no longer configured", retained.ID, retained.Pool)
+	}
+	if name := volumeContext[poolParameter]; name != "" && name != pool.Name {
+		return state.Volume{}, status.Errorf(codes.FailedPrecondition, "retained volume %s is in pool %s, requested pool %s", retained.ID, pool.Name, name)
+	}
+	if fsType := capability.GetMount().GetFsType(); fsType != "" && fsType != retained.Filesystem {
+		return state.Volume{}, status.Errorf(codes.FailedPrecondition, "retained volume %s has %s, requested %s", retained.ID, retained.Filesystem, fsType)
+	}
+	if retained.Encrypted != volume.Encrypted {
+		return state.Volume{}, status.Errorf(codes.FailedPrecondition, "retained volume %s has %s %v, requested %v", retained.ID, encryptedParameter, retained.Encrypted, volume.Encrypted)
+	}
+
+	sizeBytes, err := ephemeralSize(ns.Env, pool, retained.Filesystem, sizeRequest)
+	if err != nil {
+		return state.Volume{}, err
+	}
+	if retained.Size < sizeBytes {
+		return state.Volume{}, status.Errorf(codes.FailedPrecondition, "retained volume %s has %s, requested %s", retained.ID, formatBytes(retained.Size), formatBytes(sizeBytes))
+	}
+
+	device := ns.Env.RealPath(retained.BackingFile)
+	if retained.Encrypted {
+		if err := openEncryptedVolume(ctx, ns.Env, retained.BackingFile, volume.ID, passphrase); err != nil {
+			return state.Volume{}, err
+		}
+		device = encryptedDevicePath(volume.ID)
+	}
+	// The mapping is closed again if the volume cannot be handed over
+	lock := func() {
+		if retained.Encrypted {
+			closeEncryptedVolume(ns.Env, volume.ID)
+		}
+	}
+
+	if err := checkFilesystem(ctx, ns.Env, retained.Filesystem, device); err != nil {
+		lock()
+		return state.Volume{}, status.Errorf(codes.Internal, "retained volume %s: %v", retained.ID, err)
+	}
+
+	volume.Pool = retained.Pool
+	volume.Filesystem = retained.Filesystem
+	volume.BackingFile = backingFilePath(pool.Path, volume.ID)
+	volume.Size = retained.Size
+	volume.CreatedAt = retained.CreatedAt
+
+	if volume.BackingFile != retained.BackingFile {
+		if err := ns.Env.FS.Rename(retained.BackingFile, volume.BackingFile); err != nil {
+			lock()
+			return state.Volume{}, fmt.Errorf("failed to move backing file: %v", err)
+		}
+		ns.Env.FS.Remove(metadataFilePath(retained.BackingFile))
+	}
+	if err := ns.State.ReplaceVolume(retained.ID, volume); err != nil {
+		ns.Env.FS.Rename(volume.BackingFile, retained.BackingFile)
+		writeMetadata(ns.Env, retained)
+		lock()
+		return state.Volume{}, err
+	}
+	writeMetadata(ns.Env, volume)
+	return volume, nil
+}
@@ -0,0 +1,194 @@
+// Retained inline volume tests.
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetainKey(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		volumeContext   map[string]string
+		want            string
+		wantErrContains string
+	}{
+		{
+			name:          "deletes volumes by default",
+			volumeContext: map[string]string{podNamespaceKey: "team-a", podNameKey: "db-0"},
+		},
+		{
+			name:          "deletes volumes with delete policy",
+			volumeContext: map[string]string{retainPolicyParameter: "delete", podNamespaceKey: "team-a", podNameKey: "db-0"},
+		},
+		{
+			name:          "keys kept volumes by pod identity and volume name",
+			volumeContext: map[string]string{retainPolicyParameter: "keep", podNamespaceKey: "team-a", podNameKey: "db-0"},
+			want:          "team-a/db-0/data",
+		},
+		{
+			name:            "fails on unknown policy",
+			volumeContext:   map[string]string{retainPolicyParameter: "forever"},
+			wantErrContains: "retainPolicy forever is not supported, use delete or keep",
+		},
+		{
+			name:            "fails without pod info",
+			volumeContext:   map[string]string{retainPolicyParameter: "keep"},
+			wantErrContains: "retainPolicy keep requires the pod info",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			key, err := retainKey(tt.volumeContext, "/var/lib/kubelet/pods/uid-0/volumes/kubernetes.io~csi/data/mount")
+
+			if tt.wantErrContains != "" {
+				require.Error(t, err)
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, key)
+		})
+	}
+}
+
+func TestNodeServer_RetainedVolume(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		if name == "truncate" {
+			return afero.WriteFile(env.FS, args[2], nil, 0644)
+		}
+		return nil
+	})
+
+	mockStatfs(env, 1<<40, 1<<40)
+
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+	targetPath := func(podUID string) string {
+		return fmt.Sprintf("/var/lib/kubelet/pods/%s/volumes/kubernetes.io~csi/data/mount", podUID)
+	}
+	publish := func(volumeID, podUID, size string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       targetPath(podUID),
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeContext: map[string]string{
+				"size":                size,
+				retainPolicyParameter: "keep",
+				podNamespaceKey:       "team-a",
+				podNameKey:            "db-0",
+				podUIDKey:             podUID,
+			},
+		})
+		return err
+	}
+	unpublish := func(volumeID, podUID string) {
+		_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath(podUID)})
+		require.NoError(t, err)
+	}
+
+	// The backing file is kept when the first pod is gone
+	require.NoError(t, publish("csi-1", "uid-1", "200Mi"))
+	unpublish("csi-1", "uid-1")
+
+	retained, ok := ns.State.GetVolume("csi-1")
+	require.True(t, ok)
+	assert.Equal(t, "team-a/db-0/data", retained.RetainKey)
+	assert.NotNil(t, retained.ReleasedAt)
+	assert.Empty(t, retained.TargetPaths)
+	exists, _ := afero.Exists(env.FS, retained.BackingFile)
+	assert.True(t, exists, "backing file should be kept")
+
+	// Unpublishing again keeps the volume
+	unpublish("csi-1", "uid-1")
+	_, ok = ns.State.GetVolume("csi-1")
+	assert.True(t, ok)
+
+	// The next pod with the same identity gets the checked filesystem instead of a new one
+	commands = nil
+	require.NoError(t, publish("csi-2", "uid-2", "200Mi"))
+	assert.Equal(t, []string{
+		"[btrfs check /var/lib/csi-loop/csi-1.img]",
+		"[mount -o loop,nosuid,nodev /var/lib/csi-loop/csi-2.img " + targetPath("uid-2") + "]",
+	}, commands)
+
+	_, ok = ns.State.GetVolume("csi-1")
+	assert.False(t, ok)
+	volume, ok := ns.State.GetVolume("csi-2")
+	require.True(t, ok)
+	assert.Equal(t, "uid-2", volume.PodUID)
+	assert.Nil(t, volume.ReleasedAt)
+	assert.Equal(t, retained.CreatedAt, volume.CreatedAt)
+	exists, _ = afero.Exists(env.FS, backingFilePath(config.DefaultPoolPath, "csi-2"))
+	assert.True(t, exists, "backing file should be moved to the new volume ID")
+	exists, _ = afero.Exists(env.FS, backingFilePath(config.DefaultPoolPath, "csi-1"))
+	assert.False(t, exists)
+
+	// A retained volume smaller than requested is not handed over
+	unpublish("csi-2", "uid-2")
+	err := publish("csi-3", "uid-3", "400Mi")
+	require.Error(t, err)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "retained volume csi-2 has 200Mi, requested 400Mi")
+
+	// Retained volumes are released once the pod did not come back within the TTL
+	releasedAt := time.Now().Add(-2 * config.DefaultRetainTTL)
+	volume, _ = ns.State.GetVolume("csi-2")
+	volume.ReleasedAt = &releasedAt
+	require.NoError(t, ns.State.PutVolume(volume))
+
+	expireRetainedVolumes(env, ns.Config, ns.State)
+
+	assert.Empty(t, ns.State.Volumes())
+	exists, _ = afero.Exists(env.FS, volume.BackingFile)
+	assert.False(t, exists, "backing file should be removed")
+}
+
+func TestNodeServer_ExpireRetained(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+
+	expired := time.Now().Add(-2 * config.DefaultRetainTTL)
+	recent := time.Now().Add(-time.Minute)
+	for id, releasedAt := range map[string]time.Time{"csi-1": expired, "csi-2": recent} {
+		volume := state.Volume{ID: id, BackingFile: backingFilePath(config.DefaultPoolPath, id), RetainKey: "team-a/db-0/" + id, ReleasedAt: &releasedAt}
+		writeBackingFile(t, env, volume.BackingFile, 4096)
+		require.NoError(t, ns.State.PutVolume(volume))
+	}
+
+	// Expired volumes are released on start, without a volume being published
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ns.ExpireRetained(ctx)
+
+	_, ok := ns.State.GetVolume("csi-1")
+	assert.False(t, ok)
+	exists, _ := afero.Exists(env.FS, backingFilePath(config.DefaultPoolPath, "csi-1"))
+	assert.False(t, exists, "backing file should be removed")
+	_, ok = ns.State.GetVolume("csi-2")
+	assert.True(t, ok, "volumes within the TTL should be kept")
+}
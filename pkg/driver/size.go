@@ -0,0 +1,151 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// defaultVolumeSize is used for volumes that do not request a size, unless configured otherwise.
+const defaultVolumeSize = 1 << 30
+
+// blockSize is the granularity backing file sizes are rounded up to.
+const blockSize = 4096
+
+// filesystemMinSize is the smallest image each filesystem can be created on.
+var filesystemMinSize = map[string]int64{
+	"btrfs": 109 << 20, // mkfs.btrfs refuses images below ~109MiB
+	"ext4":  1 << 20,
+	"xfs":   300 << 20, // mkfs.xfs refuses images below 300MiB since xfsprogs 5.19
+}
+
+// sizeRequest is a parsed size volume attribute.
+type sizeRequest struct {
+	// bytes is an absolute size, zero if not given.
+	bytes int64
+	// percent is a size relative to the free space of the pool, zero if not given.
+	percent float64
+}
+
+// parseSize parses a size volume attribute: a Kubernetes quantity such as 1Gi or 500Mi,
+// a percentage of the pool's free space such as 10%, or empty for the default size.
+//
+// Returns an InvalidArgument error for malformed sizes.
+func parseSize(value string) (sizeRequest, error) {
+	if value == "" {
+		return sizeRequest{}, nil
+	}
+
+	if number, ok := strings.CutSuffix(value, "%"); ok {
+		percent, err := strconv.ParseFloat(number, 64)
+		// NaN fails every comparison, so it is only rejected by asking for the valid range
+		if err != nil || !(percent > 0 && percent <= 100) {
+			return sizeRequest{}, status.Errorf(codes.InvalidArgument, "invalid size format %s: percentage must be between 0 and 100", value)
+		}
+		return sizeRequest{percent: percent}, nil
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return sizeRequest{}, status.Errorf(codes.InvalidArgument, "invalid size format %s: %v", value, err)
+	}
+	if quantity.Sign() <= 0 {
+		return sizeRequest{}, status.Errorf(codes.InvalidArgument, "invalid size format %s: size must be positive", value)
+	}
+	return sizeRequest{bytes: quantity.Value()}, nil
+}
+
+// sizeLimits returns the range of volume sizes accepted in a pool for the given filesystem.
+// The minimum is the larger of the configured minimum and the filesystem minimum;
+// a maximum of zero is unlimited.
+func sizeLimits(pool config.Pool, fsType string) (minSize, maxSize int64) {
+	minSize = roundUpToBlock(filesystemMinSize[fsType])
+	if pool.MinSize != nil {
+		minSize = max(minSize, roundUpToBlock(pool.MinSize.Value()))
+	}
+	if pool.MaxSize != nil {
+		maxSize = pool.MaxSize.Value()
+	}
+	return minSize, maxSize
+}
+
+// defaultSize returns the size of volumes in a pool that do not request one.
+func defaultSize(pool config.Pool) int64 {
+	if pool.DefaultSize != nil {
+		return pool.DefaultSize.Value()
+	}
+	return defaultVolumeSize
+}
+
+// ephemeralSize returns the size of an inline volume in a pool. Percentages are taken
+// of the free space of the pool's filesystem, and sizes are rounded up to whole blocks.
+//
+// Returns an InvalidArgument error describing the allowed range if the size is out of range.
+func ephemeralSize(env *conf.Env, pool config.Pool, fsType string, request sizeRequest) (int64, error) {
+	size := request.bytes
+	switch {
+	case request.percent > 0:
+		_, free, err := env.Statfs(pool.Path)
+		if err != nil {
+			return 0, status.Errorf(codes.Internal, "failed to inspect pool %s: %v", pool.Name, err)
+		}
+		size = int64(float64(free) * request.percent / 100)
+	case size == 0:
+		size = defaultSize(pool)
+	}
+	size = roundUpToBlock(size)
+
+	minSize, maxSize := sizeLimits(pool, fsType)
+	if size < minSize || (maxSize > 0 && size > maxSize) {
+		return 0, status.Errorf(codes.InvalidArgument, "size %s is out of range for pool %s with %s, allowed %s",
+			formatBytes(size), pool.Name, fsType, formatRange(minSize, maxSize))
+	}
+	return size, nil
+}
+
+// capacitySize returns the size of a persistent volume in a pool for a capacity range.
+// The required bytes, falling back to the limit bytes and the default size, are raised
+// to the pool minimum and rounded up to whole blocks, which the capacity range allows
+// as long as the limit is not exceeded.
+//
+// Returns an InvalidArgument error describing the allowed range if no size fits.
+func capacitySize(pool config.Pool, fsType string, capacityRange *csi.CapacityRange) (int64, error) {
+	limit := capacityRange.GetLimitBytes()
+
+	size := capacityRange.GetRequiredBytes()
+	if size == 0 {
+		size = limit
+	}
+	if size == 0 {
+		size = defaultSize(pool)
+	}
+
+	minSize, maxSize := sizeLimits(pool, fsType)
+	size = roundUpToBlock(max(size, minSize))
+
+	if (limit > 0 && size > limit) || (maxSize > 0 && size > maxSize) {
+		return 0, status.Errorf(codes.InvalidArgument, "capacity range of %s to %s is out of range for pool %s with %s, allowed %s",
+			formatBytes(capacityRange.GetRequiredBytes()), formatBytes(limit), pool.Name, fsType, formatRange(minSize, maxSize))
+	}
+	return size, nil
+}
+
+// roundUpToBlock rounds a size up to a multiple of the block size.
+func roundUpToBlock(size int64) int64 {
+	return (size + blockSize - 1) / blockSize * blockSize
+}
+
+// formatRange renders a size range, e.g. "109Mi to 100Gi" or "at least 109Mi".
+func formatRange(minSize, maxSize int64) string {
+	if maxSize == 0 {
+		return fmt.Sprintf("at least %s", formatBytes(minSize))
+	}
+	return fmt.Sprintf("%s to %s", formatBytes(minSize), formatBytes(maxSize))
+}
@@ -0,0 +1,209 @@
+// Volume size parsing and bounds tests.
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// sizedPool returns a pool with the given size bounds, empty strings leave a bound unset.
+func sizedPool(defaultSize, minSize, maxSize string) config.Pool {
+	quantity := func(value string) *resource.Quantity {
+		if value == "" {
+			return nil
+		}
+		q := resource.MustParse(value)
+		return &q
+	}
+	return config.Pool{
+		Name:   "test",
+		Path:   config.DefaultPoolPath,
+		Sizing: config.Sizing{DefaultSize: quantity(defaultSize), MinSize: quantity(minSize), MaxSize: quantity(maxSize)},
+	}
+}
+
+func TestEphemeralSize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		size            string
+		pool            config.Pool
+		fsType          string
+		want            int64
+		wantErrContains string
+	}{
+		{
+			name:   "uses absolute size",
+			size:   "500Mi",
+			pool:   sizedPool("", "", ""),
+			fsType: "btrfs",
+			want:   500 << 20,
+		},
+		{
+			name:   "uses built-in default size",
+			pool:   sizedPool("", "", ""),
+			fsType: "btrfs",
+			want:   1 << 30,
+		},
+		{
+			name:   "uses configured default size",
+			pool:   sizedPool("2Gi", "", ""),
+			fsType: "btrfs",
+			want:   2 << 30,
+		},
+		{
+			name:   "rounds up to whole blocks",
+			size:   "2000000",
+			pool:   sizedPool("", "", ""),
+			fsType: "ext4",
+			want:   2002944,
+		},
+		{
+			name:   "takes percentage of pool free space",
+			size:   "50%",
+			pool:   sizedPool("", "", ""),
+			fsType: "btrfs",
+			want:   512 << 30,
+		},
+		{
+			name:            "rejects size below filesystem minimum",
+			size:            "200Mi",
+			pool:            sizedPool("", "", ""),
+			fsType:          "xfs",
+			wantErrContains: "size 200Mi is out of range for pool test with xfs, allowed at least 300Mi",
+		},
+		{
+			name:            "rejects size above configured maximum",
+			size:            "1Pi",
+			pool:            sizedPool("", "1Gi", "100Gi"),
+			fsType:          "btrfs",
+			wantErrContains: "size 1Pi is out of range for pool test with btrfs, allowed 1Gi to 100Gi",
+		},
+		{
+			name:            "rejects zero size",
+			size:            "0",
+			pool:            sizedPool("", "", ""),
+			fsType:          "btrfs",
+			wantErrContains: "invalid size format 0: size must be positive",
+		},
+		{
+			name:            "rejects percentage above 100",
+			size:            "150%",
+			pool:            sizedPool("", "", ""),
+			fsType:          "btrfs",
+			wantErrContains: "percentage must be between 0 and 100",
+		},
+		{
+			name:            "rejects NaN percentage",
+			size:            "NaN%",
+			pool:            sizedPool("", "", ""),
+			fsType:          "btrfs",
+			wantErrContains: "percentage must be between 0 and 100",
+		},
+		{
+			name:            "rejects infinite percentage",
+			size:            "Inf%",
+			pool:            sizedPool("", "", ""),
+			fsType:          "btrfs",
+			wantErrContains: "percentage must be between 0 and 100",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			mockStatfs(env, 2<<40, 1<<40)
+
+			request, err := parseSize(tt.size)
+			var size int64
+			if err == nil {
+				size, err = ephemeralSize(env, tt.pool, tt.fsType, request)
+			}
+
+			if tt.wantErrContains != "" {
+				require.Error(t, err)
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, size)
+		})
+	}
+}
+
+func TestCapacitySize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		capacityRange   *csi.CapacityRange
+		pool            config.Pool
+		want            int64
+		wantErrContains string
+	}{
+		{
+			name:          "uses required bytes",
+			capacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30},
+			pool:          sizedPool("", "", ""),
+			want:          2 << 30,
+		},
+		{
+			name:          "falls back to limit bytes",
+			capacityRange: &csi.CapacityRange{LimitBytes: 3 << 30},
+			pool:          sizedPool("", "", ""),
+			want:          3 << 30,
+		},
+		{
+			name: "uses configured default size",
+			pool: sizedPool("5Gi", "", ""),
+			want: 5 << 30,
+		},
+		{
+			name:          "raises small volume to the minimum",
+			capacityRange: &csi.CapacityRange{RequiredBytes: 1 << 20},
+			pool:          sizedPool("", "", ""),
+			want:          109 << 20,
+		},
+		{
+			name:            "rejects limit below the minimum",
+			capacityRange:   &csi.CapacityRange{RequiredBytes: 1 << 20, LimitBytes: 10 << 20},
+			pool:            sizedPool("", "", ""),
+			wantErrContains: "capacity range of 1Mi to 10Mi is out of range for pool test with btrfs, allowed at least 109Mi",
+		},
+		{
+			name:            "rejects volume above the maximum",
+			capacityRange:   &csi.CapacityRange{RequiredBytes: 200 << 30},
+			pool:            sizedPool("", "", "100Gi"),
+			wantErrContains: "allowed 109Mi to 100Gi",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			size, err := capacitySize(tt.pool, "btrfs", tt.capacityRange)
+
+			if tt.wantErrContains != "" {
+				require.Error(t, err)
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, size)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/klog/v2"
+)
+
+// CreateSnapshot copies the backing file of a persistent volume into the snapshot directory
+// of the volume's pool, so reflinks can share blocks with the volume.
+// A mounted volume is frozen with fsfreeze during the copy, so the snapshot is crash-consistent.
+// Creating a snapshot that already exists for the same source returns the existing snapshot.
+//
+// Returns an error if the request is invalid, the source volume is unknown,
+// or freezing or copying fails.
+func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	snapshotID := req.GetName()
+	sourceVolumeID := req.GetSourceVolumeId()
+	if snapshotID == "" || sourceVolumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot name and source volume ID are required")
+	}
+
+	klog.Infof("CreateSnapshot: snapshotID=%s, sourceVolumeID=%s", snapshotID, sourceVolumeID)
+
+	if snapshot, ok := cs.State.GetSnapshot(snapshotID); ok {
+		if snapshot.SourceVolumeID != sourceVolumeID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", snapshotID, snapshot.SourceVolumeID)
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot(snapshot)}, nil
+	}
+
+	volume, ok := cs.persistentVolume(sourceVolumeID)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found on node %s", sourceVolumeID, cs.NodeId)
+	}
+
+	snapshot := state.Snapshot{
+		ID:             snapshotID,
+		SourceVolumeID: sourceVolumeID,
+		Filesystem:     volume.Filesystem,
+		Encrypted:      volume.Encrypted,
+		Unformatted:    volume.Unformatted,
+		BackingFile:    snapshotFilePath(filepath.Dir(volume.BackingFile), snapshotID),
+		Size:           volume.Size,
+		ResizePending:  volume.ResizePending,
+		CreatedAt:      cs.Env.Now(),
+	}
+
+	cs.Env.FS.MkdirAll(filepath.Dir(snapshot.BackingFile), 0755)
+
+	if err := copyVolume(ctx, cs.Env, volume, snapshot.BackingFile); err != nil {
+		cs.Env.FS.Remove(snapshot.BackingFile)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := cs.State.PutSnapshot(snapshot); err != nil {
+		cs.Env.FS.Remove(snapshot.BackingFile)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	klog.Infof("Snapshot %s successfully created", snapshotID)
+	return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot(snapshot)}, nil
+}
+
+// DeleteSnapshot removes a snapshot and its backing file, wiped according to the wipe policy of its pool.
+// Deleting an unknown snapshot succeeds, as required for idempotency.
+func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	snapshotID := req.GetSnapshotId()
+	if snapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot ID is required")
+	}
+
+	klog.Infof("DeleteSnapshot: snapshotID=%s", snapshotID)
+
+	snapshot, ok := cs.State.GetSnapshot(snapshotID)
+	if !ok {
+		klog.Infof("Snapshot %s not found, nothing to delete", snapshotID)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	// Snapshots are in the snapshot directory of the pool of their source volume
+	pool := dataPool(cs.Config, "", filepath.Dir(filepath.Dir(snapshot.BackingFile)))
+	removeDataFile(cs.Env, cs.State, pool, snapshot.ID, snapshot.BackingFile, snapshot.Size)
+	if err := cs.State.DeleteSnapshot(snapshotID); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	klog.Infof("Snapshot %s successfully deleted", snapshotID)
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots returns the snapshots on this node, optionally filtered by
+// snapshot ID or source volume ID. Results are ordered by snapshot ID and
+// paginated with the index of the next entry as token.
+//
+// Returns an Aborted error if the starting token is invalid.
+func (cs *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	var snapshots []state.Snapshot
+	for _, snapshot := range cs.State.Snapshots() {
+		if req.GetSnapshotId() != "" && snapshot.ID != req.GetSnapshotId() {
+			continue
+		}
+		if req.GetSourceVolumeId() != "" && snapshot.SourceVolumeID != req.GetSourceVolumeId() {
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		var err error
+		start, err = strconv.Atoi(token)
+		if err != nil || start < 0 || start > len(snapshots) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", token)
+		}
+	}
+
+	end := len(snapshots)
+	nextToken := ""
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+		nextToken = strconv.Itoa(end)
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, snapshot := range snapshots[start:end] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnapshot(snapshot)})
+	}
+
+	return &csi.ListSnapshotsResponse{Entries: entries, NextToken: nextToken}, nil
+}
+
+// csiSnapshot converts a snapshot record into its CSI representation.
+// Snapshots are complete copies, so they are always ready to use.
+func csiSnapshot(snapshot state.Snapshot) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     snapshot.ID,
+		SourceVolumeId: snapshot.SourceVolumeID,
+		SizeBytes:      snapshot.Size,
+		CreationTime:   timestamppb.New(snapshot.CreatedAt),
+		ReadyToUse:     true,
+	}
+}
@@ -0,0 +1,224 @@
+// Controller service snapshot tests.
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestControllerServer_CreateSnapshot(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		sourceVolume string
+		volume       *state.Volume
+		existing     *state.Snapshot
+		mockCommands map[string]error
+		wantCode     codes.Code
+		wantCommands []string
+	}{
+		{
+			name:         "copies unmounted volume",
+			sourceVolume: "pvc-1",
+			volume:       &state.Volume{ID: "pvc-1", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-1"), Size: 1 << 30},
+			wantCommands: []string{"cp --reflink=always /var/lib/csi-loop/pvc-1.img /var/lib/csi-loop/snapshots/snap-1.img"},
+		},
+		{
+			name:         "freezes mounted volume during copy",
+			sourceVolume: "pvc-1",
+			volume:       &state.Volume{ID: "pvc-1", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-1"), Size: 1 << 30, TargetPaths: []string{"/mnt/pvc"}},
+			wantCommands: []string{
+				"fsfreeze -f /mnt/pvc",
+				"cp --reflink=always /var/lib/csi-loop/pvc-1.img /var/lib/csi-loop/snapshots/snap-1.img",
+				"fsfreeze -u /mnt/pvc",
+			},
+		},
+		{
+			name:         "unfreezes volume when copy fails",
+			sourceVolume: "pvc-1",
+			volume:       &state.Volume{ID: "pvc-1", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-1"), Size: 1 << 30, TargetPaths: []string{"/mnt/pvc"}},
+			mockCommands: map[string]error{"cp": fmt.Errorf("no space left on device")},
+			wantCode:     codes.Internal,
+			wantCommands: []string{
+				"fsfreeze -f /mnt/pvc",
+				"cp --reflink=always /var/lib/csi-loop/pvc-1.img /var/lib/csi-loop/snapshots/snap-1.img",
+				"cp --sparse=always /var/lib/csi-loop/pvc-1.img /var/lib/csi-loop/snapshots/snap-1.img",
+				"fsfreeze -u /mnt/pvc",
+			},
+		},
+		{
+			name:         "fails when freeze fails",
+			sourceVolume: "pvc-1",
+			volume:       &state.Volume{ID: "pvc-1", BackingFile: backingFilePath(config.DefaultPoolPath, "pvc-1"), Size: 1 << 30, TargetPaths: []string{"/mnt/pvc"}},
+			mockCommands: map[string]error{"fsfreeze": fmt.Errorf("operation not supported")},
+			wantCode:     codes.Internal,
+			wantCommands: []string{"fsfreeze -f /mnt/pvc"},
+		},
+		{
+			name:         "returns existing snapshot of same volume",
+			sourceVolume: "pvc-1",
+			existing:     &state.Snapshot{ID: "snap-1", SourceVolumeID: "pvc-1"},
+		},
+		{
+			name:         "rejects existing snapshot of another volume",
+			sourceVolume: "pvc-1",
+			existing:     &state.Snapshot{ID: "snap-1", SourceVolumeID: "pvc-2"},
+			wantCode:     codes.AlreadyExists,
+		},
+		{
+			name:         "rejects unknown volume",
+			sourceVolume: "pvc-unknown",
+			wantCode:     codes.NotFound,
+		},
+		{
+			name:     "rejects missing source volume",
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+
+			// Setup mock
+			var commands []string
+			mockCommands(env, func(name string, args ...string) error {
+				commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+				return tt.mockCommands[name]
+			})
+
+			store := newTestState(t, env)
+			if tt.volume != nil {
+				require.NoError(t, store.PutVolume(*tt.volume))
+			}
+			if tt.existing != nil {
+				require.NoError(t, store.PutSnapshot(*tt.existing))
+			}
+
+			cs := NewControllerServer(env, config.Default(), store)
+			resp, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+				Name:           "snap-1",
+				SourceVolumeId: tt.sourceVolume,
+			})
+
+			var wantCommands []string
+			for _, command := range tt.wantCommands {
+				wantCommands = append(wantCommands, "["+command+"]")
+			}
+			assert.Equal(t, wantCommands, commands)
+
+			if tt.wantCode != codes.OK {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "snap-1", resp.Snapshot.SnapshotId)
+			assert.Equal(t, "pvc-1", resp.Snapshot.SourceVolumeId)
+			assert.True(t, resp.Snapshot.ReadyToUse)
+
+			_, ok := store.GetSnapshot("snap-1")
+			assert.True(t, ok, "snapshot should be recorded in state")
+		})
+	}
+}
+
+func TestControllerServer_DeleteSnapshot(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	store := newTestState(t, env)
+	snapshotFile := snapshotFilePath(config.DefaultPoolPath, "snap-1")
+	require.NoError(t, afero.WriteFile(env.FS, snapshotFile, []byte("fake-image"), 0644))
+	require.NoError(t, store.PutSnapshot(state.Snapshot{ID: "snap-1", BackingFile: snapshotFile}))
+
+	cs := NewControllerServer(env, config.Default(), store)
+
+	_, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"})
+	require.NoError(t, err)
+
+	_, ok := store.GetSnapshot("snap-1")
+	assert.False(t, ok)
+	exists, _ := afero.Exists(env.FS, snapshotFile)
+	assert.False(t, exists, "snapshot file should be removed")
+
+	// Deleting again is idempotent
+	_, err = cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"})
+	require.NoError(t, err)
+}
+
+func TestControllerServer_ListSnapshots(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	store := newTestState(t, env)
+	for _, snapshot := range []state.Snapshot{
+		{ID: "snap-a", SourceVolumeID: "pvc-1"},
+		{ID: "snap-b", SourceVolumeID: "pvc-2"},
+		{ID: "snap-c", SourceVolumeID: "pvc-1"},
+	} {
+		require.NoError(t, store.PutSnapshot(snapshot))
+	}
+
+	cs := NewControllerServer(env, config.Default(), store)
+
+	ids := func(resp *csi.ListSnapshotsResponse) []string {
+		var ids []string
+		for _, entry := range resp.Entries {
+			ids = append(ids, entry.Snapshot.SnapshotId)
+		}
+		return ids
+	}
+
+	t.Run("lists all snapshots", func(t *testing.T) {
+		resp, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"snap-a", "snap-b", "snap-c"}, ids(resp))
+		assert.Empty(t, resp.NextToken)
+	})
+
+	t.Run("filters by source volume", func(t *testing.T) {
+		resp, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: "pvc-1"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"snap-a", "snap-c"}, ids(resp))
+	})
+
+	t.Run("filters by snapshot ID", func(t *testing.T) {
+		resp, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: "snap-b"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"snap-b"}, ids(resp))
+	})
+
+	t.Run("paginates results", func(t *testing.T) {
+		resp, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"snap-a", "snap-b"}, ids(resp))
+		require.Equal(t, "2", resp.NextToken)
+
+		resp, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 2, StartingToken: resp.NextToken})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"snap-c"}, ids(resp))
+		assert.Empty(t, resp.NextToken)
+	})
+
+	t.Run("rejects invalid starting token", func(t *testing.T) {
+		_, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{StartingToken: "bogus"})
+		require.Error(t, err)
+		assert.Equal(t, codes.Aborted, status.Code(err))
+	})
+}
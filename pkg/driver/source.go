@@ -0,0 +1,245 @@
+package driver
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// sourceParameter is the volume attribute naming the archive a new inline volume is seeded from,
+// relative to the source catalog.
+const sourceParameter = "source"
+
+// preserveOwnershipParameter is the volume attribute keeping the owners recorded in the source
+// archive. By default, extracted files are owned by root.
+const preserveOwnershipParameter = "preserveOwnership"
+
+// sourceExtensions lists the archive formats volumes can be seeded from.
+var sourceExtensions = []string{".tar", ".tar.gz", ".tgz", ".tar.zst", ".tzst"}
+
+// sourceArchive returns the path of the archive a new volume is seeded from, or an empty path
+// if the volume starts empty, and whether the owners recorded in the archive are kept.
+//
+// Returns an InvalidArgument error if the source is outside the catalog, is not a supported
+// archive or the ownership attribute is invalid, and a NotFound error if it does not exist.
+func sourceArchive(env *conf.Env, cfg *config.Config, volumeContext map[string]string) (string, bool, error) {
+	source := volumeContext[sourceParameter]
+	if source == "" {
+		return "", false, nil
+	}
+
+	if !filepath.IsLocal(source) {
+		return "", false, status.Errorf(codes.InvalidArgument, "source %s must be a relative path inside the source catalog", source)
+	}
+	supported := false
+	for _, extension := range sourceExtensions {
+		supported = supported || strings.HasSuffix(source, extension)
+	}
+	if !supported {
+		return "", false, status.Errorf(codes.InvalidArgument, "source %s is not a supported archive, use one of %v", source, sourceExtensions)
+	}
+
+	preserveOwnership, err := preserveOwnership(volumeContext)
+	if err != nil {
+		return "", false, err
+	}
+
+	path := filepath.Join(cfg.SourceCatalogPath(), source)
+	if exists, _ := afero.Exists(env.FS, path); !exists {
+		return "", false, status.Errorf(codes.NotFound, "source %s not found in %s", source, cfg.SourceCatalogPath())
+	}
+	return path, preserveOwnership, nil
+}
+
+// preserveOwnership returns whether the owners recorded in the source of a volume are kept.
+func preserveOwnership(volumeContext map[string]string) (bool, error) {
+	value, ok := volumeContext[preserveOwnershipParameter]
+	if !ok {
+		return false, nil
+	}
+	preserve, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "invalid %s %q: must be true or false", preserveOwnershipParameter, value)
+	}
+	return preserve, nil
+}
+
+// extractArchive extracts a tar archive, optionally compressed with gzip or zstd, into dir.
+// Entries outside dir, symlinks pointing outside dir and entries below symlinks are rejected,
+// so an archive can never write outside the volume. Devices and other special files are skipped.
+// Owners are only kept if preserveOwnership is set.
+func extractArchive(env *conf.Env, archive, dir string, preserveOwnership bool) error {
+	file, err := env.FS.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	compression := ""
+	switch {
+	case strings.HasSuffix(archive, ".gz"), strings.HasSuffix(archive, ".tgz"):
+		compression = "gzip"
+	case strings.HasSuffix(archive, ".zst"), strings.HasSuffix(archive, ".tzst"):
+		compression = "zstd"
+	}
+	reader, err := decompress(file, compression)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := extractEntry(env, tr, header, dir, preserveOwnership); err != nil {
+			return fmt.Errorf("%s: %v", header.Name, err)
+		}
+	}
+}
+
+// decompress returns a reader of r decompressed with gzip or zstd, or r itself without compression.
+func decompress(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// extractEntry extracts a single archive entry into dir.
+func extractEntry(env *conf.Env, tr io.Reader, header *tar.Header, dir string, preserveOwnership bool) error {
+	name := filepath.Clean(header.Name)
+	if name == "." {
+		return nil
+	}
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("path escapes the volume")
+	}
+	if err := checkNoSymlinks(env, dir, filepath.Dir(name)); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, name)
+	mode := header.FileInfo().Mode().Perm()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := checkNoSymlinks(env, dir, name); err != nil {
+			return err
+		}
+		if err := env.FS.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		if err := writeFile(env, path, tr, mode); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		// Hard links are extracted as copies of the file they link to
+		target := filepath.Clean(header.Linkname)
+		if !filepath.IsLocal(target) {
+			return fmt.Errorf("hard link to %s escapes the volume", header.Linkname)
+		}
+		if err := checkNoSymlinks(env, dir, target); err != nil {
+			return err
+		}
+		source, err := env.FS.Open(filepath.Join(dir, target))
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		if err := writeFile(env, path, source, mode); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if filepath.IsAbs(header.Linkname) || !filepath.IsLocal(filepath.Join(filepath.Dir(name), header.Linkname)) {
+			return fmt.Errorf("symlink to %s escapes the volume", header.Linkname)
+		}
+		linker, ok := env.FS.(afero.Linker)
+		if !ok {
+			return fmt.Errorf("symlinks are not supported")
+		}
+		env.FS.MkdirAll(filepath.Dir(path), 0755)
+		env.FS.Remove(path)
+		// Attributes of symlinks are left alone, changing them would follow the link
+		return linker.SymlinkIfPossible(header.Linkname, path)
+	default:
+		klog.Warningf("Skipping %s of unsupported type %q", header.Name, header.Typeflag)
+		return nil
+	}
+
+	if preserveOwnership {
+		if err := env.FS.Chown(path, header.Uid, header.Gid); err != nil {
+			return err
+		}
+	}
+	if err := env.FS.Chmod(path, mode); err != nil {
+		return err
+	}
+	return env.FS.Chtimes(path, header.ModTime, header.ModTime)
+}
+
+// writeFile creates a file with the content of r, replacing an existing file or symlink
+// instead of writing through it.
+func writeFile(env *conf.Env, path string, r io.Reader, mode os.FileMode) error {
+	env.FS.MkdirAll(filepath.Dir(path), 0755)
+	env.FS.Remove(path)
+
+	file, err := env.FS.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// checkNoSymlinks verifies that neither the relative path rel inside dir nor any directory
+// leading to it is a symlink, so accessing rel cannot be redirected outside dir.
+func checkNoSymlinks(env *conf.Env, dir, rel string) error {
+	lstater, ok := env.FS.(afero.Lstater)
+	if !ok {
+		return nil
+	}
+
+	path := dir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		path = filepath.Join(path, part)
+		info, _, err := lstater.LstatIfPossible(path)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("path goes through the symlink %s", strings.TrimPrefix(path, dir+"/"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+// Volume seeding from source archives tests.
+package driver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/klauspost/compress/zstd"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tarEntry is an entry of a test archive.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+// writeArchive writes a tar archive of the given entries into the filesystem of env,
+// compressed according to its extension.
+func writeArchive(t *testing.T, env *conf.Env, path string, entries []tarEntry) {
+	compression := ""
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		compression = "gzip"
+	case strings.HasSuffix(path, ".zst"):
+		compression = "zstd"
+	}
+
+	require.NoError(t, afero.WriteFile(env.FS, path, tarArchive(t, compression, entries), 0644))
+}
+
+// tarArchive returns a tar archive of the given entries, compressed with gzip, zstd or not at all.
+func tarArchive(t *testing.T, compression string, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser = nopCloser{&buf}
+	switch compression {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		require.NoError(t, err)
+		w = zw
+	}
+
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Linkname: entry.linkname, Mode: 0640, Size: int64(len(entry.content))}
+		if entry.typeflag == tar.TypeDir {
+			header.Mode = 0750
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		_, err := tw.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestSourceArchive(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	writeArchive(t, env, "/var/lib/csi-loop-sources/datasets/mnist.tar.gz", nil)
+
+	tests := []struct {
+		name            string
+		volumeContext   map[string]string
+		want            string
+		wantPreserve    bool
+		wantCode        codes.Code
+		wantErrContains string
+	}{
+		{
+			name:          "starts empty without source",
+			volumeContext: map[string]string{},
+		},
+		{
+			name:          "resolves source in the catalog",
+			volumeContext: map[string]string{sourceParameter: "datasets/mnist.tar.gz", preserveOwnershipParameter: "true"},
+			want:          "/var/lib/csi-loop-sources/datasets/mnist.tar.gz",
+			wantPreserve:  true,
+		},
+		{
+			name:            "fails on source outside the catalog",
+			volumeContext:   map[string]string{sourceParameter: "../../etc/shadow.tar"},
+			wantCode:        codes.InvalidArgument,
+			wantErrContains: "must be a relative path inside the source catalog",
+		},
+		{
+			name:            "fails on unsupported archive",
+			volumeContext:   map[string]string{sourceParameter: "datasets/mnist.zip"},
+			wantCode:        codes.InvalidArgument,
+			wantErrContains: "source datasets/mnist.zip is not a supported archive",
+		},
+		{
+			name:            "fails on invalid ownership attribute",
+			volumeContext:   map[string]string{sourceParameter: "datasets/mnist.tar.gz", preserveOwnershipParameter: "maybe"},
+			wantCode:        codes.InvalidArgument,
+			wantErrContains: `invalid preserveOwnership "maybe"`,
+		},
+		{
+			name:            "fails on missing source",
+			volumeContext:   map[string]string{sourceParameter: "datasets/imagenet.tar"},
+			wantCode:        codes.NotFound,
+			wantErrContains: "source datasets/imagenet.tar not found in /var/lib/csi-loop-sources",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, preserveOwnership, err := sourceArchive(env, config.Default(), tt.volumeContext)
+
+			if tt.wantErrContains != "" {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, path)
+			assert.Equal(t, tt.wantPreserve, preserveOwnership)
+		})
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	t.Parallel()
+
+	dataset := []tarEntry{
+		{name: "./", typeflag: tar.TypeDir},
+		{name: "data/", typeflag: tar.TypeDir},
+		{name: "data/train.csv", typeflag: tar.TypeReg, content: "a,b\n1,2\n"},
+		{name: "data/copy.csv", typeflag: tar.TypeLink, linkname: "data/train.csv"},
+		{name: "dev/null", typeflag: tar.TypeChar},
+	}
+
+	tests := []struct {
+		name            string
+		archive         string
+		entries         []tarEntry
+		wantErrContains string
+	}{
+		{name: "extracts tar", archive: "/sources/dataset.tar", entries: dataset},
+		{name: "extracts gzip compressed tar", archive: "/sources/dataset.tar.gz", entries: dataset},
+		{name: "extracts zstd compressed tar", archive: "/sources/dataset.tar.zst", entries: dataset},
+		{
+			name:            "rejects path traversal",
+			archive:         "/sources/evil.tar",
+			entries:         []tarEntry{{name: "../../etc/cron.d/evil", typeflag: tar.TypeReg, content: "x"}},
+			wantErrContains: "../../etc/cron.d/evil: path escapes the volume",
+		},
+		{
+			name:            "rejects absolute symlinks",
+			archive:         "/sources/evil.tar",
+			entries:         []tarEntry{{name: "etc", typeflag: tar.TypeSymlink, linkname: "/etc"}},
+			wantErrContains: "etc: symlink to /etc escapes the volume",
+		},
+		{
+			name:            "rejects symlinks leaving the volume",
+			archive:         "/sources/evil.tar",
+			entries:         []tarEntry{{name: "data/up", typeflag: tar.TypeSymlink, linkname: "../../.."}},
+			wantErrContains: "data/up: symlink to ../../.. escapes the volume",
+		},
+		{
+			name:            "rejects hard links leaving the volume",
+			archive:         "/sources/evil.tar",
+			entries:         []tarEntry{{name: "shadow", typeflag: tar.TypeLink, linkname: "../etc/shadow"}},
+			wantErrContains: "shadow: hard link to ../etc/shadow escapes the volume",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			target := "/mnt/seeded"
+			require.NoError(t, env.FS.MkdirAll(target, 0755))
+			writeArchive(t, env, tt.archive, tt.entries)
+
+			err := extractArchive(env, tt.archive, target, false)
+
+			if tt.wantErrContains != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+
+			for _, path := range []string{"/mnt/seeded/data/train.csv", "/mnt/seeded/data/copy.csv"} {
+				content, err := afero.ReadFile(env.FS, path)
+				require.NoError(t, err)
+				assert.Equal(t, "a,b\n1,2\n", string(content))
+			}
+			info, err := env.FS.Stat("/mnt/seeded/data")
+			require.NoError(t, err)
+			assert.Equal(t, "drwxr-x---", info.Mode().String())
+			exists, _ := afero.Exists(env.FS, "/mnt/seeded/dev/null")
+			assert.False(t, exists, "devices should be skipped")
+		})
+	}
+}
+
+func TestExtractArchive_InvalidArchive(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	archive := "/sources/broken.tar.gz"
+	require.NoError(t, afero.WriteFile(env.FS, archive, []byte("not an archive"), 0644))
+
+	err := extractArchive(env, archive, "/mnt/seeded", false)
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "gzip: invalid header")
+}
+
+func TestNodeServer_SeedVolume(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		return nil
+	})
+
+	mockStatfs(env, 1<<40, 1<<40)
+	writeArchive(t, env, "/var/lib/csi-loop-sources/dataset.tar", []tarEntry{{name: "train.csv", typeflag: tar.TypeReg, content: "1,2\n"}})
+	writeArchive(t, env, "/var/lib/csi-loop-sources/evil.tar", []tarEntry{{name: "../evil", typeflag: tar.TypeReg, content: "x"}})
+
+	ns := NewNodeServer(env, config.Default(), newTestState(t, env), nil)
+	publish := func(volumeID, targetPath, source string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       targetPath,
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY),
+			VolumeContext:    map[string]string{"size": "200Mi", sourceParameter: source},
+		})
+		return err
+	}
+
+	// The volume is seeded through a writable mount and remounted read-only
+	require.NoError(t, publish("csi-1", "/mnt/dataset", "dataset.tar"))
+	content, err := afero.ReadFile(env.FS, "/mnt/dataset/train.csv")
+	require.NoError(t, err)
+	assert.Equal(t, "1,2\n", string(content))
+	assert.Contains(t, commands, "[mount -o loop,nosuid,nodev /var/lib/csi-loop/csi-1.img /mnt/dataset]")
+	assert.Contains(t, commands, "[mount -o remount,ro,nosuid,nodev /mnt/dataset]")
+	volume, _ := ns.State.GetVolume("csi-1")
+	assert.Equal(t, "dataset.tar", volume.Source)
+
+	// An invalid archive fails publishing and releases the volume
+	err = publish("csi-2", "/mnt/evil", "evil.tar")
+	require.Error(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), "failed to extract source evil.tar: ../evil: path escapes the volume")
+	_, ok := ns.State.GetVolume("csi-2")
+	assert.False(t, ok)
+	assert.Contains(t, commands, "[umount /mnt/evil]")
+}
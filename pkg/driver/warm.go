@@ -0,0 +1,220 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"k8s.io/klog/v2"
+)
+
+// warmPoolInterval is how often the warm pool is refilled without images being taken.
+const warmPoolInterval = 30 * time.Second
+
+// WarmPool keeps pre-formatted images ready in the warm directory of each pool, so new
+// inline volumes are moved into place instead of formatted on publish. Images are kept per
+// filesystem of the pool and size class, and do not count towards the pool budget until taken.
+type WarmPool struct {
+	// Env is the environment the warm pool runs in: its filesystem, commands, mounts and clock.
+	Env *conf.Env
+	// Config holds the driver configuration.
+	Config *config.Config
+
+	// mu serializes taking images, so concurrent volumes never take the same image.
+	mu sync.Mutex
+	// refill wakes the filler after an image was taken.
+	refill chan struct{}
+	// paused holds the pools whose filling is paused under disk pressure.
+	paused map[string]bool
+	// metrics counts hits and misses and tracks the ready images.
+	metrics *warmPoolMetrics
+}
+
+// NewWarmPool returns a warm pool for the pools of the given configuration, filled in env.
+// Its metrics are registered with the registry of env.
+func NewWarmPool(env *conf.Env, cfg *config.Config) *WarmPool {
+	return &WarmPool{Env: env, Config: cfg, refill: make(chan struct{}, 1), paused: map[string]bool{}, metrics: newWarmPoolMetrics(env.Metrics)}
+}
+
+// Run fills the warm pools until ctx is done, after images were taken and periodically.
+// Images left half-formatted by a previous run are removed first.
+func (w *WarmPool) Run(ctx context.Context) {
+	for _, pool := range w.Config.AllPools() {
+		stale, _ := afero.Glob(w.Env.FS, filepath.Join(pool.Path, warmSubdir, "*.tmp"))
+		for _, path := range stale {
+			w.Env.FS.Remove(path)
+		}
+	}
+
+	for {
+		w.fill(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.refill:
+		case <-time.After(warmPoolInterval):
+		}
+	}
+}
+
+// fill formats the missing images of all pools. Filling a pool pauses while its
+// filesystem has less free space than the warm pool requires.
+func (w *WarmPool) fill(ctx context.Context) {
+	for _, pool := range w.Config.AllPools() {
+		if !pool.WarmPool.Enabled() {
+			continue
+		}
+
+	classes:
+		for _, class := range pool.WarmPool.SizeClasses {
+			size := warmImageSize(pool.Filesystem, class.Value())
+			for i := range pool.WarmPool.Images {
+				path := warmImagePath(pool.Path, pool.Filesystem, size, i)
+				if exists, _ := afero.Exists(w.Env.FS, path); exists {
+					continue
+				}
+				if w.underPressure(pool) {
+					break classes
+				}
+				if err := formatWarmImage(ctx, w.Env, pool.Filesystem, size, path); err != nil {
+					klog.Warningf("Failed to fill warm pool of %s: %v", pool.Name, err)
+					break classes
+				}
+			}
+		}
+
+		for _, class := range pool.WarmPool.SizeClasses {
+			size := warmImageSize(pool.Filesystem, class.Value())
+			images, _ := warmImages(w.Env, pool.Path, pool.Filesystem, size)
+			w.metrics.images.WithLabelValues(pool.Name, pool.Filesystem, class.String()).Set(float64(len(images)))
+		}
+	}
+}
+
+// underPressure reports whether filling a pool pauses, logging when a pool pauses or resumes.
+func (w *WarmPool) underPressure(pool config.Pool) bool {
+	total, free, err := w.Env.Statfs(pool.Path)
+	pressure := err != nil || float64(free) < float64(total)*pool.WarmPool.MinFree()/100
+
+	if pressure != w.paused[pool.Name] {
+		if pressure {
+			klog.Infof("Pausing warm pool of %s under disk pressure: %s of %s free", pool.Name, formatBytes(free), formatBytes(total))
+			w.metrics.paused.WithLabelValues(pool.Name).Set(1)
+		} else {
+			klog.Infof("Resuming warm pool of %s", pool.Name)
+			w.metrics.paused.WithLabelValues(pool.Name).Set(0)
+		}
+		w.paused[pool.Name] = pressure
+	}
+	return pressure
+}
+
+// allocateVolume allocates a new volume from a warm image of the largest size class not above
+// the size of the volume, like allocateVolume. The image is moved into place and its backing
+// file grown to the size of the volume, leaving the filesystem to be grown on mount.
+// Returns false without allocating anything if no image is ready.
+func (w *WarmPool) allocateVolume(store *state.Store, pool config.Pool, volume state.Volume) (state.Volume, bool, error) {
+	if w == nil || !pool.WarmPool.Enabled() {
+		return volume, false, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	image, size, ok := w.ready(pool, volume.Filesystem, volume.Size)
+	if !ok {
+		klog.Infof("Warm pool miss for volume %s: no %s image of at most %s ready in %s", volume.ID, volume.Filesystem, formatBytes(volume.Size), pool.Name)
+		w.metrics.misses.WithLabelValues(pool.Name, volume.Filesystem).Inc()
+		return volume, false, nil
+	}
+
+	volume.ResizePending = size < volume.Size
+	err := allocate(w.Env, w.Config, store, pool, volume, func() error {
+		if err := w.Env.FS.Rename(image, volume.BackingFile); err != nil {
+			return fmt.Errorf("failed to take warm image: %v", err)
+		}
+		if volume.ResizePending {
+			if err := w.Env.Loop.Truncate(w.Env.RealPath(volume.BackingFile), volume.Size); err != nil {
+				w.Env.FS.Rename(volume.BackingFile, image)
+				return fmt.Errorf("failed to grow backing file: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return volume, true, err
+	}
+
+	klog.Infof("Warm pool hit for volume %s: took %s", volume.ID, image)
+	w.metrics.hits.WithLabelValues(pool.Name, volume.Filesystem).Inc()
+	select {
+	case w.refill <- struct{}{}:
+	default:
+	}
+	return volume, true, nil
+}
+
+// ready returns a ready image of the largest size class not above size and its size.
+// Images of smaller classes are used if the matching class is exhausted.
+func (w *WarmPool) ready(pool config.Pool, fsType string, size int64) (string, int64, bool) {
+	if fsType != pool.Filesystem {
+		return "", 0, false
+	}
+
+	var sizes []int64
+	for _, class := range pool.WarmPool.SizeClasses {
+		if imageSize := warmImageSize(fsType, class.Value()); imageSize <= size {
+			sizes = append(sizes, imageSize)
+		}
+	}
+	slices.Sort(sizes)
+	slices.Reverse(sizes)
+
+	for _, imageSize := range sizes {
+		if images, _ := warmImages(w.Env, pool.Path, fsType, imageSize); len(images) > 0 {
+			return images[0], imageSize, true
+		}
+	}
+	return "", 0, false
+}
+
+// warmImageSize returns the size of the images of a size class, which is rounded up to whole
+// blocks and the minimum size of the filesystem.
+func warmImageSize(fsType string, class int64) int64 {
+	return max(roundUpToBlock(class), filesystemMinSize[fsType])
+}
+
+// warmImagePath returns the path of a warm image in the given pool directory.
+func warmImagePath(dir, fsType string, size int64, index int) string {
+	return filepath.Join(dir, warmSubdir, fmt.Sprintf("%s-%d-%d.img", fsType, size, index))
+}
+
+// warmImages returns the ready images of a filesystem and size in the given pool directory.
+func warmImages(env *conf.Env, dir, fsType string, size int64) ([]string, error) {
+	return afero.Glob(env.FS, filepath.Join(dir, warmSubdir, fmt.Sprintf("%s-%d-*.img", fsType, size)))
+}
+
+// formatWarmImage creates and formats a warm image under a temporary name, so only
+// completely formatted images can be taken.
+func formatWarmImage(ctx context.Context, env *conf.Env, fsType string, size int64, path string) error {
+	tmp := path + ".tmp"
+	env.FS.MkdirAll(filepath.Dir(path), 0755)
+
+	klog.Infof("Formatting warm image %s", path)
+	if err := env.Loop.Truncate(env.RealPath(tmp), size); err != nil {
+		env.FS.Remove(tmp)
+		return fmt.Errorf("failed to create warm image: %v", err)
+	}
+	if err := formatBackingFile(ctx, env, fsType, tmp); err != nil {
+		env.FS.Remove(tmp)
+		return err
+	}
+	return env.FS.Rename(tmp, path)
+}
@@ -0,0 +1,140 @@
+// Warm pool of pre-formatted images tests.
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// warmConfig returns a configuration keeping two images of 200Mi and 1Gi ready.
+func warmConfig() *config.Config {
+	cfg := config.Default()
+	cfg.WarmPool = &config.WarmPool{Images: 2, SizeClasses: []resource.Quantity{resource.MustParse("200Mi"), resource.MustParse("1Gi")}}
+	return cfg
+}
+
+// mockWarmCommands records the commands run in env and creates the files truncate is called on.
+func mockWarmCommands(env *conf.Env) *[]string {
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		if name == "truncate" {
+			return afero.WriteFile(env.FS, args[2], nil, 0644)
+		}
+		return nil
+	})
+	return &commands
+}
+
+func TestWarmPool_Fill(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	commands := mockWarmCommands(env)
+	mockStatfs(env, 1<<40, 1<<40)
+
+	w := NewWarmPool(env, warmConfig())
+	w.fill(context.Background())
+
+	for _, size := range []int64{200 << 20, 1 << 30} {
+		images, err := warmImages(env, config.DefaultPoolPath, "btrfs", size)
+		require.NoError(t, err)
+		assert.Len(t, images, 2)
+	}
+	assert.Contains(t, *commands, "[mkfs.btrfs /var/lib/csi-loop/warm/btrfs-209715200-0.img.tmp]")
+	assert.Equal(t, 2.0, testutil.ToFloat64(w.metrics.images.WithLabelValues("default", "btrfs", "1Gi")))
+
+	// Full pools are not refilled
+	*commands = nil
+	w.fill(context.Background())
+	assert.Empty(t, *commands)
+}
+
+func TestWarmPool_FillUnderPressure(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	commands := mockWarmCommands(env)
+	mockStatfs(env, 100<<30, 10<<30)
+
+	w := NewWarmPool(env, warmConfig())
+	w.fill(context.Background())
+
+	assert.Empty(t, *commands, "filling should pause below 15% free space")
+	assert.Equal(t, 1.0, testutil.ToFloat64(w.metrics.paused.WithLabelValues("default")))
+
+	mockStatfs(env, 100<<30, 50<<30)
+	w.fill(context.Background())
+
+	assert.NotEmpty(t, *commands, "filling should resume")
+	assert.Equal(t, 0.0, testutil.ToFloat64(w.metrics.paused.WithLabelValues("default")))
+}
+
+func TestNodeServer_WarmVolume(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	commands := mockWarmCommands(env)
+	mockStatfs(env, 1<<40, 1<<40)
+
+	cfg := warmConfig()
+	w := NewWarmPool(env, cfg)
+	w.fill(context.Background())
+
+	ns := NewNodeServer(env, cfg, newTestState(t, env), w)
+	publish := func(volumeID, size, fsType string) error {
+		capability := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+		capability.GetMount().FsType = fsType
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       "/mnt/" + volumeID,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"size": size},
+		})
+		return err
+	}
+
+	// A volume of a size class takes an image without formatting
+	*commands = nil
+	require.NoError(t, publish("csi-1", "1Gi", ""))
+	assert.Equal(t, []string{"[mount -o loop,nosuid,nodev /var/lib/csi-loop/csi-1.img /mnt/csi-1]"}, *commands)
+	images, _ := warmImages(env, config.DefaultPoolPath, "btrfs", 1<<30)
+	assert.Len(t, images, 1)
+
+	// Larger volumes take an image of the largest class below and grow it
+	*commands = nil
+	require.NoError(t, publish("csi-2", "500Mi", ""))
+	assert.Equal(t, []string{
+		"[truncate -s 524288000 /var/lib/csi-loop/csi-2.img]",
+		"[mount -o loop,nosuid,nodev /var/lib/csi-loop/csi-2.img /mnt/csi-2]",
+		"[btrfs filesystem resize max /mnt/csi-2]",
+	}, *commands)
+	volume, _ := ns.State.GetVolume("csi-2")
+	assert.False(t, volume.ResizePending)
+	assert.Equal(t, int64(500<<20), volume.Size)
+
+	// Volumes below the smallest class are formatted on publish
+	*commands = nil
+	require.NoError(t, publish("csi-3", "150Mi", ""))
+	assert.Contains(t, *commands, "[mkfs.btrfs /var/lib/csi-loop/csi-3.img]")
+
+	// So are volumes of another filesystem than the pool's
+	*commands = nil
+	require.NoError(t, publish("csi-4", "1Gi", "ext4"))
+	assert.Contains(t, *commands, "[mkfs.ext4 -F /var/lib/csi-loop/csi-4.img]")
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(w.metrics.hits.WithLabelValues("default", "btrfs")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(w.metrics.misses.WithLabelValues("default", "btrfs")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(w.metrics.misses.WithLabelValues("default", "ext4")))
+}
@@ -0,0 +1,258 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"k8s.io/klog/v2"
+)
+
+// wipeInterval is how often failed wipes are retried.
+const wipeInterval = time.Minute
+
+// wipeChunkSize is the number of zeros written at once.
+const wipeChunkSize = 4 << 20
+
+// wipeProgressInterval is how many bytes are overwritten between progress updates in the state.
+const wipeProgressInterval = 1 << 30
+
+// errCopyOnWrite is returned for backing files that cannot be overwritten in place.
+var errCopyOnWrite = errors.New("backing file is copy-on-write, overwriting would not reach its blocks")
+
+// Wiper overwrites the backing files of deleted volumes with the overwrite wipe policy in the
+// background, so unpublishing is not blocked by it. Queued wipes are recorded in the state with
+// their progress and last failure, and resumed after a restart.
+type Wiper struct {
+	// Env is the environment the wiper runs in: its filesystem, commands, mounts and clock.
+	Env *conf.Env
+	// Config holds the driver configuration.
+	Config *config.Config
+	// State records the queued wipes.
+	State *state.Store
+}
+
+// NewWiper returns a wiper for the pools of the given configuration, wiping in env.
+func NewWiper(env *conf.Env, cfg *config.Config, store *state.Store) *Wiper {
+	return &Wiper{Env: env, Config: cfg, State: store}
+}
+
+// Run wipes the queued backing files until ctx is done, after files were queued and periodically.
+// Files left in the wipe directories without a record, e.g. after a crash while queueing, are queued first.
+func (w *Wiper) Run(ctx context.Context) {
+	w.recover()
+
+	for {
+		w.wipeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.Env.WipeQueued:
+		case <-time.After(wipeInterval):
+		}
+	}
+}
+
+// recover queues the files in the wipe directories of all pools that are not recorded in the state.
+func (w *Wiper) recover() {
+	queued := map[string]bool{}
+	for _, wipe := range w.State.Wipes() {
+		queued[wipe.BackingFile] = true
+	}
+
+	for _, pool := range w.Config.AllPools() {
+		files, _ := afero.Glob(w.Env.FS, filepath.Join(pool.Path, wipeSubdir, "*.img"))
+		for _, path := range files {
+			info, err := w.Env.FS.Stat(path)
+			if err != nil || queued[path] {
+				continue
+			}
+			klog.Infof("Queueing unrecorded backing file %s for wiping", path)
+			if err := w.State.PutWipe(state.Wipe{BackingFile: path, Pool: pool.Name, Size: info.Size(), QueuedAt: info.ModTime()}); err != nil {
+				klog.Warningf("Failed to queue %s for wiping: %v", path, err)
+			}
+		}
+	}
+}
+
+// wipeAll wipes the queued backing files in the order they were queued, until ctx is done.
+// Failures are recorded with the wipe, which is retried on the next pass.
+func (w *Wiper) wipeAll(ctx context.Context) {
+	for _, wipe := range w.State.Wipes() {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := w.wipe(ctx, wipe); err != nil {
+			// The wipe may have made progress before failing
+			if current, ok := w.State.GetWipe(wipe.BackingFile); ok {
+				wipe = current
+			}
+			wipe.Attempts++
+			wipe.Error = err.Error()
+			klog.Warningf("Failed to wipe backing file %s of volume %s (attempt %d): %v", wipe.BackingFile, wipe.VolumeID, wipe.Attempts, err)
+			if err := w.State.PutWipe(wipe); err != nil {
+				klog.Warningf("Failed to record wipe of %s: %v", wipe.BackingFile, err)
+			}
+		}
+	}
+}
+
+// wipe overwrites a queued backing file, then removes it and its record.
+// Copy-on-write files are discarded instead, see overwrite. A backing file that is already gone,
+// e.g. removed by a pass that failed to delete the record, is finished.
+func (w *Wiper) wipe(ctx context.Context, wipe state.Wipe) error {
+	if _, err := w.Env.FS.Stat(wipe.BackingFile); errors.Is(err, os.ErrNotExist) {
+		klog.Infof("Backing file %s of volume %s is already gone", wipe.BackingFile, wipe.VolumeID)
+		return w.State.DeleteWipe(wipe.BackingFile)
+	}
+
+	klog.Infof("Wiping backing file %s of volume %s from offset %d", wipe.BackingFile, wipe.VolumeID, wipe.Offset)
+	err := w.overwrite(ctx, wipe)
+	if errors.Is(err, errCopyOnWrite) {
+		klog.Warningf("Discarding backing file %s of volume %s instead of overwriting it: %v", wipe.BackingFile, wipe.VolumeID, err)
+		err = w.Env.Loop.PunchHole(w.Env.RealPath(wipe.BackingFile), 0, wipe.Size)
+	}
+	if err != nil {
+		return err
+	}
+	if err := w.Env.FS.Remove(wipe.BackingFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	klog.Infof("Wiped backing file %s of volume %s", wipe.BackingFile, wipe.VolumeID)
+	return w.State.DeleteWipe(wipe.BackingFile)
+}
+
+// overwrite overwrites the data of a queued backing file with zeros, starting at the recorded
+// offset. Holes of the sparse file are skipped, so wiping never allocates space.
+// Progress is recorded in the state every wipeProgressInterval bytes.
+//
+// Files on btrfs or sharing extents with reflinked clones are refused with errCopyOnWrite,
+// since their zeros would be written to new blocks and leave the old data on the disk.
+func (w *Wiper) overwrite(ctx context.Context, wipe state.Wipe) error {
+	cow, err := w.Env.CopyOnWrite(wipe.BackingFile)
+	if err != nil {
+		return fmt.Errorf("failed to check for copy-on-write: %v", err)
+	}
+	if cow {
+		return errCopyOnWrite
+	}
+
+	extents, err := w.Env.DataExtents(wipe.BackingFile)
+	if err != nil {
+		return fmt.Errorf("failed to find data: %v", err)
+	}
+
+	f, err := w.Env.FS.OpenFile(wipe.BackingFile, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zeros := make([]byte, wipeChunkSize)
+	recorded := wipe.Offset
+	for _, extent := range extents {
+		end := extent[0] + extent[1]
+		for offset := max(extent[0], wipe.Offset); offset < end; {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			n := min(end-offset, wipeChunkSize)
+			if _, err := f.WriteAt(zeros[:n], offset); err != nil {
+				return err
+			}
+			offset += n
+
+			if offset-recorded >= wipeProgressInterval {
+				if err := f.Sync(); err != nil {
+					return err
+				}
+				wipe.Offset, recorded = offset, offset
+				w.State.PutWipe(wipe)
+			}
+		}
+	}
+	// The zeros must reach the disk before the file is removed, or its dirty pages are just dropped
+	return f.Sync()
+}
+
+// removeBackingFile removes the backing file of a deleted volume according to the wipe policy
+// of its pool, see removeDataFile.
+func removeBackingFile(env *conf.Env, cfg *config.Config, store *state.Store, volume state.Volume) {
+	pool := dataPool(cfg, volume.Pool, filepath.Dir(volume.BackingFile))
+	removeDataFile(env, store, pool, volume.ID, volume.BackingFile, volume.Size)
+}
+
+// removeDataFile removes a file holding volume data in a pool, the backing file of a volume or
+// a cache, snapshot or archive image, according to the wipe policy of the pool. Discarded files
+// have their blocks punched out first, files to overwrite are moved to the wipe directory of the
+// pool and queued for the wiper. Files are removed without wiping if that fails.
+// The file is named by id, the volume, cache, snapshot or archive it belongs to.
+func removeDataFile(env *conf.Env, store *state.Store, pool config.Pool, id, path string, size int64) {
+	switch pool.WipePolicy {
+	case config.WipePolicyDiscard:
+		if err := env.Loop.PunchHole(env.RealPath(path), 0, size); err != nil {
+			klog.Warningf("Failed to discard backing file of %s: %v", id, err)
+		}
+	case config.WipePolicyOverwrite:
+		if err := queueWipe(env, store, pool, id, path, size); err != nil {
+			klog.Warningf("Failed to queue backing file of %s for wiping: %v", id, err)
+		} else {
+			return
+		}
+	}
+	env.FS.Remove(path)
+}
+
+// dataPool returns the pool with the given name, or without a name the pool in the directory dir.
+// Files of pools that are no longer configured are wiped according to the node's wipe policy.
+func dataPool(cfg *config.Config, name, dir string) config.Pool {
+	for _, pool := range cfg.AllPools() {
+		if pool.Name == name || name == "" && pool.Path == dir {
+			return pool
+		}
+	}
+	return config.Pool{Name: name, Path: dir, WipePolicy: cfg.WipePolicy}
+}
+
+// queueWipe moves a file holding volume data to the wipe directory of its pool,
+// records it in the state and wakes the wiper.
+func queueWipe(env *conf.Env, store *state.Store, pool config.Pool, id, path string, size int64) error {
+	now := env.Now()
+	wipe := state.Wipe{
+		BackingFile: wipeFilePath(pool.Path, strings.TrimSuffix(filepath.Base(path), ".img"), now),
+		VolumeID:    id,
+		Pool:        pool.Name,
+		Size:        size,
+		QueuedAt:    now,
+	}
+
+	env.FS.MkdirAll(filepath.Dir(wipe.BackingFile), 0755)
+	if err := env.FS.Rename(path, wipe.BackingFile); err != nil {
+		return err
+	}
+	if err := store.PutWipe(wipe); err != nil {
+		klog.Warningf("Failed to record wipe of %s, it is queued again on the next start: %v", id, err)
+		return nil
+	}
+
+	klog.Infof("Queued backing file of %s for wiping", id)
+	select {
+	case env.WipeQueued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// wipeFilePath returns the path a file named name queued for wiping is moved to, unique per deletion
+// so a new volume with the same ID never collides with it.
+func wipeFilePath(dir, name string, queuedAt time.Time) string {
+	return filepath.Join(dir, wipeSubdir, fmt.Sprintf("%s-%d.img", name, queuedAt.UnixNano()))
+}
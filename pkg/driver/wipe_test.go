@@ -0,0 +1,303 @@
+// Wiping of deleted backing files tests.
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/conf/conftest"
+	"github.com/marxus/csi-loop-driver/pkg/config"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// mockDataExtents makes env report the given extents for every file.
+func mockDataExtents(env *conf.Env, extents [][2]int64, err error) {
+	env.DataExtents = func(path string) ([][2]int64, error) {
+		return extents, err
+	}
+}
+
+// mockCopyOnWrite makes env report whether every file is copy-on-write.
+func mockCopyOnWrite(env *conf.Env, cow bool) {
+	env.CopyOnWrite = func(path string) (bool, error) {
+		return cow, nil
+	}
+}
+
+func TestReleaseVolume_WipePolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		policy       string
+		wantCommands []string
+		wantQueued   bool
+	}{
+		{
+			name: "removes without wiping by default",
+		},
+		{
+			name:         "punches holes before removing",
+			policy:       config.WipePolicyDiscard,
+			wantCommands: []string{"[fallocate --punch-hole --offset 0 --length 4096 /var/lib/csi-loop/csi-1.img]"},
+		},
+		{
+			name:       "queues for overwriting",
+			policy:     config.WipePolicyOverwrite,
+			wantQueued: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			var commands []string
+			mockCommands(env, func(name string, args ...string) error {
+				commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+				return nil
+			})
+
+			cfg := config.Default()
+			cfg.WipePolicy = tt.policy
+			store := newTestState(t, env)
+			volume := state.Volume{ID: "csi-1", BackingFile: backingFilePath(config.DefaultPoolPath, "csi-1"), Size: 4096}
+			require.NoError(t, afero.WriteFile(env.FS, volume.BackingFile, []byte("secret"), 0644))
+			require.NoError(t, store.PutVolume(volume))
+
+			require.NoError(t, releaseVolume(env, cfg, store, volume))
+
+			assert.Equal(t, tt.wantCommands, commands)
+			exists, _ := afero.Exists(env.FS, volume.BackingFile)
+			assert.False(t, exists, "backing file should be gone")
+			_, ok := store.GetVolume("csi-1")
+			assert.False(t, ok)
+
+			wipes := store.Wipes()
+			if !tt.wantQueued {
+				assert.Empty(t, wipes)
+				return
+			}
+			require.Len(t, wipes, 1)
+			assert.Equal(t, "csi-1", wipes[0].VolumeID)
+			assert.Equal(t, int64(4096), wipes[0].Size)
+			assert.Equal(t, filepath.Join(config.DefaultPoolPath, wipeSubdir), filepath.Dir(wipes[0].BackingFile))
+			content, err := afero.ReadFile(env.FS, wipes[0].BackingFile)
+			require.NoError(t, err)
+			assert.Equal(t, "secret", string(content), "queued backing file should keep its data until wiped")
+		})
+	}
+}
+
+func TestRemoveDataFile_WipePolicy(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		path   string
+		id     string
+		remove func(t *testing.T, env *conf.Env, cfg *config.Config, store *state.Store)
+	}{
+		{
+			name: "queues evicted caches",
+			path: "/var/lib/csi-loop/caches/ci_go-mod.img",
+			id:   "ci/go-mod",
+			remove: func(t *testing.T, env *conf.Env, cfg *config.Config, store *state.Store) {
+				cacheCapacity := resource.MustParse("0")
+				cfg.CacheCapacity = &cacheCapacity
+				require.NoError(t, store.PutCache(state.Cache{Key: "ci/go-mod", Pool: config.DefaultPoolName, BackingFile: "/var/lib/csi-loop/caches/ci_go-mod.img", Size: 4096, LastUsedAt: now}))
+				evictCaches(env, cfg, store, config.DefaultPoolName)
+			},
+		},
+		{
+			name: "queues pruned archives",
+			path: "/var/lib/csi-loop/archive/csi-1-20260101T000000Z.img",
+			id:   "csi-1-20260101T000000Z",
+			remove: func(t *testing.T, env *conf.Env, cfg *config.Config, store *state.Store) {
+				maxSize := resource.MustParse("0")
+				cfg.Archive.MaxSize = &maxSize
+				pool, _ := cfg.Pool(config.DefaultPoolName)
+				pruneArchives(env, cfg, store, pool)
+			},
+		},
+		{
+			name: "queues deleted snapshots",
+			path: "/var/lib/csi-loop/snapshots/snap-1.img",
+			id:   "snap-1",
+			remove: func(t *testing.T, env *conf.Env, cfg *config.Config, store *state.Store) {
+				require.NoError(t, store.PutSnapshot(state.Snapshot{ID: "snap-1", BackingFile: "/var/lib/csi-loop/snapshots/snap-1.img", Size: 4096, CreatedAt: now}))
+				cs := NewControllerServer(env, cfg, store)
+				_, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"})
+				require.NoError(t, err)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := conftest.New()
+			cfg := config.Default()
+			cfg.WipePolicy = config.WipePolicyOverwrite
+			store := newTestState(t, env)
+			env.FS.MkdirAll(filepath.Dir(tt.path), 0755)
+			require.NoError(t, afero.WriteFile(env.FS, tt.path, []byte("secret"), 0644))
+
+			tt.remove(t, env, cfg, store)
+
+			exists, _ := afero.Exists(env.FS, tt.path)
+			assert.False(t, exists, "image should be gone")
+			wipes := store.Wipes()
+			require.Len(t, wipes, 1)
+			assert.Equal(t, tt.id, wipes[0].VolumeID)
+			assert.Equal(t, filepath.Join(config.DefaultPoolPath, wipeSubdir), filepath.Dir(wipes[0].BackingFile))
+			content, err := afero.ReadFile(env.FS, wipes[0].BackingFile)
+			require.NoError(t, err)
+			assert.Equal(t, "secret", string(content), "queued image should keep its data until wiped")
+		})
+	}
+}
+
+func TestWiper_Overwrite(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	path := wipeFilePath(config.DefaultPoolPath, "csi-1", time.Now())
+	env.FS.MkdirAll(filepath.Dir(path), 0755)
+
+	content := bytes.Repeat([]byte("s"), 64)
+	require.NoError(t, afero.WriteFile(env.FS, path, content, 0644))
+
+	// Only the data extents past the recorded offset are overwritten
+	mockCopyOnWrite(env, false)
+	mockDataExtents(env, [][2]int64{{0, 16}, {32, 16}}, nil)
+	w := NewWiper(env, config.Default(), newTestState(t, env))
+	require.NoError(t, w.overwrite(context.Background(), state.Wipe{BackingFile: path, Offset: 8}))
+
+	got, err := afero.ReadFile(env.FS, path)
+	require.NoError(t, err)
+	want := bytes.Repeat([]byte("s"), 64)
+	copy(want[8:16], make([]byte, 8))
+	copy(want[32:48], make([]byte, 16))
+	assert.Equal(t, want, got)
+}
+
+func TestWiper_WipeAll(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	store := newTestState(t, env)
+	w := NewWiper(env, config.Default(), store)
+	wipe := state.Wipe{BackingFile: wipeFilePath(config.DefaultPoolPath, "csi-1", time.Now()), VolumeID: "csi-1", Size: 64, QueuedAt: time.Now()}
+	env.FS.MkdirAll(filepath.Dir(wipe.BackingFile), 0755)
+	require.NoError(t, afero.WriteFile(env.FS, wipe.BackingFile, make([]byte, 64), 0644))
+	require.NoError(t, store.PutWipe(wipe))
+
+	// Failures are recorded and the file is kept for the next attempt
+	mockCopyOnWrite(env, false)
+	mockDataExtents(env, nil, fmt.Errorf("lseek failed"))
+	w.wipeAll(context.Background())
+
+	failed, ok := store.GetWipe(wipe.BackingFile)
+	require.True(t, ok)
+	assert.Equal(t, 1, failed.Attempts)
+	assert.Contains(t, failed.Error, "lseek failed")
+	exists, _ := afero.Exists(env.FS, wipe.BackingFile)
+	assert.True(t, exists)
+
+	// A successful wipe removes the file and its record
+	mockDataExtents(env, [][2]int64{{0, 64}}, nil)
+	w.wipeAll(context.Background())
+
+	assert.Empty(t, store.Wipes())
+	exists, _ = afero.Exists(env.FS, wipe.BackingFile)
+	assert.False(t, exists)
+}
+
+func TestWiper_MissingBackingFile(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	store := newTestState(t, env)
+	w := NewWiper(env, config.Default(), store)
+	// The file was removed by a pass that failed to delete the record
+	wipe := state.Wipe{BackingFile: wipeFilePath(config.DefaultPoolPath, "csi-1", time.Now()), VolumeID: "csi-1", Size: 64, Attempts: 1, QueuedAt: time.Now()}
+	require.NoError(t, store.PutWipe(wipe))
+
+	w.wipeAll(context.Background())
+
+	assert.Empty(t, store.Wipes(), "wipe of a missing backing file should be finished")
+}
+
+func TestWiper_CopyOnWrite(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	var commands []string
+	mockCommands(env, func(name string, args ...string) error {
+		commands = append(commands, fmt.Sprint(append([]string{name}, args...)))
+		return nil
+	})
+	mockCopyOnWrite(env, true)
+	mockDataExtents(env, [][2]int64{{0, 64}}, nil)
+
+	store := newTestState(t, env)
+	w := NewWiper(env, config.Default(), store)
+	wipe := state.Wipe{BackingFile: wipeFilePath(config.DefaultPoolPath, "csi-1", time.Now()), VolumeID: "csi-1", Size: 64, QueuedAt: time.Now()}
+	env.FS.MkdirAll(filepath.Dir(wipe.BackingFile), 0755)
+	content := bytes.Repeat([]byte("s"), 64)
+	require.NoError(t, afero.WriteFile(env.FS, wipe.BackingFile, content, 0644))
+	require.NoError(t, store.PutWipe(wipe))
+
+	// Overwriting is refused, the zeros would not reach the old blocks
+	err := w.overwrite(context.Background(), wipe)
+	assert.ErrorIs(t, err, errCopyOnWrite)
+	got, err := afero.ReadFile(env.FS, wipe.BackingFile)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	// The wiper discards the file instead
+	w.wipeAll(context.Background())
+
+	assert.Equal(t, []string{fmt.Sprintf("[fallocate --punch-hole --offset 0 --length 64 %s]", wipe.BackingFile)}, commands)
+	assert.Empty(t, store.Wipes())
+	exists, _ := afero.Exists(env.FS, wipe.BackingFile)
+	assert.False(t, exists)
+}
+
+func TestWiper_Recover(t *testing.T) {
+	t.Parallel()
+
+	env := conftest.New()
+	store := newTestState(t, env)
+	w := NewWiper(env, config.Default(), store)
+	recorded := wipeFilePath(config.DefaultPoolPath, "csi-1", time.Unix(1, 0))
+	unrecorded := wipeFilePath(config.DefaultPoolPath, "csi-2", time.Unix(2, 0))
+	env.FS.MkdirAll(filepath.Dir(recorded), 0755)
+	require.NoError(t, afero.WriteFile(env.FS, recorded, make([]byte, 8), 0644))
+	require.NoError(t, afero.WriteFile(env.FS, unrecorded, make([]byte, 16), 0644))
+	require.NoError(t, store.PutWipe(state.Wipe{BackingFile: recorded, VolumeID: "csi-1", Offset: 4}))
+
+	w.recover()
+
+	wipes := store.Wipes()
+	require.Len(t, wipes, 2)
+	current, _ := store.GetWipe(recorded)
+	assert.Equal(t, int64(4), current.Offset, "recorded wipes should keep their progress")
+	queued, ok := store.GetWipe(unrecorded)
+	require.True(t, ok)
+	assert.Equal(t, int64(16), queued.Size)
+}
@@ -0,0 +1,65 @@
+package mount
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Fake is a Mounter and LoopManager for tests. Instead of performing an operation, it reports
+// it to Run as the equivalent util-linux command, e.g. mount -o loop,ro /a.img /mnt, so tests
+// can record and fail it along with the other commands they run. Filesystem types are left
+// out like mount(8) detects them.
+type Fake struct {
+	// Run is called with every operation.
+	Run func(name string, args ...string) error
+}
+
+// FakeLoopDevice is the loop device Attach of a Fake returns.
+const FakeLoopDevice = "/dev/loop0"
+
+func (f *Fake) Mount(source, target, fsType string, options []string) error {
+	return f.Run("mount", "-o", joinOptions(options), source, target)
+}
+
+func (f *Fake) BindMount(source, target string) error {
+	return f.Run("mount", "--bind", source, target)
+}
+
+func (f *Fake) Remount(target string, options []string) error {
+	return f.Run("mount", "-o", joinOptions(append([]string{"remount"}, options...)), target)
+}
+
+func (f *Fake) Unmount(target string) error {
+	return f.Run("umount", target)
+}
+
+func (f *Fake) Truncate(path string, size int64) error {
+	return f.Run("truncate", "-s", fmt.Sprint(size), path)
+}
+
+func (f *Fake) PunchHole(path string, offset, length int64) error {
+	return f.Run("fallocate", "--punch-hole", "--offset", fmt.Sprint(offset), "--length", fmt.Sprint(length), path)
+}
+
+func (f *Fake) Attach(path string, readOnly bool) (string, error) {
+	args := []string{"--find", "--show"}
+	if readOnly {
+		args = append(args, "--read-only")
+	}
+	if err := f.Run("losetup", append(args, path)...); err != nil {
+		return "", err
+	}
+	return FakeLoopDevice, nil
+}
+
+func (f *Fake) Detach(device string) error {
+	return f.Run("losetup", "--detach", device)
+}
+
+// joinOptions joins mount options for mount -o, defaults without any.
+func joinOptions(options []string) string {
+	if len(options) == 0 {
+		return "defaults"
+	}
+	return strings.Join(options, ",")
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package mount
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// parseIDMappings parses the space-separated u:, g: and b: mappings of containerID:hostID:length
+// of an X-mount.idmap option into user and group mappings.
+func parseIDMappings(mappings string) (uids, gids []syscall.SysProcIDMap, err error) {
+	for _, mapping := range strings.Fields(mappings) {
+		fields := strings.Split(mapping, ":")
+		if len(fields) != 4 {
+			return nil, nil, fmt.Errorf("invalid ID mapping %q", mapping)
+		}
+		var ids [3]int
+		for i, field := range fields[1:] {
+			if ids[i], err = strconv.Atoi(field); err != nil || ids[i] < 0 {
+				return nil, nil, fmt.Errorf("invalid ID mapping %q", mapping)
+			}
+		}
+		idMap := syscall.SysProcIDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}
+		switch fields[0] {
+		case "u":
+			uids = append(uids, idMap)
+		case "g":
+			gids = append(gids, idMap)
+		case "b":
+			uids, gids = append(uids, idMap), append(gids, idMap)
+		default:
+			return nil, nil, fmt.Errorf("invalid ID mapping %q", mapping)
+		}
+	}
+	return uids, gids, nil
+}
+
+// userNamespace returns a file descriptor of a new user namespace with the given mappings.
+// The namespace is created by a child process that is stopped by ptrace when it executes and
+// killed once the namespace is open, so it never runs.
+func userNamespace(mappings string) (int, error) {
+	uids, gids, err := parseIDMappings(mappings)
+	if err != nil {
+		return -1, err
+	}
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: uids,
+		GidMappings: gids,
+		Ptrace:      true,
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	if err := cmd.Start(); err != nil {
+		return -1, fmt.Errorf("failed to create user namespace: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	path := fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid)
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return fd, nil
+}
+
+// idmapMount replaces the mount at target with a clone ID-mapped with the given mappings,
+// so files owned by an ID on disk appear owned by the ID it is mapped to.
+func idmapMount(target, mappings string) error {
+	userns, err := userNamespace(mappings)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(userns)
+
+	tree, err := unix.OpenTree(unix.AT_FDCWD, target, unix.OPEN_TREE_CLONE|unix.O_CLOEXEC)
+	if err != nil {
+		return &os.PathError{Op: "open_tree", Path: target, Err: err}
+	}
+	defer unix.Close(tree)
+
+	attr := unix.MountAttr{Attr_set: unix.MOUNT_ATTR_IDMAP, Userns_fd: uint64(userns)}
+	if err := unix.MountSetattr(tree, "", unix.AT_EMPTY_PATH, &attr); err != nil {
+		return &os.PathError{Op: "mount_setattr", Path: target, Err: err}
+	}
+	// The clone keeps the filesystem mounted while it replaces the original mount
+	if err := unix.Unmount(target, unix.MNT_DETACH); err != nil {
+		return &os.PathError{Op: "umount", Path: target, Err: err}
+	}
+	if err := unix.MoveMount(tree, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return &os.PathError{Op: "move_mount", Path: target, Err: err}
+	}
+	return nil
+}
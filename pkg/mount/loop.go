@@ -0,0 +1,25 @@
+package mount
+
+import "os"
+
+// LoopManager manages backing files and the loop devices they are attached to.
+type LoopManager interface {
+	// Truncate creates the backing file at path as a sparse file of size bytes, or resizes it.
+	Truncate(path string, size int64) error
+	// PunchHole deallocates length bytes of the backing file at path from offset, keeping its size.
+	PunchHole(path string, offset, length int64) error
+	// Attach attaches the backing file at path to a free loop device, read-only if requested,
+	// and returns the device. It stays attached until detached.
+	Attach(path string, readOnly bool) (string, error)
+	// Detach detaches a loop device from its backing file.
+	Detach(device string) error
+}
+
+func (l *loopManager) Truncate(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Truncate(size)
+}
@@ -0,0 +1,147 @@
+//go:build linux
+
+package mount
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// loopControl is the device handing out free loop devices.
+const loopControl = "/dev/loop-control"
+
+// loopMajor is the major device number of loop devices.
+const loopMajor = 7
+
+// attachAttempts is how often attaching retries with another free loop device, when another
+// process took the free one first.
+const attachAttempts = 5
+
+// loopManager manages loop devices with the ioctls of the loop driver.
+type loopManager struct{}
+
+// NewLoopManager returns a LoopManager using system calls.
+func NewLoopManager() LoopManager {
+	return &loopManager{}
+}
+
+func (l *loopManager) PunchHole(path string, offset, length int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length); err != nil {
+		return &os.PathError{Op: "fallocate", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (l *loopManager) Attach(path string, readOnly bool) (string, error) {
+	mode := os.O_RDWR
+	if readOnly {
+		mode = os.O_RDONLY
+	}
+	backing, err := os.OpenFile(path, mode, 0)
+	if err != nil {
+		return "", err
+	}
+	defer backing.Close()
+
+	control, err := os.OpenFile(loopControl, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer control.Close()
+
+	for range attachAttempts {
+		number, err := unix.IoctlRetInt(int(control.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return "", &os.PathError{Op: "LOOP_CTL_GET_FREE", Path: loopControl, Err: err}
+		}
+		device := fmt.Sprintf("/dev/loop%d", number)
+		err = configure(device, number, backing, mode)
+		if errors.Is(err, unix.EBUSY) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return device, nil
+	}
+	return "", &os.PathError{Op: "attach", Path: path, Err: unix.EBUSY}
+}
+
+// configure attaches an open backing file to the given free loop device, creating its device
+// node if devtmpfs has not yet.
+//
+// Returns EBUSY if another process attached the device first.
+func configure(device string, number int, backing *os.File, mode int) error {
+	loop, err := os.OpenFile(device, mode, 0)
+	if os.IsNotExist(err) {
+		if err := unix.Mknod(device, unix.S_IFBLK|0660, int(unix.Mkdev(loopMajor, uint32(number)))); err != nil && !errors.Is(err, unix.EEXIST) {
+			return &os.PathError{Op: "mknod", Path: device, Err: err}
+		}
+		loop, err = os.OpenFile(device, mode, 0)
+	}
+	if err != nil {
+		return err
+	}
+	defer loop.Close()
+
+	config := unix.LoopConfig{Fd: uint32(backing.Fd())}
+	copy(config.Info.File_name[:len(config.Info.File_name)-1], backing.Name())
+	if mode == os.O_RDONLY {
+		config.Info.Flags |= unix.LO_FLAGS_READ_ONLY
+	}
+	err = unix.IoctlLoopConfigure(int(loop.Fd()), &config)
+	if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) {
+		// Kernels before 5.8 attach in two steps
+		err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backing.Fd()))
+		if err == nil {
+			if err = unix.IoctlLoopSetStatus64(int(loop.Fd()), &config.Info); err != nil {
+				unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+			}
+		}
+	}
+	if err != nil {
+		return &os.PathError{Op: "LOOP_CONFIGURE", Path: device, Err: err}
+	}
+	return nil
+}
+
+// autoclear makes the kernel detach a loop device once it is no longer used, so the device
+// of a mounted filesystem is detached when it is unmounted.
+func (l *loopManager) autoclear(device string) error {
+	loop, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer loop.Close()
+
+	info, err := unix.IoctlLoopGetStatus64(int(loop.Fd()))
+	if err == nil {
+		info.Flags |= unix.LO_FLAGS_AUTOCLEAR
+		err = unix.IoctlLoopSetStatus64(int(loop.Fd()), info)
+	}
+	if err != nil {
+		return &os.PathError{Op: "LOOP_SET_STATUS64", Path: device, Err: err}
+	}
+	return nil
+}
+
+func (l *loopManager) Detach(device string) error {
+	loop, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer loop.Close()
+
+	if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0); err != nil {
+		return &os.PathError{Op: "LOOP_CLR_FD", Path: device, Err: err}
+	}
+	return nil
+}
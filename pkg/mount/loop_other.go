@@ -0,0 +1,29 @@
+//go:build !linux
+
+package mount
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// loopManager fails with ENOTSUP outside of Linux, except for truncating backing files.
+type loopManager struct{}
+
+// NewLoopManager returns a LoopManager failing with ENOTSUP outside of Linux.
+func NewLoopManager() LoopManager {
+	return &loopManager{}
+}
+
+func (l *loopManager) PunchHole(path string, offset, length int64) error {
+	return &os.PathError{Op: "fallocate", Path: path, Err: unix.ENOTSUP}
+}
+
+func (l *loopManager) Attach(path string, readOnly bool) (string, error) {
+	return "", &os.PathError{Op: "open", Path: path, Err: unix.ENOTSUP}
+}
+
+func (l *loopManager) Detach(device string) error {
+	return &os.PathError{Op: "ioctl", Path: device, Err: unix.ENOTSUP}
+}
@@ -0,0 +1,36 @@
+// Package mount mounts filesystems and manages loop devices through system calls, without
+// depending on util-linux. Failed calls return *os.PathError wrapping the errno, so callers
+// can tell a busy target from a missing one with errors.Is, e.g. errors.Is(err, unix.EBUSY).
+package mount
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// idmapOption is the prefix of the option ID-mapping a mount, as X-mount.idmap of util-linux:
+// space-separated u:, g: or b: mappings of containerID:hostID:length.
+const idmapOption = "X-mount.idmap="
+
+// Mounter mounts filesystems.
+type Mounter interface {
+	// Mount mounts the filesystem of type fsType on source at target. The loop option
+	// attaches source to a loop device first, which is detached again once unmounted.
+	// The X-mount.idmap option ID-maps the mount.
+	Mount(source, target, fsType string, options []string) error
+	// BindMount mounts the mount at source at target too.
+	BindMount(source, target string) error
+	// Remount changes the flags of the mount at target. The bind option only changes the flags
+	// of the mount itself, not the flags of the filesystem.
+	Remount(target string, options []string) error
+	// Unmount unmounts the mount at target. Returns EINVAL if nothing is mounted at target,
+	// and EBUSY if the mount is still in use.
+	Unmount(target string) error
+}
+
+// IsNotMounted reports whether an Unmount failed because nothing is mounted at the target,
+// or the target does not exist.
+func IsNotMounted(err error) bool {
+	return errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOENT)
+}
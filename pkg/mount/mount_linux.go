@@ -0,0 +1,135 @@
+//go:build linux
+
+package mount
+
+import (
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountFlags maps the mount options of mount(8) to the flags of mount(2).
+// Per-mount options must be flags, filesystems reject them as data.
+var mountFlags = map[string]uintptr{
+	"ro":          unix.MS_RDONLY,
+	"nosuid":      unix.MS_NOSUID,
+	"nodev":       unix.MS_NODEV,
+	"noexec":      unix.MS_NOEXEC,
+	"noatime":     unix.MS_NOATIME,
+	"nodiratime":  unix.MS_NODIRATIME,
+	"relatime":    unix.MS_RELATIME,
+	"strictatime": unix.MS_STRICTATIME,
+	"lazytime":    unix.MS_LAZYTIME,
+	"sync":        unix.MS_SYNCHRONOUS,
+	"dirsync":     unix.MS_DIRSYNC,
+	"bind":        unix.MS_BIND,
+	"remount":     unix.MS_REMOUNT,
+}
+
+// ignoredOptions lists the mount options of mount(8) setting no flag.
+var ignoredOptions = []string{"defaults", "rw", "suid", "dev", "exec", "atime", "diratime", "async", "loop"}
+
+// parsedOptions holds mount options as understood by mount(2).
+type parsedOptions struct {
+	// flags are the MS_ flags of the options.
+	flags uintptr
+	// data holds the comma-separated filesystem options, e.g. context= or compress=.
+	data string
+	// loop is set by the loop option.
+	loop bool
+	// idmap holds the mappings of the X-mount.idmap option, or "".
+	idmap string
+}
+
+// parseOptions splits mount options into flags, filesystem data, loop and ID mapping.
+func parseOptions(options []string) parsedOptions {
+	var parsed parsedOptions
+	var data []string
+	for _, option := range options {
+		if flag, ok := mountFlags[option]; ok {
+			parsed.flags |= flag
+			continue
+		}
+		if mappings, ok := strings.CutPrefix(option, idmapOption); ok {
+			parsed.idmap = mappings
+			continue
+		}
+		parsed.loop = parsed.loop || option == "loop"
+		// Other X- options are for userspace only
+		if slices.Contains(ignoredOptions, option) || strings.HasPrefix(option, "X-") {
+			continue
+		}
+		data = append(data, option)
+	}
+	parsed.data = strings.Join(data, ",")
+	return parsed
+}
+
+// mounter mounts filesystems with mount(2), attaching loop devices with its loop manager.
+type mounter struct {
+	loop *loopManager
+}
+
+// NewMounter returns a Mounter using system calls.
+func NewMounter() Mounter {
+	return &mounter{loop: &loopManager{}}
+}
+
+func (m *mounter) Mount(source, target, fsType string, options []string) error {
+	parsed := parseOptions(options)
+
+	device := source
+	if parsed.loop {
+		attached, err := m.loop.Attach(source, parsed.flags&unix.MS_RDONLY != 0)
+		if err != nil {
+			return err
+		}
+		device = attached
+	}
+
+	err := unix.Mount(device, target, fsType, parsed.flags, parsed.data)
+	if err != nil {
+		err = &os.PathError{Op: "mount", Path: target, Err: err}
+	}
+	if parsed.loop {
+		// The mount holds the loop device from now on, it is detached once unmounted
+		if err == nil {
+			err = m.loop.autoclear(device)
+		}
+		if err != nil {
+			unix.Unmount(target, 0)
+			m.loop.Detach(device)
+			return err
+		}
+	}
+	if err == nil && parsed.idmap != "" {
+		if err = idmapMount(target, parsed.idmap); err != nil {
+			unix.Unmount(target, 0)
+		}
+	}
+	return err
+}
+
+func (m *mounter) BindMount(source, target string) error {
+	if err := unix.Mount(source, target, "", unix.MS_BIND, ""); err != nil {
+		return &os.PathError{Op: "mount", Path: target, Err: err}
+	}
+	return nil
+}
+
+func (m *mounter) Remount(target string, options []string) error {
+	parsed := parseOptions(options)
+	if err := unix.Mount("", target, "", parsed.flags|unix.MS_REMOUNT, parsed.data); err != nil {
+		return &os.PathError{Op: "remount", Path: target, Err: err}
+	}
+	return nil
+}
+
+func (m *mounter) Unmount(target string) error {
+	if err := unix.Unmount(target, 0); err != nil {
+		return &os.PathError{Op: "umount", Path: target, Err: err}
+	}
+	return nil
+}
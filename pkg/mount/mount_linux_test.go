@@ -0,0 +1,77 @@
+//go:build linux
+
+package mount
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseOptions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		options []string
+		want    parsedOptions
+	}{
+		{
+			name: "parses no options",
+		},
+		{
+			name:    "sets flags of hardened options",
+			options: []string{"loop", "ro", "nosuid", "nodev", "noexec"},
+			want:    parsedOptions{flags: unix.MS_RDONLY | unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, loop: true},
+		},
+		{
+			name:    "sets flags of per-mount options",
+			options: []string{"noatime", "nodiratime", "lazytime", "sync", "dirsync"},
+			want:    parsedOptions{flags: unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_LAZYTIME | unix.MS_SYNCHRONOUS | unix.MS_DIRSYNC},
+		},
+		{
+			name:    "sets flags of access time options",
+			options: []string{"relatime", "strictatime"},
+			want:    parsedOptions{flags: unix.MS_RELATIME | unix.MS_STRICTATIME},
+		},
+		{
+			name:    "ignores options setting no flag",
+			options: []string{"defaults", "rw", "suid", "dev", "exec", "atime", "diratime", "async", "X-mount.mkdir"},
+		},
+		{
+			name:    "passes filesystem options as data",
+			options: []string{"nosuid", `context="system_u:object_r:container_file_t:s0:c1,c2"`, "noatime", "compress=zstd"},
+			want:    parsedOptions{flags: unix.MS_NOSUID | unix.MS_NOATIME, data: `context="system_u:object_r:container_file_t:s0:c1,c2",compress=zstd`},
+		},
+		{
+			name:    "takes the ID mapping",
+			options: []string{"loop", "X-mount.idmap=u:0:65536:65536 g:0:65536:65536"},
+			want:    parsedOptions{loop: true, idmap: "u:0:65536:65536 g:0:65536:65536"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.want, parseOptions(tt.options))
+		})
+	}
+}
+
+func TestParseIDMappings(t *testing.T) {
+	t.Parallel()
+
+	uids, gids, err := parseIDMappings("u:0:131072:65536 g:0:196608:65536 b:65536:1000:1")
+	require.NoError(t, err)
+	assert.Equal(t, []syscall.SysProcIDMap{{ContainerID: 0, HostID: 131072, Size: 65536}, {ContainerID: 65536, HostID: 1000, Size: 1}}, uids)
+	assert.Equal(t, []syscall.SysProcIDMap{{ContainerID: 0, HostID: 196608, Size: 65536}, {ContainerID: 65536, HostID: 1000, Size: 1}}, gids)
+
+	for _, mappings := range []string{"0:131072:65536", "x:0:131072:65536", "u:0:-1:65536", "u:0:a:1"} {
+		_, _, err := parseIDMappings(mappings)
+		assert.Error(t, err, mappings)
+	}
+}
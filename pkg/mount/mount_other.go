@@ -0,0 +1,33 @@
+//go:build !linux
+
+package mount
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mounter fails every mount with ENOTSUP, mount(2) and its flags being specific to Linux.
+type mounter struct{}
+
+// NewMounter returns a Mounter failing with ENOTSUP outside of Linux.
+func NewMounter() Mounter {
+	return &mounter{}
+}
+
+func (m *mounter) Mount(source, target, fsType string, options []string) error {
+	return &os.PathError{Op: "mount", Path: target, Err: unix.ENOTSUP}
+}
+
+func (m *mounter) BindMount(source, target string) error {
+	return &os.PathError{Op: "mount", Path: target, Err: unix.ENOTSUP}
+}
+
+func (m *mounter) Remount(target string, options []string) error {
+	return &os.PathError{Op: "mount", Path: target, Err: unix.ENOTSUP}
+}
+
+func (m *mounter) Unmount(target string) error {
+	return &os.PathError{Op: "umount", Path: target, Err: unix.ENOTSUP}
+}
@@ -0,0 +1,87 @@
+// Mount and loop device tests.
+package mount
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestFake(t *testing.T) {
+	t.Parallel()
+
+	var commands [][]string
+	fake := &Fake{Run: func(name string, args ...string) error {
+		commands = append(commands, append([]string{name}, args...))
+		return nil
+	}}
+
+	require.NoError(t, fake.Mount("/a.img", "/mnt", "btrfs", []string{"loop", "nosuid"}))
+	require.NoError(t, fake.Mount("/dev/mapper/a", "/mnt", "btrfs", nil))
+	require.NoError(t, fake.BindMount("/mnt", "/mnt2"))
+	require.NoError(t, fake.Remount("/mnt2", []string{"bind", "ro"}))
+	require.NoError(t, fake.Unmount("/mnt"))
+	require.NoError(t, fake.Truncate("/a.img", 1024))
+	require.NoError(t, fake.PunchHole("/a.img", 0, 1024))
+	device, err := fake.Attach("/a.img", true)
+	require.NoError(t, err)
+	assert.Equal(t, FakeLoopDevice, device)
+	require.NoError(t, fake.Detach(device))
+
+	assert.Equal(t, [][]string{
+		{"mount", "-o", "loop,nosuid", "/a.img", "/mnt"},
+		{"mount", "-o", "defaults", "/dev/mapper/a", "/mnt"},
+		{"mount", "--bind", "/mnt", "/mnt2"},
+		{"mount", "-o", "remount,bind,ro", "/mnt2"},
+		{"umount", "/mnt"},
+		{"truncate", "-s", "1024", "/a.img"},
+		{"fallocate", "--punch-hole", "--offset", "0", "--length", "1024", "/a.img"},
+		{"losetup", "--find", "--show", "--read-only", "/a.img"},
+		{"losetup", "--detach", "/dev/loop0"},
+	}, commands)
+
+	// Failures of Run are returned as is
+	fake.Run = func(name string, args ...string) error {
+		return &os.PathError{Op: "umount", Path: "/mnt", Err: unix.EBUSY}
+	}
+	assert.ErrorIs(t, fake.Unmount("/mnt"), unix.EBUSY)
+	_, err = fake.Attach("/a.img", false)
+	assert.Error(t, err)
+}
+
+func TestLoopManager_Truncate(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "a.img")
+	loop := NewLoopManager()
+
+	require.NoError(t, loop.Truncate(path, 1<<20))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<20), info.Size())
+
+	// Punching a hole keeps the size
+	if err := loop.PunchHole(path, 0, 1<<20); errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skip("filesystem does not support punching holes")
+	} else {
+		require.NoError(t, err)
+	}
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<20), info.Size())
+
+	assert.ErrorIs(t, loop.PunchHole(filepath.Join(t.TempDir(), "missing.img"), 0, 1), os.ErrNotExist)
+}
+
+func TestIsNotMounted(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, IsNotMounted(&os.PathError{Op: "umount", Path: "/mnt", Err: unix.EINVAL}))
+	assert.True(t, IsNotMounted(&os.PathError{Op: "umount", Path: "/mnt", Err: unix.ENOENT}))
+	assert.False(t, IsNotMounted(&os.PathError{Op: "umount", Path: "/mnt", Err: unix.EBUSY}))
+}
@@ -3,41 +3,83 @@
 package serve
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/http"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/marxus/csi-loop-driver/conf"
+	"github.com/marxus/csi-loop-driver/pkg/config"
 	"github.com/marxus/csi-loop-driver/pkg/driver"
+	"github.com/marxus/csi-loop-driver/pkg/state"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 	"k8s.io/klog/v2"
 )
 
 const socketAddress = "/csi/csi.sock"
 
-// StartDriver starts the CSI loop driver server.
-// It validates the NODE_ID environment variable, creates the gRPC server,
-// registers the CSI services, and starts listening on the Unix socket.
+const configPath = "/etc/csi-loop-driver/config.json"
+
+const statePath = "/var/lib/csi-loop/state.json"
+
+// StartDriver starts the CSI loop driver server in the given environment.
+// It validates the node ID of the environment, loads the driver configuration and state,
+// starts filling the warm pool, wiping deleted backing files, expiring retained volumes,
+// pruning archives and serving metrics, creates the gRPC server, registers the CSI services,
+// and starts listening on the Unix socket.
 //
-// Returns an error if NODE_ID is missing, socket creation fails, or server startup fails.
-func StartDriver() error {
-	if conf.NodeId == "" {
+// Returns an error if the node ID is missing, the configuration or state is invalid,
+// socket creation fails, or server startup fails.
+func StartDriver(env *conf.Env) error {
+	if env.NodeId == "" {
 		return fmt.Errorf("NODE_ID environment variable is required")
 	}
 
-	klog.Infof("Starting CSI driver: nodeID=%s, socketAddr=%s", conf.NodeId, socketAddress)
+	cfg, err := config.Load(env.FS, configPath)
+	if err != nil {
+		return err
+	}
+
+	store, err := state.Open(env.FS, statePath)
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("Starting CSI driver: nodeID=%s, socketAddr=%s", env.NodeId, socketAddress)
 
 	// Remove existing socket if it exists
-	conf.FS.Remove(socketAddress)
+	env.FS.Remove(socketAddress)
 
-	listener, err := net.Listen("unix", conf.RealPath(socketAddress))
+	listener, err := net.Listen("unix", env.RealPath(socketAddress))
 	if err != nil {
 		return fmt.Errorf("failed to listen: %v", err)
 	}
 
+	warmPool := driver.NewWarmPool(env, cfg)
+	go warmPool.Run(context.Background())
+	go driver.NewWiper(env, cfg, store).Run(context.Background())
+
+	env.Metrics.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	go func() {
+		klog.Infof("Serving metrics on %s/metrics", cfg.MetricsAddr())
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(env.Metrics, promhttp.HandlerOpts{}))
+		if err := http.ListenAndServe(cfg.MetricsAddr(), mux); err != nil {
+			klog.Errorf("Failed to serve metrics: %v", err)
+		}
+	}()
+
+	nodeServer := driver.NewNodeServer(env, cfg, store, warmPool)
+	go nodeServer.ExpireRetained(context.Background())
+	go nodeServer.PruneArchives(context.Background())
+
 	server := grpc.NewServer()
-	csi.RegisterIdentityServer(server, &driver.IdentityServer{})
-	csi.RegisterNodeServer(server, &driver.NodeServer{NodeId: conf.NodeId})
+	csi.RegisterIdentityServer(server, driver.NewIdentityServer())
+	csi.RegisterNodeServer(server, nodeServer)
+	csi.RegisterControllerServer(server, driver.NewControllerServer(env, cfg, store))
 
 	klog.Infof("Starting gRPC server on unix://%s", socketAddress)
 	return server.Serve(listener)
@@ -0,0 +1,441 @@
+// Package state persists the driver's bookkeeping about volumes and snapshots.
+// The state is kept in memory and written to a JSON file on every change,
+// so it survives driver restarts.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Volume describes a loop volume on this node.
+// Persistent volumes are created through CreateVolume, ephemeral inline volumes
+// through NodePublishVolume.
+type Volume struct {
+	// ID is the CSI volume ID.
+	ID string `json:"id"`
+	// Ephemeral is set for inline volumes that only live as long as their pod.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	// Namespace is the namespace of the pod or claim the volume belongs to.
+	Namespace string `json:"namespace,omitempty"`
+	// PodName is the name of the pod an ephemeral volume belongs to.
+	PodName string `json:"podName,omitempty"`
+	// PodUID is the UID of the pod an ephemeral volume belongs to.
+	PodUID string `json:"podUid,omitempty"`
+	// ServiceAccount is the service account of the pod an ephemeral volume belongs to.
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	// Pool is the storage pool the backing file lives in, empty for the default pool.
+	Pool string `json:"pool,omitempty"`
+	// Filesystem is the filesystem the backing file is formatted with, empty for btrfs.
+	Filesystem string `json:"filesystem,omitempty"`
+	// BackingFile is the path of the image holding the filesystem.
+	BackingFile string `json:"backingFile"`
+	// Size is the apparent size of the backing file in bytes.
+	Size int64 `json:"size"`
+	// RequestedSize is the size the volume was requested with, before defaults and rounding.
+	RequestedSize string `json:"requestedSize,omitempty"`
+	// SourceSnapshotID is the snapshot the volume was restored from, if any.
+	SourceSnapshotID string `json:"sourceSnapshotId,omitempty"`
+	// SourceVolumeID is the volume the volume was cloned from, if any.
+	SourceVolumeID string `json:"sourceVolumeId,omitempty"`
+	// ResizePending is set when the backing file was grown but the filesystem was not.
+	ResizePending bool `json:"resizePending,omitempty"`
+	// Source is the archive in the source catalog a new ephemeral volume was seeded from.
+	Source string `json:"source,omitempty"`
+	// SourceImage is the OCI image a new ephemeral volume was seeded from, pinned to its digest.
+	SourceImage string `json:"sourceImage,omitempty"`
+	// Archive is set for ephemeral volumes whose backing file is archived instead of deleted.
+	Archive bool `json:"archive,omitempty"`
+	// Encrypted is set for volumes encrypted with LUKS, which are used through a dm-crypt
+	// mapping instead of a loop mount.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Unformatted is set for encrypted persistent volumes until their first publish, which
+	// formats them with the key passed to the node.
+	Unformatted bool `json:"unformatted,omitempty"`
+	// CacheKey is the cache an ephemeral volume was checked out from and is written back to,
+	// as namespace/key. Empty for volumes without a cache.
+	CacheKey string `json:"cacheKey,omitempty"`
+	// RetainKey is the pod identity an ephemeral volume is kept for after unpublishing,
+	// as namespace/pod/volume. Empty for volumes deleted on unpublish.
+	RetainKey string `json:"retainKey,omitempty"`
+	// ReleasedAt is when a retained volume was last unpublished, nil while it is in use.
+	ReleasedAt *time.Time `json:"releasedAt,omitempty"`
+	// TargetPaths lists the paths the volume is currently mounted at.
+	TargetPaths []string `json:"targetPaths,omitempty"`
+	// SELinuxContext is the context= mount option the filesystem is mounted with while it is
+	// mounted, as passed by kubelet. Empty for mounts without one.
+	SELinuxContext string `json:"seLinuxContext,omitempty"`
+	// IDMap is the X-mount.idmap mount option the filesystem is mounted with while it is
+	// mounted, mapping the IDs on disk into the user namespace of the pod. Empty without one.
+	IDMap string `json:"idMap,omitempty"`
+	// CreatedAt is when the volume was created.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Snapshot describes a point-in-time copy of a persistent volume.
+type Snapshot struct {
+	// ID is the CSI snapshot ID.
+	ID string `json:"id"`
+	// SourceVolumeID is the volume the snapshot was taken from.
+	SourceVolumeID string `json:"sourceVolumeId"`
+	// Filesystem is the filesystem of the copied image, empty for btrfs.
+	Filesystem string `json:"filesystem,omitempty"`
+	// Encrypted is set if the copied image is encrypted with LUKS.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Unformatted is set if the source volume was not formatted yet.
+	Unformatted bool `json:"unformatted,omitempty"`
+	// BackingFile is the path of the copied image.
+	BackingFile string `json:"backingFile"`
+	// Size is the size of the copied image in bytes.
+	Size int64 `json:"size"`
+	// ResizePending is set if the filesystem of the copied image was not grown to its size yet.
+	ResizePending bool `json:"resizePending,omitempty"`
+	// CreatedAt is when the snapshot was taken.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Cache describes a node-local cache image shared by the inline volumes with the same cache key.
+type Cache struct {
+	// Key is the namespace and cache key of the volumes sharing the cache, as namespace/key.
+	Key string `json:"key"`
+	// Pool is the storage pool the cache image lives in.
+	Pool string `json:"pool,omitempty"`
+	// Filesystem is the filesystem of the cache image, empty for btrfs.
+	Filesystem string `json:"filesystem,omitempty"`
+	// BackingFile is the path of the cache image.
+	BackingFile string `json:"backingFile"`
+	// Size is the apparent size of the cache image in bytes.
+	Size int64 `json:"size"`
+	// LastUsedAt is when the cache was last checked out or written back.
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// Wipe describes the backing file of a deleted volume queued for overwriting.
+type Wipe struct {
+	// BackingFile is the path of the backing file, moved out of the way of new volumes.
+	BackingFile string `json:"backingFile"`
+	// VolumeID is the volume the backing file belonged to, or the cache, snapshot or archive it held.
+	VolumeID string `json:"volumeId"`
+	// Pool is the storage pool the backing file lives in.
+	Pool string `json:"pool,omitempty"`
+	// Size is the apparent size of the backing file in bytes.
+	Size int64 `json:"size"`
+	// Offset is the offset up to which the backing file was overwritten.
+	Offset int64 `json:"offset,omitempty"`
+	// Attempts is the number of failed attempts to wipe the backing file.
+	Attempts int `json:"attempts,omitempty"`
+	// Error is the failure of the last attempt, empty if none failed.
+	Error string `json:"error,omitempty"`
+	// QueuedAt is when the volume was deleted.
+	QueuedAt time.Time `json:"queuedAt"`
+}
+
+type data struct {
+	Volumes   map[string]Volume   `json:"volumes"`
+	Snapshots map[string]Snapshot `json:"snapshots"`
+	Caches    map[string]Cache    `json:"caches,omitempty"`
+	Wipes     map[string]Wipe     `json:"wipes,omitempty"`
+}
+
+// Store holds the driver state and persists it to a file.
+// It is safe for concurrent use.
+type Store struct {
+	mu   sync.Mutex
+	fs   afero.Fs
+	path string
+	data data
+	// reservations holds the volumes whose backing files are being created, by ID.
+	reservations map[string]Volume
+}
+
+// Open loads the state from the given path of the filesystem.
+// A missing file yields an empty state that is created on the first change.
+//
+// Returns an error if the file exists but cannot be read or parsed.
+func Open(fs afero.Fs, path string) (*Store, error) {
+	s := &Store{
+		fs:           fs,
+		path:         path,
+		reservations: map[string]Volume{},
+		data: data{
+			Volumes:   map[string]Volume{},
+			Snapshots: map[string]Snapshot{},
+			Caches:    map[string]Cache{},
+			Wipes:     map[string]Wipe{},
+		},
+	}
+
+	content, err := afero.ReadFile(fs, path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(content, &s.data); err != nil {
+		return nil, fmt.Errorf("failed to parse state %s: %v", path, err)
+	}
+	if s.data.Volumes == nil {
+		s.data.Volumes = map[string]Volume{}
+	}
+	if s.data.Snapshots == nil {
+		s.data.Snapshots = map[string]Snapshot{}
+	}
+	if s.data.Caches == nil {
+		s.data.Caches = map[string]Cache{}
+	}
+	if s.data.Wipes == nil {
+		s.data.Wipes = map[string]Wipe{}
+	}
+	return s, nil
+}
+
+// GetVolume returns the volume with the given ID.
+func (s *Store) GetVolume(id string) (Volume, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.data.Volumes[id]
+	return v, ok
+}
+
+// Volumes returns all volumes ordered by ID.
+func (s *Store) Volumes() []Volume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	volumes := make([]Volume, 0, len(s.data.Volumes))
+	for _, v := range s.data.Volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].ID < volumes[j].ID })
+	return volumes
+}
+
+// PutVolume adds or replaces a volume and persists the state.
+// A reservation of the volume is replaced by it.
+func (s *Store) PutVolume(v Volume) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.reservations, v.ID)
+	s.data.Volumes[v.ID] = v
+	return s.save()
+}
+
+// Reserve holds the place of a new volume while its backing file is created, until the volume
+// is put or the reservation is cancelled. Reservations are only kept in memory.
+// Returns false if a volume with the same ID is recorded or reserved already.
+func (s *Store) Reserve(v Volume) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.Volumes[v.ID]; ok {
+		return false
+	}
+	if _, ok := s.reservations[v.ID]; ok {
+		return false
+	}
+	s.reservations[v.ID] = v
+	return true
+}
+
+// CancelReservation drops the reservation of the volume with the given ID.
+// Cancelling an unknown reservation is not an error.
+func (s *Store) CancelReservation(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.reservations, id)
+}
+
+// Reservations returns the reserved volumes ordered by ID.
+func (s *Store) Reservations() []Volume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	volumes := make([]Volume, 0, len(s.reservations))
+	for _, v := range s.reservations {
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].ID < volumes[j].ID })
+	return volumes
+}
+
+// ReplaceVolume replaces the volume with the given ID by a volume with another ID
+// and persists the state, so the volume is never lost or recorded twice.
+func (s *Store) ReplaceVolume(id string, v Volume) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.Volumes, id)
+	s.data.Volumes[v.ID] = v
+	return s.save()
+}
+
+// DeleteVolume removes a volume and persists the state.
+// Removing an unknown volume is not an error.
+func (s *Store) DeleteVolume(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.Volumes, id)
+	return s.save()
+}
+
+// GetSnapshot returns the snapshot with the given ID.
+func (s *Store) GetSnapshot(id string) (Snapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, ok := s.data.Snapshots[id]
+	return snap, ok
+}
+
+// Snapshots returns all snapshots ordered by ID.
+func (s *Store) Snapshots() []Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots := make([]Snapshot, 0, len(s.data.Snapshots))
+	for _, snap := range s.data.Snapshots {
+		snapshots = append(snapshots, snap)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	return snapshots
+}
+
+// PutSnapshot adds or replaces a snapshot and persists the state.
+func (s *Store) PutSnapshot(snap Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Snapshots[snap.ID] = snap
+	return s.save()
+}
+
+// DeleteSnapshot removes a snapshot and persists the state.
+// Removing an unknown snapshot is not an error.
+func (s *Store) DeleteSnapshot(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.Snapshots, id)
+	return s.save()
+}
+
+// GetCache returns the cache with the given key.
+func (s *Store) GetCache(key string) (Cache, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.data.Caches[key]
+	return c, ok
+}
+
+// Caches returns all caches ordered by key.
+func (s *Store) Caches() []Cache {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	caches := make([]Cache, 0, len(s.data.Caches))
+	for _, c := range s.data.Caches {
+		caches = append(caches, c)
+	}
+	sort.Slice(caches, func(i, j int) bool { return caches[i].Key < caches[j].Key })
+	return caches
+}
+
+// PutCache adds or replaces a cache and persists the state.
+func (s *Store) PutCache(c Cache) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Caches[c.Key] = c
+	return s.save()
+}
+
+// DeleteCache removes a cache and persists the state.
+// Removing an unknown cache is not an error.
+func (s *Store) DeleteCache(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.Caches, key)
+	return s.save()
+}
+
+// GetWipe returns the wipe of the given backing file.
+func (s *Store) GetWipe(backingFile string) (Wipe, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.data.Wipes[backingFile]
+	return w, ok
+}
+
+// Wipes returns all queued wipes ordered by the time they were queued.
+func (s *Store) Wipes() []Wipe {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wipes := make([]Wipe, 0, len(s.data.Wipes))
+	for _, w := range s.data.Wipes {
+		wipes = append(wipes, w)
+	}
+	sort.Slice(wipes, func(i, j int) bool {
+		if !wipes[i].QueuedAt.Equal(wipes[j].QueuedAt) {
+			return wipes[i].QueuedAt.Before(wipes[j].QueuedAt)
+		}
+		return wipes[i].BackingFile < wipes[j].BackingFile
+	})
+	return wipes
+}
+
+// PutWipe adds or replaces a wipe, keyed by its backing file, and persists the state.
+func (s *Store) PutWipe(w Wipe) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Wipes[w.BackingFile] = w
+	return s.save()
+}
+
+// DeleteWipe removes a wipe and persists the state.
+// Removing an unknown wipe is not an error.
+func (s *Store) DeleteWipe(backingFile string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.Wipes, backingFile)
+	return s.save()
+}
+
+// save writes the state to a temporary file and renames it into place,
+// so a crash never leaves a truncated state file behind.
+// Callers must hold s.mu.
+func (s *Store) save() error {
+	content, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+
+	s.fs.MkdirAll(filepath.Dir(s.path), 0755)
+
+	tmp := s.path + ".tmp"
+	if err := afero.WriteFile(s.fs, tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	if err := s.fs.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Driver state persistence tests.
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_Persistence(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	path := "/var/lib/csi-loop/state.json"
+
+	store, err := Open(fs, path)
+	require.NoError(t, err)
+	assert.Empty(t, store.Volumes())
+	assert.Empty(t, store.Snapshots())
+
+	require.NoError(t, store.PutVolume(Volume{ID: "pvc-b", Size: 2}))
+	require.NoError(t, store.PutVolume(Volume{ID: "pvc-a", Size: 1}))
+	require.NoError(t, store.PutSnapshot(Snapshot{ID: "snap-a", SourceVolumeID: "pvc-a"}))
+	require.NoError(t, store.PutCache(Cache{Key: "ci/go-mod", Size: 3}))
+	require.NoError(t, store.PutWipe(Wipe{BackingFile: "/var/lib/csi-loop/wipe/b.img", QueuedAt: time.Unix(2, 0)}))
+	require.NoError(t, store.PutWipe(Wipe{BackingFile: "/var/lib/csi-loop/wipe/a.img", QueuedAt: time.Unix(3, 0), Offset: 4}))
+
+	// Reopening reads back what was written
+	reopened, err := Open(fs, path)
+	require.NoError(t, err)
+
+	volumes := reopened.Volumes()
+	require.Len(t, volumes, 2)
+	assert.Equal(t, "pvc-a", volumes[0].ID)
+	assert.Equal(t, "pvc-b", volumes[1].ID)
+
+	snapshot, ok := reopened.GetSnapshot("snap-a")
+	require.True(t, ok)
+	assert.Equal(t, "pvc-a", snapshot.SourceVolumeID)
+
+	cache, ok := reopened.GetCache("ci/go-mod")
+	require.True(t, ok)
+	assert.Equal(t, int64(3), cache.Size)
+
+	wipes := reopened.Wipes()
+	require.Len(t, wipes, 2)
+	assert.Equal(t, "/var/lib/csi-loop/wipe/b.img", wipes[0].BackingFile, "wipes should be ordered by queue time")
+	assert.Equal(t, int64(4), wipes[1].Offset)
+
+	require.NoError(t, reopened.ReplaceVolume("pvc-a", Volume{ID: "pvc-c", Size: 1}))
+	require.NoError(t, reopened.DeleteVolume("pvc-b"))
+	require.NoError(t, reopened.DeleteSnapshot("snap-a"))
+	require.NoError(t, reopened.DeleteSnapshot("snap-unknown"))
+	require.NoError(t, reopened.DeleteCache("ci/go-mod"))
+	require.NoError(t, reopened.DeleteWipe("/var/lib/csi-loop/wipe/a.img"))
+	require.NoError(t, reopened.DeleteWipe("/var/lib/csi-loop/wipe/b.img"))
+
+	reopened, err = Open(fs, path)
+	require.NoError(t, err)
+	_, ok = reopened.GetVolume("pvc-b")
+	assert.False(t, ok)
+	volumes = reopened.Volumes()
+	require.Len(t, volumes, 1)
+	assert.Equal(t, "pvc-c", volumes[0].ID)
+	assert.Empty(t, reopened.Snapshots())
+	assert.Empty(t, reopened.Caches())
+	assert.Empty(t, reopened.Wipes())
+
+	exists, _ := afero.Exists(fs, path+".tmp")
+	assert.False(t, exists, "temporary state file should be renamed into place")
+}
+
+func TestOpen_InvalidFile(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	path := "/var/lib/csi-loop/state.json"
+	require.NoError(t, afero.WriteFile(fs, path, []byte("{"), 0644))
+
+	_, err := Open(fs, path)
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse state")
+}
+
+func TestStore_Reservations(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	path := "/var/lib/csi-loop/state.json"
+	store, err := Open(fs, path)
+	require.NoError(t, err)
+	require.NoError(t, store.PutVolume(Volume{ID: "pvc-a"}))
+
+	// A volume is only reserved once, and not if it is recorded already
+	assert.True(t, store.Reserve(Volume{ID: "pvc-b", Size: 2}))
+	assert.False(t, store.Reserve(Volume{ID: "pvc-b", Size: 2}))
+	assert.False(t, store.Reserve(Volume{ID: "pvc-a"}))
+	assert.True(t, store.Reserve(Volume{ID: "pvc-c", Size: 3}))
+	assert.Equal(t, []Volume{{ID: "pvc-b", Size: 2}, {ID: "pvc-c", Size: 3}}, store.Reservations())
+
+	// Putting the volume replaces its reservation, cancelling drops it
+	require.NoError(t, store.PutVolume(Volume{ID: "pvc-b", Size: 2}))
+	store.CancelReservation("pvc-c")
+	assert.Empty(t, store.Reservations())
+
+	// Reservations are not persisted
+	reopened, err := Open(fs, path)
+	require.NoError(t, err)
+	assert.Len(t, reopened.Volumes(), 2)
+	assert.Empty(t, reopened.Reservations())
+}